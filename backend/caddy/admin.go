@@ -0,0 +1,302 @@
+package caddy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+
+	"github.com/damnever/goodog/internal/pkg/traffic"
+)
+
+// closeReasonAdmin is the close reason of the sessions terminated by the admin API.
+const closeReasonAdmin = "admin"
+
+// _sessions tracks the live sessions of all the handlers.
+var _sessions = newSessionTable()
+
+func init() {
+	err := caddy.RegisterModule(adminAPI{})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// adminAPI registers the routes of goodog in the Caddy admin API.
+type adminAPI struct{}
+
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.goodog",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+func (adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/goodog/metrics", Handler: caddy.AdminHandlerFunc(handleMetrics)},
+		{Pattern: "/goodog/sessions", Handler: caddy.AdminHandlerFunc(handleSessions)},
+		{Pattern: "/goodog/sessions/", Handler: caddy.AdminHandlerFunc(handleSession)},
+		{Pattern: "/goodog/stats", Handler: caddy.AdminHandlerFunc(handleStats)},
+	}
+}
+
+// handleMetrics serves the metrics in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return errMethodNotAllowed()
+	}
+	_registry.ServeHTTP(w, r)
+	return nil
+}
+
+// handleSessions lists the live sessions by the handlers(GET), or terminates the
+// sessions of a user(DELETE), both of them can be filtered by the handler and the user.
+func handleSessions(w http.ResponseWriter, r *http.Request) error {
+	handler, user := r.URL.Query().Get("handler"), r.URL.Query().Get("user")
+	match := func(s *liveSession) bool {
+		return (handler == "" || s.handler == handler) && (user == "" || s.user == user)
+	}
+	switch r.Method {
+	case http.MethodGet:
+		sessions := map[string][]sessionInfo{}
+		for _, name := range _sessions.handlers() {
+			if handler == "" || name == handler {
+				sessions[name] = []sessionInfo{}
+			}
+		}
+		for _, info := range _sessions.list(match) {
+			sessions[info.Handler] = append(sessions[info.Handler], info)
+		}
+		return writeJSON(w, sessions)
+	case http.MethodDelete:
+		if user == "" {
+			return caddy.APIError{Code: http.StatusBadRequest, Err: fmt.Errorf("user is required")}
+		}
+		return writeJSON(w, map[string]int{"terminated": _sessions.terminate(match)})
+	default:
+		return errMethodNotAllowed()
+	}
+}
+
+// handleSession terminates the session by the ID.
+func handleSession(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodDelete {
+		return errMethodNotAllowed()
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/goodog/sessions/"), 10, 64)
+	if err != nil {
+		return caddy.APIError{Code: http.StatusBadRequest, Err: fmt.Errorf("invalid session id: %v", err)}
+	}
+	if _sessions.terminate(func(s *liveSession) bool { return s.id == id }) == 0 {
+		return caddy.APIError{Code: http.StatusNotFound, Err: fmt.Errorf("session not found: %d", id)}
+	}
+	return writeJSON(w, map[string]int{"terminated": 1})
+}
+
+// handleStats responds with the traffic by the protocols since the start, and
+// the live sessions summed up by the handlers.
+func handleStats(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return errMethodNotAllowed()
+	}
+	protocols := map[string]protocolStats{}
+	for name, counters := range _traffic {
+		protocols[name] = protocolStats{
+			Sessions:    counters.Sessions.Load(),
+			Active:      counters.Active.Load(),
+			BytesUp:     counters.BytesUp.Load(),
+			BytesDown:   counters.BytesDown.Load(),
+			PacketsUp:   counters.PacketsUp.Load(),
+			PacketsDown: counters.PacketsDown.Load(),
+		}
+	}
+	handlers := map[string]*handlerStats{}
+	for _, name := range _sessions.handlers() {
+		handlers[name] = newHandlerStats()
+	}
+	for _, info := range _sessions.list(func(*liveSession) bool { return true }) {
+		stats, ok := handlers[info.Handler]
+		if !ok { // The handler is gone, the session is not done yet.
+			stats = newHandlerStats()
+			handlers[info.Handler] = stats
+		}
+		stats.Active[info.Protocol]++
+		stats.Users[info.User]++
+		stats.BytesUp += info.BytesUp
+		stats.BytesDown += info.BytesDown
+	}
+	return writeJSON(w, map[string]interface{}{"protocols": protocols, "handlers": handlers})
+}
+
+type protocolStats struct {
+	Sessions    uint64 `json:"sessions"`
+	Active      int64  `json:"active"`
+	BytesUp     uint64 `json:"bytes_up"`
+	BytesDown   uint64 `json:"bytes_down"`
+	PacketsUp   uint64 `json:"packets_up"`
+	PacketsDown uint64 `json:"packets_down"`
+}
+
+// handlerStats sums up the live sessions of a handler.
+type handlerStats struct {
+	Active    map[string]int `json:"active"` // By the protocols.
+	Users     map[string]int `json:"users"`  // The active sessions by the users.
+	BytesUp   uint64         `json:"bytes_up"`
+	BytesDown uint64         `json:"bytes_down"`
+}
+
+func newHandlerStats() *handlerStats {
+	return &handlerStats{Active: map[string]int{}, Users: map[string]int{}}
+}
+
+func errMethodNotAllowed() error {
+	return caddy.APIError{
+		Code: http.StatusMethodNotAllowed,
+		Err:  fmt.Errorf("method not allowed"),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+// sessionTable tracks the live sessions and the handlers, so that they can be
+// inspected and terminated by the admin API.
+type sessionTable struct {
+	mu       sync.Mutex
+	nextID   uint64
+	sessions map[*traffic.Session]*liveSession
+	names    map[string]int // The handlers by the names, the names may be shared.
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{sessions: map[*traffic.Session]*liveSession{}, names: map[string]int{}}
+}
+
+type liveSession struct {
+	id        uint64
+	handler   string
+	user      string
+	remote    string
+	upstream  string
+	mux       string
+	session   *traffic.Session
+	terminate func()
+	release   func() // Called once it is done.
+}
+
+func (t *sessionTable) add(s *liveSession) {
+	t.mu.Lock()
+	t.nextID++
+	s.id = t.nextID
+	t.sessions[s.session] = s
+	t.mu.Unlock()
+}
+
+// remove forgets the session once it is done.
+func (t *sessionTable) remove(session *traffic.Session) {
+	t.mu.Lock()
+	s, ok := t.sessions[session]
+	delete(t.sessions, session)
+	t.mu.Unlock()
+	if ok && s.release != nil {
+		s.release()
+	}
+}
+
+// terminate terminates the sessions which match, it returns the number of them.
+func (t *sessionTable) terminate(match func(*liveSession) bool) int {
+	matched := []*liveSession{}
+	t.mu.Lock()
+	for _, s := range t.sessions {
+		if match(s) {
+			matched = append(matched, s)
+		}
+	}
+	t.mu.Unlock()
+	// They are removed once they are done.
+	for _, s := range matched {
+		s.session.SetCloseReason(closeReasonAdmin)
+		s.terminate()
+	}
+	return len(matched)
+}
+
+func (t *sessionTable) list(match func(*liveSession) bool) []sessionInfo {
+	t.mu.Lock()
+	infos := []sessionInfo{}
+	for _, s := range t.sessions {
+		if !match(s) {
+			continue
+		}
+		stats := s.session.Stats()
+		infos = append(infos, sessionInfo{
+			ID:          s.id,
+			Handler:     s.handler,
+			User:        s.user,
+			Remote:      s.remote,
+			Upstream:    s.upstream,
+			Mux:         s.mux,
+			Protocol:    stats.Protocol,
+			Start:       s.session.Start(),
+			Age:         stats.Duration.Round(time.Millisecond).String(),
+			BytesUp:     stats.BytesUp,
+			BytesDown:   stats.BytesDown,
+			PacketsUp:   stats.PacketsUp,
+			PacketsDown: stats.PacketsDown,
+		})
+	}
+	t.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+type sessionInfo struct {
+	ID          uint64    `json:"id"`
+	Handler     string    `json:"-"`
+	User        string    `json:"user"`
+	Remote      string    `json:"remote"`
+	Upstream    string    `json:"upstream,omitempty"` // Empty for the packets of v2.
+	Mux         string    `json:"mux,omitempty"`
+	Protocol    string    `json:"protocol"`
+	Start       time.Time `json:"start"`
+	Age         string    `json:"age"`
+	BytesUp     uint64    `json:"bytes_up"`
+	BytesDown   uint64    `json:"bytes_down"`
+	PacketsUp   uint64    `json:"packets_up,omitempty"`
+	PacketsDown uint64    `json:"packets_down,omitempty"`
+}
+
+// register registers a handler, it is listed even if it has no sessions.
+func (t *sessionTable) register(name string) {
+	t.mu.Lock()
+	t.names[name]++
+	t.mu.Unlock()
+}
+
+func (t *sessionTable) unregister(name string) {
+	t.mu.Lock()
+	if t.names[name]--; t.names[name] <= 0 {
+		delete(t.names, name)
+	}
+	t.mu.Unlock()
+}
+
+func (t *sessionTable) handlers() []string {
+	t.mu.Lock()
+	names := make([]string, 0, len(t.names))
+	for name := range t.names {
+		names = append(names, name)
+	}
+	t.mu.Unlock()
+	sort.Strings(names)
+	return names
+}
@@ -1,10 +1,15 @@
 package caddy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	caddy "github.com/caddyserver/caddy/v2"
@@ -12,9 +17,13 @@ import (
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	ioext "github.com/damnever/libext-go/io"
+	"github.com/hashicorp/yamux"
 	"go.uber.org/zap"
 
-	"github.com/damnever/goodog/internal/pkg/snappypool"
+	"github.com/damnever/goodog/internal/pkg/acl"
+	"github.com/damnever/goodog/internal/pkg/compression"
+	"github.com/damnever/goodog/internal/pkg/protocol"
+	"github.com/damnever/goodog/internal/pkg/traffic"
 )
 
 func init() {
@@ -34,8 +43,10 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 type GoodogCaddyAdapter struct {
 	Options // For JSON config
 
-	forwarder *forwarder
-	logger    *zap.Logger
+	forwarder  *forwarder
+	features   string // See protocol.HeaderFeatures.
+	logger     *zap.Logger
+	registered bool // In the admin API.
 }
 
 func (GoodogCaddyAdapter) CaddyModule() caddy.ModuleInfo {
@@ -48,10 +59,20 @@ func (GoodogCaddyAdapter) CaddyModule() caddy.ModuleInfo {
 func (g *GoodogCaddyAdapter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
 		args := d.RemainingArgs()
+		if len(args) == 1 && args[0] == "allow_private" {
+			g.Options.AllowPrivate = true
+			continue
+		}
+		if len(args) == 1 && args[0] == "masque" {
+			g.Options.MASQUE = true
+			continue
+		}
 		if len(args) < 2 {
 			continue
 		}
 		switch args[0] {
+		case "name":
+			g.Options.Name = args[1]
 		case "upstream_tcp":
 			g.Options.UpstreamTCP = args[1]
 		case "upstream_udp":
@@ -68,6 +89,32 @@ func (g *GoodogCaddyAdapter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return err
 			}
 			g.Options.Timeout = d
+		case "allow_cidrs":
+			g.Options.AllowCIDRs = append(g.Options.AllowCIDRs, args[1:]...)
+		case "deny_cidrs":
+			g.Options.DenyCIDRs = append(g.Options.DenyCIDRs, args[1:]...)
+		case "allow_ports":
+			g.Options.AllowPorts = append(g.Options.AllowPorts, args[1:]...)
+		case "deny_ports":
+			g.Options.DenyPorts = append(g.Options.DenyPorts, args[1:]...)
+		case "allow_domains":
+			g.Options.AllowDomains = append(g.Options.AllowDomains, args[1:]...)
+		case "deny_domains":
+			g.Options.DenyDomains = append(g.Options.DenyDomains, args[1:]...)
+		case "allow_private":
+			allow, err := strconv.ParseBool(args[1])
+			if err != nil {
+				return err
+			}
+			g.Options.AllowPrivate = allow
+		case "masque":
+			enable, err := strconv.ParseBool(args[1])
+			if err != nil {
+				return err
+			}
+			g.Options.MASQUE = enable
+		case "masque_template":
+			g.Options.MASQUETemplate = args[1]
 		}
 	}
 	return nil
@@ -76,8 +123,18 @@ func (g *GoodogCaddyAdapter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 func (g *GoodogCaddyAdapter) Provision(ctx caddy.Context) error {
 	g.logger = ctx.Logger(g)
 	(&g.Options).withDefaults()
-	g.forwarder = newForwarder(g.logger, g.Options)
-	g.logger.Info("goodog configured")
+	forwarder, err := newForwarder(g.logger, g.Options)
+	if err != nil {
+		return err
+	}
+	g.forwarder = forwarder
+	g.features = protocol.Features(g.Options.MASQUE, compression.Methods())
+	_sessions.register(g.Options.Name)
+	g.registered = true
+	if g.Options.MASQUE && !extendedConnectEnabled() {
+		g.logger.Warn("MASQUE over HTTP/2 is disabled, run with GODEBUG=http2xconnect=1 to accept the extended CONNECT")
+	}
+	g.logger.Info("goodog configured", zap.String("name", g.Options.Name))
 	return nil
 }
 
@@ -85,60 +142,352 @@ func (g *GoodogCaddyAdapter) Validate() error {
 	if g.forwarder == nil {
 		return fmt.Errorf("goodog: not initialized")
 	}
-	if g.Options.UpstreamTCP == "" && g.Options.UpstreamUDP == "" {
-		return fmt.Errorf("goodog: one of upstream_tcp or upstream_udp must be given")
+	if g.Options.UpstreamTCP == "" && g.Options.UpstreamUDP == "" && !g.Options.MASQUE {
+		return fmt.Errorf("goodog: one of upstream_tcp, upstream_udp or masque must be given")
+	}
+	if g.Options.MASQUE {
+		if _, err := protocol.ExpandMASQUETemplate(g.Options.MASQUETemplate, "x", 1); err != nil {
+			return fmt.Errorf("goodog: bad masque_template: %v", err)
+		}
 	}
 	return nil
 }
 
 func (g *GoodogCaddyAdapter) Cleanup() error {
+	if g.registered { // The sessions live until they are done.
+		_sessions.unregister(g.Options.Name)
+		g.registered = false
+	}
 	return g.logger.Sync()
 }
 
 func (g *GoodogCaddyAdapter) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if g.Options.MASQUE && isMASQUERequest(r) {
+		return g.serveMASQUE(w, r)
+	}
+	if r.URL.Query().Get("protocol") == "ping" { // The health check of the frontend.
+		w.Header().Set(protocol.HeaderFeatures, g.features)
+		w.WriteHeader(http.StatusNoContent)
+		r.Body.Close()
+		return nil
+	}
 	if r.Method != http.MethodPost {
 		return next.ServeHTTP(w, r)
 	}
 
+	w.Header().Set(protocol.HeaderFeatures, g.features)
 	args := r.URL.Query()
-	if args.Get("version") != "v1" {
+	version := args.Get("version")
+	network := strings.ToLower(args.Get("protocol"))
+	mux := args.Get("mux")
+	if (version != protocol.V1 && version != protocol.V2) || (network != "tcp" && network != "udp") ||
+		(mux != "" && !(mux == protocol.MuxYamux && network == "tcp") && !(mux == protocol.MuxPacket && network == "udp")) {
+		countRejected("bad-request")
+		w.WriteHeader(http.StatusBadRequest)
+		r.Body.Close()
+		return nil
+	}
+	// The stream is corrupted if the two sides disagree on the compression.
+	codec, err := compression.Lookup(args.Get("compression"))
+	if err != nil {
+		g.logger.Warn("bad compression", zap.String("remote", r.RemoteAddr), zap.Error(err))
+		countRejected("bad-compression")
 		w.WriteHeader(http.StatusBadRequest)
 		r.Body.Close()
 		return nil
 	}
+	w.Header().Set(protocol.HeaderVersion, version)
+	if method := strings.ToLower(args.Get("compression")); method != "" {
+		w.Header().Set(protocol.HeaderCompression, method)
+	} else {
+		w.Header().Set(protocol.HeaderCompression, protocol.CompressionNone)
+	}
+	switch mux {
+	case protocol.MuxYamux:
+		return g.serveYamux(w, r, version, codec)
+	case protocol.MuxPacket:
+		return g.servePackets(w, r, version, codec)
+	}
 
+	upstreamConn, upstream, status := g.dial(r, r.Body, version, network)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		r.Body.Close()
+		return nil
+	}
+
+	fw := newFlushWriter(w)
 	sw := &caddyStreamWrapper{
 		Reader: r.Body,
-		Writer: w,
+		Writer: fw,
+		Closer: r.Body,
+	}
+	defer g.withCompression(sw, codec)()
+
+	w.Header().Set("Transfer-Encoding", "chunked")
+	w.WriteHeader(http.StatusOK)
+	fw.Flush() // The client is waiting for it.
+	ctx, session := g.startSession(r.Context(), r, network, upstream, "")
+	if network == "udp" {
+		err = g.forwarder.ForwardUDP(ctx, sw, upstreamConn, session)
+	} else {
+		err = g.forwarder.ForwardTCP(ctx, sw, upstreamConn, session)
+	}
+	// The error is in the access record, Caddy would log it again and write the status.
+	g.sessionDone(r, session, err, zap.String("upstream", upstream))
+	return nil
+}
+
+// serveYamux serves the TCP streams multiplexed by yamux, see protocol.MuxYamux.
+func (g *GoodogCaddyAdapter) serveYamux(w http.ResponseWriter, r *http.Request, version string, codec compression.Codec) error {
+	w.Header().Set("Transfer-Encoding", "chunked")
+	w.WriteHeader(http.StatusOK)
+	fw := newFlushWriter(w)
+	fw.Flush()
+
+	// The session may still be writing when the handler returns.
+	cw := &closableWriter{w: fw}
+	defer cw.Close()
+	session, err := yamux.Server(&caddyStreamWrapper{
+		Reader: r.Body,
+		Writer: cw,
 		Closer: r.Body,
+	}, protocol.NewYamuxConfig())
+	if err != nil {
+		r.Body.Close()
+		return err
 	}
-	switch strings.ToLower(args.Get("compression")) {
-	case "snappy":
-		snappyr := snappypool.GetReader(r.Body)
-		sw.Reader = snappyr
-		snappyw := snappypool.GetWriter(w)
-		sw.Writer = snappyw
-		defer func() {
-			snappypool.PutReader(snappyr)
-			snappypool.PutWriter(snappyw)
+	defer session.Close()
+
+	ctx := r.Context()
+	go func() {
+		<-ctx.Done()
+		session.Close()
+	}()
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			session.Close()
+			if err == io.EOF || err == yamux.ErrSessionShutdown {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.serveYamuxStream(ctx, r, stream, version, codec)
 		}()
-	default:
-	}
-
-	switch strings.ToLower(args.Get("protocol")) {
-	case "tcp":
-		w.Header().Set("Transfer-Encoding", "chunked")
-		w.WriteHeader(http.StatusOK)
-		return g.forwarder.ForwardTCP(r.Context(), sw)
-	case "udp":
-		w.Header().Set("Transfer-Encoding", "chunked")
-		w.WriteHeader(http.StatusOK)
-		return g.forwarder.ForwardUDP(r.Context(), sw)
-	default:
-		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (g *GoodogCaddyAdapter) serveYamuxStream(ctx context.Context, r *http.Request, stream *yamux.Stream, version string, codec compression.Codec) {
+	upstreamConn, upstream, status := g.dial(r, stream, version, "tcp")
+	if err := protocol.WriteStatus(stream, uint16(status)); err != nil || status != http.StatusOK {
+		if upstreamConn != nil {
+			upstreamConn.Close()
+		}
+		stream.Close()
+		return
+	}
+
+	sw := &caddyStreamWrapper{
+		Reader: stream,
+		Writer: stream,
+		Closer: stream,
+	}
+	defer g.withCompression(sw, codec)()
+	ctx, session := g.startSession(ctx, r, "tcp", upstream, protocol.MuxYamux)
+	err := g.forwarder.ForwardTCP(ctx, sw, upstreamConn, session)
+	g.sessionDone(r, session, err, zap.String("upstream", upstream), zap.String("mux", protocol.MuxYamux))
+}
+
+// servePackets serves the UDP packets multiplexed over the stream, see protocol.MuxPacket.
+func (g *GoodogCaddyAdapter) servePackets(w http.ResponseWriter, r *http.Request, version string, codec compression.Codec) error {
+	if version == protocol.V1 && g.Options.UpstreamUDP == "" {
+		w.WriteHeader(http.StatusBadGateway)
 		r.Body.Close()
+		return nil
 	}
-	return nil
+
+	fw := newFlushWriter(w)
+	sw := &caddyStreamWrapper{
+		Reader: r.Body,
+		Writer: fw,
+		Closer: r.Body,
+	}
+	defer g.withCompression(sw, codec)()
+
+	w.Header().Set("Transfer-Encoding", "chunked")
+	w.WriteHeader(http.StatusOK)
+	fw.Flush()
+	user := authenticatedUser(r)
+	upstream := ""
+	if version == protocol.V1 {
+		upstream = g.Options.UpstreamUDP
+	}
+	return g.forwarder.ForwardPackets(r.Context(), sw, version == protocol.V2, func(dst *protocol.Addr, err error) {
+		countDialError("udp", err)
+		var derr *acl.DeniedError
+		if errors.As(err, &derr) {
+			g.logger.Warn("destination denied",
+				zap.String("user", user),
+				zap.String("remote", r.RemoteAddr),
+				zap.String("protocol", "udp"),
+				zap.Stringer("upstream", dst),
+				zap.String("reason", derr.Reason),
+			)
+			return
+		}
+		g.logger.Warn("resolve upstream failed",
+			zap.String("protocol", "udp"),
+			zap.Stringer("upstream", dst),
+			zap.Error(err),
+		)
+	}, func(src *protocol.Addr, session *traffic.Session, terminate func()) {
+		g.trackSession(r, session, upstream, protocol.MuxPacket, terminate, nil)
+	}, func(src *protocol.Addr, session *traffic.Session) {
+		fields := []zap.Field{zap.Stringer("src", src), zap.String("mux", protocol.MuxPacket)}
+		if upstream != "" {
+			fields = append(fields, zap.String("upstream", upstream))
+		}
+		g.sessionDone(r, session, nil, fields...)
+	})
+}
+
+// dial dials the upstream for the stream, the preamble is read from the body
+// in protocol v2, it returns the upstream and the status for the client.
+func (g *GoodogCaddyAdapter) dial(r *http.Request, body io.Reader, version, network string) (net.Conn, string, int) {
+	var (
+		upstream     string
+		upstreamConn net.Conn
+		err          error
+	)
+	if version == protocol.V2 { // The preamble is not compressed.
+		dst, err0 := protocol.ReadPreamble(body)
+		if err0 != nil || dst.Network != network {
+			g.logger.Debug("bad preamble", zap.String("protocol", network), zap.Error(err0))
+			return nil, "", http.StatusBadRequest
+		}
+		upstream = dst.String()
+		upstreamConn, err = g.forwarder.DialDestination(r.Context(), dst)
+	} else {
+		upstream = g.Options.UpstreamTCP
+		if network == "udp" {
+			upstream = g.Options.UpstreamUDP
+		}
+		upstreamConn, err = g.forwarder.Dial(r.Context(), network, upstream)
+	}
+	if err == nil {
+		return upstreamConn, upstream, http.StatusOK
+	}
+	return nil, upstream, g.dialStatus(r, network, upstream, err)
+}
+
+// startSession starts a session of the network(or masque), it is tracked by the admin
+// API until it is done, the returned ctx is canceled if it is terminated.
+func (g *GoodogCaddyAdapter) startSession(ctx context.Context, r *http.Request, network, upstream, mux string) (context.Context, *traffic.Session) {
+	ctx, cancel := context.WithCancel(ctx)
+	session := traffic.NewSession(network, _traffic[network])
+	g.trackSession(r, session, upstream, mux, cancel, cancel)
+	return ctx, session
+}
+
+func (g *GoodogCaddyAdapter) trackSession(r *http.Request, session *traffic.Session, upstream, mux string,
+	terminate func(), release func()) {
+	_sessions.add(&liveSession{
+		handler:   g.Options.Name,
+		user:      authenticatedUser(r),
+		remote:    r.RemoteAddr,
+		upstream:  upstream,
+		mux:       mux,
+		session:   session,
+		terminate: terminate,
+		release:   release,
+	})
+}
+
+// sessionDone closes the session and logs the access record of it.
+func (g *GoodogCaddyAdapter) sessionDone(r *http.Request, session *traffic.Session, err error, fields ...zap.Field) {
+	_sessions.remove(session)
+	stats := session.Close(closeReasonError) // The forwarders set the reason if they know it.
+	_sessionSeconds[stats.Protocol].Observe(stats.Duration.Seconds())
+
+	method := strings.ToLower(r.URL.Query().Get("compression"))
+	if method == "" || stats.Protocol == "masque" {
+		method = protocol.CompressionNone
+	}
+	fields = append(fields,
+		zap.String("user", authenticatedUser(r)),
+		zap.String("remote", r.RemoteAddr),
+		zap.String("compression", method),
+	)
+	fields = append(fields, stats.Fields()...)
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+	g.logger.Info("access", fields...)
+}
+
+// dialStatus logs the dial error and returns the status for the client.
+func (g *GoodogCaddyAdapter) dialStatus(r *http.Request, network, upstream string, err error) int {
+	countDialError(network, err)
+	var derr *acl.DeniedError
+	if errors.As(err, &derr) {
+		g.logger.Warn("destination denied",
+			zap.String("user", authenticatedUser(r)),
+			zap.String("remote", r.RemoteAddr),
+			zap.String("protocol", network),
+			zap.String("upstream", upstream),
+			zap.String("reason", derr.Reason),
+		)
+		return http.StatusForbidden
+	}
+	g.logger.Warn("dial upstream failed",
+		zap.String("protocol", network),
+		zap.String("upstream", upstream),
+		zap.Error(err),
+	)
+	return http.StatusBadGateway
+}
+
+// withCompression wraps the stream with the compression(nil means no compression),
+// the returned function must be called once the stream is done.
+func (g *GoodogCaddyAdapter) withCompression(sw *caddyStreamWrapper, codec compression.Codec) func() {
+	if codec == nil {
+		return func() {}
+	}
+	r := codec.NewReader(sw.Reader)
+	w := codec.NewWriter(sw.Writer)
+	sw.Reader, sw.Writer = r, w
+	return func() {
+		if reporter, ok := r.(compression.StatsReporter); ok { // The block based ones.
+			rstats, wstats := reporter.Stats(), w.(compression.StatsReporter).Stats()
+			_compression.add(rstats)
+			_compression.add(wstats)
+			g.logger.Debug("compression done",
+				zap.Uint64("read_raw_bytes", rstats.RawBytes),
+				zap.Uint64("read_wire_bytes", rstats.WireBytes),
+				zap.Uint64("written_raw_bytes", wstats.RawBytes),
+				zap.Uint64("written_wire_bytes", wstats.WireBytes),
+				zap.Uint64("stored_blocks", rstats.StoredBlocks+wstats.StoredBlocks),
+			)
+		}
+		r.Release()
+		w.Release()
+	}
+}
+
+// authenticatedUser returns the user authenticated by Caddy, if any.
+func authenticatedUser(r *http.Request) string {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return ""
+	}
+	user, _ := repl.Get("http.authentication.user.id")
+	return user
 }
 
 type caddyStreamWrapper struct {
@@ -156,3 +505,52 @@ func (s *caddyStreamWrapper) Write(p []byte) (n int, err error) {
 	}
 	return
 }
+
+// flushWriter flushes the http.ResponseWriter after every write, HTTP/2
+// buffers the response data otherwise.
+type flushWriter struct {
+	w http.ResponseWriter
+	f http.Flusher
+}
+
+func newFlushWriter(w http.ResponseWriter) *flushWriter {
+	f, _ := w.(http.Flusher)
+	return &flushWriter{w: w, f: f}
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err == nil {
+		fw.Flush()
+	}
+	return n, err
+}
+
+func (fw *flushWriter) Flush() {
+	if fw.f != nil {
+		fw.f.Flush()
+	}
+}
+
+// closableWriter refuses to write once it is closed.
+type closableWriter struct {
+	mu     sync.Mutex
+	closed bool
+	w      io.Writer
+}
+
+func (cw *closableWriter) Write(p []byte) (int, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.closed {
+		return 0, io.ErrClosedPipe
+	}
+	return cw.w.Write(p)
+}
+
+func (cw *closableWriter) Close() error {
+	cw.mu.Lock()
+	cw.closed = true
+	cw.mu.Unlock()
+	return nil
+}
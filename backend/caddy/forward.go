@@ -2,9 +2,11 @@ package caddy
 
 import (
 	"context"
+	"errors"
 	"io"
 	"math"
 	"net"
+	"syscall"
 
 	bytesext "github.com/damnever/libext-go/bytes"
 	errorsext "github.com/damnever/libext-go/errors"
@@ -12,51 +14,177 @@ import (
 	netext "github.com/damnever/libext-go/net"
 	"go.uber.org/zap"
 
+	"github.com/damnever/goodog/internal/pkg/acl"
 	"github.com/damnever/goodog/internal/pkg/encoding"
 	goodogioutil "github.com/damnever/goodog/internal/pkg/ioutil"
+	"github.com/damnever/goodog/internal/pkg/protocol"
+	"github.com/damnever/goodog/internal/pkg/traffic"
 )
 
+// The close reasons of the sessions, see traffic.Session.
+const (
+	closeReasonDownstreamEOF = "downstream-eof" // The client closes it.
+	closeReasonUpstreamEOF   = "upstream-eof"
+	closeReasonTimeout       = "timeout" // Idle for the timeout.
+	closeReasonCanceled      = "canceled"
+	closeReasonError         = "error"
+)
+
+// streamResult is the result of copying from the downstream or the upstream.
+type streamResult struct {
+	fromUpstream bool
+	err          error
+}
+
+// closeReason returns the close reason if the session is done because of the result.
+func (r streamResult) closeReason() string {
+	var nerr net.Error
+	switch {
+	case r.err == nil || r.err == io.EOF:
+		if r.fromUpstream {
+			return closeReasonUpstreamEOF
+		}
+		return closeReasonDownstreamEOF
+	case errors.As(r.err, &nerr) && nerr.Timeout():
+		return closeReasonTimeout
+	default:
+		return closeReasonError
+	}
+}
+
 type forwarder struct {
 	opts Options
+	acl  *acl.ACL
 
 	dialer        *net.Dialer
 	logger        *zap.Logger
 	udpBufferPool *bytesext.Pool
 }
 
-func newForwarder(logger *zap.Logger, opts Options) *forwarder {
+func newForwarder(logger *zap.Logger, opts Options) (*forwarder, error) {
+	a, err := acl.New(opts.aclRules())
+	if err != nil {
+		return nil, err
+	}
 	return &forwarder{
 		opts:          opts,
+		acl:           a,
 		dialer:        &net.Dialer{Timeout: opts.ConnectTimeout},
 		logger:        logger,
 		udpBufferPool: bytesext.NewPoolWith(0, math.MaxUint16),
-	}
+	}, nil
+}
+
+// Dial dials the upstream, the network is either tcp or udp.
+func (f *forwarder) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f.dialer.DialContext(ctx, network, addr)
 }
 
-func (f *forwarder) ForwardTCP(ctx context.Context, downstream io.ReadWriteCloser) error {
-	upstreamConn, err := f.dialer.DialContext(ctx, "tcp", f.opts.UpstreamTCP)
+// DialDestination dials the destination if the ACL allows it, it returns
+// *acl.DeniedError otherwise.
+func (f *forwarder) DialDestination(ctx context.Context, dst *protocol.Addr) (net.Conn, error) {
+	if err := f.acl.CheckPort(dst.Port); err != nil {
+		return nil, err
+	}
+	trusted := false
+	if dst.Type() == protocol.AddrTypeDomain {
+		var err error
+		if trusted, err = f.acl.CheckDomain(dst.Host); err != nil {
+			return nil, err
+		}
+	}
+
+	dialer := *f.dialer
+	// The resolved addresses are checked right before connecting.
+	dialer.Control = func(_, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		return f.acl.CheckIP(net.ParseIP(host), trusted)
+	}
+	conn, err := dialer.DialContext(ctx, dst.Network, dst.String())
 	if err != nil {
-		upstreamConn.Close()
+		var derr *acl.DeniedError
+		if errors.As(err, &derr) {
+			return nil, derr
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ResolveDestination resolves the UDP destination if the ACL allows it, it returns
+// *acl.DeniedError otherwise, it is for the unconnected sockets.
+func (f *forwarder) ResolveDestination(ctx context.Context, dst *protocol.Addr) (*net.UDPAddr, error) {
+	if err := f.acl.CheckPort(dst.Port); err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(dst.Host)
+	trusted := false
+	if ip == nil {
+		var err error
+		if trusted, err = f.acl.CheckDomain(dst.Host); err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(ctx, f.opts.ConnectTimeout)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, dst.Host)
+		if err != nil {
+			return nil, err
+		}
+		ip = addrs[0].IP
+	}
+	if err := f.acl.CheckIP(ip, trusted); err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ip, Port: int(dst.Port)}, nil
+}
+
+// checkSource checks the source of an UDP packet as a destination by the ACL, it
+// returns *acl.DeniedError if denied.
+func (f *forwarder) checkSource(src *protocol.Addr) error {
+	if err := f.acl.CheckPort(src.Port); err != nil {
 		return err
 	}
+	return f.acl.CheckIP(net.ParseIP(src.Host), false)
+}
+
+// ForwardTCP forwards the stream, the traffic is added to the session.
+func (f *forwarder) ForwardTCP(ctx context.Context, downstream io.ReadWriteCloser, upstreamConn net.Conn,
+	session *traffic.Session) error {
 	upstream := netext.NewTimedConn(upstreamConn, f.opts.Timeout, f.opts.Timeout)
 
-	errc := make(chan error, 2)
-	go f.stream(downstream, upstream, errc)
-	go f.stream(upstream, downstream, errc)
+	results := make(chan streamResult, 2)
+	go f.stream(session.Writer(traffic.Down, downstream), upstream, true, results)
+	go f.stream(session.Writer(traffic.Up, upstream), downstream, false, results)
 
-	return f.wait(ctx, upstreamConn.Close, downstream.Close, errc, 2)
+	return f.wait(ctx, session, upstreamConn.Close, downstream.Close, results, 2)
 }
 
-func (f *forwarder) ForwardUDP(ctx context.Context, downstream io.ReadWriteCloser) error {
-	upstreamConn, err := f.dialer.DialContext(ctx, "udp", f.opts.UpstreamUDP)
-	if err != nil {
-		downstream.Close()
+func (f *forwarder) ForwardUDP(ctx context.Context, downstream io.ReadWriteCloser, upstreamConn net.Conn,
+	session *traffic.Session) error {
+	return f.forwardUDP(ctx, downstream, upstreamConn, session, encoding.ReadU16SizedBytes, encoding.WriteU16SizedBytes)
+}
+
+// ForwardMASQUE is the same as ForwardUDP except that the packets are carried by the
+// DATAGRAM capsules of MASQUE CONNECT-UDP.
+func (f *forwarder) ForwardMASQUE(ctx context.Context, downstream io.ReadWriteCloser, upstreamConn net.Conn,
+	session *traffic.Session) error {
+	var capsule []byte // Only the upstream -> downstream goroutine writes.
+	return f.forwardUDP(ctx, downstream, upstreamConn, session, protocol.ReadUDPCapsule, func(w io.Writer, p []byte) error {
+		capsule = protocol.AppendUDPCapsule(capsule[:0], p)
+		_, err := w.Write(capsule)
 		return err
-	}
+	})
+}
+
+// forwardUDP forwards the UDP packets framed by the readPacket and writePacket in the downstream.
+func (f *forwarder) forwardUDP(ctx context.Context, downstream io.ReadWriteCloser, upstreamConn net.Conn, session *traffic.Session,
+	readPacket func(io.Reader, []byte) (int, error), writePacket func(io.Writer, []byte) error) error {
 	upstream := netext.NewTimedConn(upstreamConn, f.opts.Timeout, f.opts.Timeout)
 
-	errc := make(chan error, 2)
+	results := make(chan streamResult, 2)
 	go func() { // upstream -> downstream
 		buf := f.udpBufferPool.Get(math.MaxUint16)
 		var (
@@ -67,7 +195,7 @@ func (f *forwarder) ForwardUDP(ctx context.Context, downstream io.ReadWriteClose
 			if n, err = upstream.Read(buf); err != nil {
 				break
 			}
-			if err = encoding.WriteU16SizedBytes(downstream, buf[:n]); err == nil {
+			if err = writePacket(downstream, buf[:n]); err == nil {
 				if f, ok := downstream.(ioext.Flusher); ok {
 					err = f.Flush()
 				}
@@ -75,9 +203,10 @@ func (f *forwarder) ForwardUDP(ctx context.Context, downstream io.ReadWriteClose
 			if err != nil {
 				break
 			}
+			session.AddPacket(traffic.Down, n)
 		}
 		f.udpBufferPool.Put(buf)
-		errc <- err
+		results <- streamResult{fromUpstream: true, err: err}
 	}()
 	go func() { // downstream -> upstream
 		buf := f.udpBufferPool.Get(math.MaxUint16)
@@ -86,32 +215,38 @@ func (f *forwarder) ForwardUDP(ctx context.Context, downstream io.ReadWriteClose
 			err error
 		)
 		for {
-			if n, err = encoding.ReadU16SizedBytes(downstream, buf); err != nil {
+			if n, err = readPacket(downstream, buf); err != nil {
 				break
 			}
 			// NOTE: use of WriteTo with pre-connected connection
 			if _, err = upstream.Write(buf[:n]); err != nil {
 				break
 			}
+			session.AddPacket(traffic.Up, n)
 		}
 		f.udpBufferPool.Put(buf)
-		errc <- err
+		results <- streamResult{fromUpstream: false, err: err}
 	}()
 
-	return f.wait(ctx, upstreamConn.Close, downstream.Close, errc, 2)
+	return f.wait(ctx, session, upstreamConn.Close, downstream.Close, results, 2)
 }
 
-func (f *forwarder) wait(ctx context.Context, upCloseFunc, downCloseFunc func() error, errc <-chan error, n int) error {
+// wait waits for the n results, both sides are closed once the first one comes or
+// the ctx is done, which is the close reason of the session.
+func (f *forwarder) wait(ctx context.Context, session *traffic.Session, upCloseFunc, downCloseFunc func() error,
+	results <-chan streamResult, n int) error {
 	donec := ctx.Done()
 	multierr := &errorsext.MultiErr{}
 	closed := false
 	for n > 0 {
 		select {
-		case err := <-errc:
+		case result := <-results:
 			n--
-			multierr.Append(err)
+			multierr.Append(result.err)
+			session.SetCloseReason(result.closeReason())
 		case <-donec:
 			donec = nil
+			session.SetCloseReason(closeReasonCanceled)
 		}
 		if !closed {
 			closed = true
@@ -126,7 +261,7 @@ func (f *forwarder) wait(ctx context.Context, upCloseFunc, downCloseFunc func()
 	return multierr.Err()
 }
 
-func (f *forwarder) stream(dst io.Writer, src io.Reader, errc chan error) {
+func (f *forwarder) stream(dst io.Writer, src io.Reader, fromUpstream bool, results chan<- streamResult) {
 	_, err := goodogioutil.Copy(dst, src, false)
-	errc <- err
+	results <- streamResult{fromUpstream: fromUpstream, err: err}
 }
@@ -0,0 +1,383 @@
+package caddy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	errorsext "github.com/damnever/libext-go/errors"
+	"go.uber.org/zap"
+
+	"github.com/damnever/goodog/internal/pkg/acl"
+	"github.com/damnever/goodog/internal/pkg/protocol"
+	"github.com/damnever/goodog/internal/pkg/traffic"
+)
+
+var errPacketForwarderClosed = errors.New("goodog: packet forwarder closed")
+
+// ForwardPackets forwards the UDP packets multiplexed over the downstream(protocol.MuxPacket),
+// every src has its own upstream socket until it is idle for the timeout. The packets go to
+// the upstream_udp in v1, to their own destinations in v2, the denied is called if the ACL
+// denies a destination. The started is called with the session of a src and the function
+// to terminate it, the done is called once it is done.
+func (f *forwarder) ForwardPackets(ctx context.Context, downstream io.ReadWriteCloser, withDst bool,
+	denied func(*protocol.Addr, error), started func(*protocol.Addr, *traffic.Session, func()),
+	done func(*protocol.Addr, *traffic.Session)) error {
+	p := &packetForwarder{
+		forwarder:  f,
+		downstream: downstream,
+		withDst:    withDst,
+		denied:     denied,
+		started:    started,
+		done:       done,
+		sessions:   map[string]*packetSession{},
+		pendings:   map[string]*pendingPacketSession{},
+	}
+	return p.serve(ctx)
+}
+
+type packetForwarder struct {
+	*forwarder
+	downstream io.ReadWriteCloser
+	withDst    bool
+	denied     func(*protocol.Addr, error)
+	started    func(*protocol.Addr, *traffic.Session, func())
+	done       func(*protocol.Addr, *traffic.Session)
+
+	wmu      sync.Mutex
+	mu       sync.Mutex
+	closed   bool
+	sessions map[string]*packetSession        // By the src.
+	pendings map[string]*pendingPacketSession // The sessions being created, by the src.
+}
+
+func (p *packetForwarder) serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		p.downstream.Close()
+	}()
+	go p.timeoutLoop(ctx)
+
+	var (
+		src, dst *protocol.Addr
+		n        int
+		err      error
+		buf      = p.udpBufferPool.Get(math.MaxUint16)
+	)
+	for {
+		if src, dst, n, err = protocol.ReadPacket(p.downstream, p.withDst, buf); err != nil {
+			break
+		}
+		session, err0 := p.getSession(ctx, src)
+		if err0 != nil {
+			countDialError("udp", err0)
+			p.logger.Debug("create session failed", zap.Stringer("src", src), zap.Error(err0))
+			continue
+		}
+		if err0 := session.write(ctx, dst, buf[:n]); err0 != nil {
+			p.logger.Debug("write to upstream failed", zap.Stringer("src", src), zap.Error(err0))
+		}
+	}
+	p.udpBufferPool.Put(buf)
+
+	reason := closeReasonError
+	if ctx.Err() != nil {
+		reason = closeReasonCanceled
+	} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+		reason = closeReasonDownstreamEOF
+	}
+	cancel()
+	multierr := &errorsext.MultiErr{}
+	p.mu.Lock()
+	p.closed = true
+	for key, session := range p.sessions {
+		session.traffic.SetCloseReason(reason)
+		multierr.Append(session.conn.Close())
+		delete(p.sessions, key)
+	}
+	p.mu.Unlock()
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		multierr.Append(err)
+	}
+	return multierr.Err()
+}
+
+// pendingPacketSession is a session being created, done is closed once it is created or failed.
+type pendingPacketSession struct {
+	done chan struct{}
+	err  error
+}
+
+func (p *packetForwarder) getSession(ctx context.Context, src *protocol.Addr) (*packetSession, error) {
+	key := src.String()
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errPacketForwarderClosed
+		}
+		if session, ok := p.sessions[key]; ok {
+			p.mu.Unlock()
+			return session, nil
+		}
+		pending, ok := p.pendings[key]
+		if !ok {
+			pending = &pendingPacketSession{done: make(chan struct{})}
+			p.pendings[key] = pending
+		}
+		p.mu.Unlock()
+
+		if !ok {
+			return p.createSession(ctx, key, src, pending)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-pending.done:
+		}
+		if pending.err != nil {
+			return nil, pending.err
+		}
+	}
+}
+
+// createSession dials the upstream without holding p.mu, the timeouts and the other
+// sessions are not blocked by resolving the upstream_udp, and wakes up the callers
+// waiting for the pending one.
+func (p *packetForwarder) createSession(ctx context.Context, key string, src *protocol.Addr,
+	pending *pendingPacketSession) (session *packetSession, err error) {
+	defer func() {
+		p.mu.Lock()
+		delete(p.pendings, key)
+		if err == nil && p.closed {
+			session.conn.Close()
+			session, err = nil, errPacketForwarderClosed
+		}
+		if err == nil {
+			p.sessions[key] = session
+		}
+		p.mu.Unlock()
+		pending.err = err
+		close(pending.done)
+		if err == nil {
+			p.started(src, session.traffic, func() { session.conn.Close() })
+			go session.serveDownstream()
+		}
+	}()
+
+	var conn net.Conn
+	if p.withDst {
+		conn, err = net.ListenUDP("udp", nil)
+	} else {
+		conn, err = p.Dial(ctx, "udp", p.opts.UpstreamUDP)
+	}
+	if err != nil {
+		return nil, err
+	}
+	session = &packetSession{
+		p:        p,
+		src:      src,
+		conn:     conn.(*net.UDPConn),
+		resolved: map[string]*resolvedDst{},
+		dsts:     map[string]*protocol.Addr{},
+		traffic:  traffic.NewSession("udp", _traffic["udp"]),
+	}
+	session.activeAt.Store(time.Now())
+	return session, nil
+}
+
+// writeDownstream writes a packet, the packets must not be interleaved.
+func (p *packetForwarder) writeDownstream(packet []byte) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	_, err := p.downstream.Write(packet)
+	return err
+}
+
+func (p *packetForwarder) timeoutLoop(ctx context.Context) {
+	ticker := time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			timedout := time.Now().Add(-p.opts.Timeout)
+			p.mu.Lock()
+			for key, session := range p.sessions {
+				if !session.activeAt.Load().(time.Time).After(timedout) {
+					session.traffic.SetCloseReason(closeReasonTimeout)
+					session.conn.Close()
+					delete(p.sessions, key)
+				}
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// packetSession is the upstream socket of a src, it is connected to the upstream_udp
+// in v1, it is unconnected in v2 so that the src can talk to many destinations.
+type packetSession struct {
+	p        *packetForwarder
+	src      *protocol.Addr
+	conn     *net.UDPConn
+	activeAt atomic.Value
+	traffic  *traffic.Session
+
+	mu       sync.Mutex
+	resolved map[string]*resolvedDst   // By the requested destination.
+	dsts     map[string]*protocol.Addr // The resolved destination -> the requested one.
+}
+
+// FIXME(damnever): magic numbers
+const (
+	// The resolve errors other than the ACL denials are retried after it, the
+	// denials are cached as long as the session lives.
+	resolveErrorTTL = 5 * time.Second
+	// The packets to a destination being resolved are queued up to it, the
+	// others are dropped.
+	maxPendingPackets = 8
+)
+
+// resolvedDst is the result of resolving a destination, the resolving is pending
+// if both the addr and the err are nil.
+type resolvedDst struct {
+	addr     *net.UDPAddr
+	err      error
+	expireAt time.Time // Only for the err, zero if it never expires.
+	pending  [][]byte
+}
+
+func (s *packetSession) write(ctx context.Context, dst *protocol.Addr, data []byte) error {
+	s.activeAt.Store(time.Now())
+	if dst == nil {
+		_, err := s.conn.Write(data)
+		if err == nil {
+			s.traffic.AddPacket(traffic.Up, len(data))
+		}
+		return err
+	}
+
+	key := dst.String()
+	s.mu.Lock()
+	r, ok := s.resolved[key]
+	if !ok || (r.err != nil && !r.expireAt.IsZero() && time.Now().After(r.expireAt)) {
+		r = &resolvedDst{}
+		s.resolved[key] = r
+		// NOTE(damnever): resolving may take a while, it must not block the packets of
+		// the other sessions, which are read from the same downstream.
+		go s.resolve(ctx, key, dst, r)
+	}
+	addr, err := r.addr, r.err
+	if addr == nil && err == nil {
+		if len(r.pending) < maxPendingPackets {
+			r.pending = append(r.pending, append([]byte(nil), data...))
+		}
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return nil // Dropped.
+	}
+	return s.writeTo(data, addr)
+}
+
+// resolve resolves the destination and writes the packets queued meanwhile.
+func (s *packetSession) resolve(ctx context.Context, key string, dst *protocol.Addr, r *resolvedDst) {
+	addr, err := s.p.ResolveDestination(ctx, dst)
+	if err != nil {
+		s.p.denied(dst, err)
+	}
+
+	s.mu.Lock()
+	r.addr, r.err = addr, err
+	if err != nil {
+		var derr *acl.DeniedError
+		if !errors.As(err, &derr) {
+			r.expireAt = time.Now().Add(resolveErrorTTL)
+		}
+	} else {
+		s.dsts[addr.String()] = dst
+	}
+	pending := r.pending
+	r.pending = nil
+	s.mu.Unlock()
+
+	if err != nil {
+		return
+	}
+	for _, data := range pending {
+		if err := s.writeTo(data, addr); err != nil {
+			s.p.logger.Debug("write to upstream failed", zap.Stringer("src", s.src), zap.Error(err))
+			return
+		}
+	}
+}
+
+func (s *packetSession) writeTo(data []byte, addr *net.UDPAddr) error {
+	_, err := s.conn.WriteToUDP(data, addr)
+	if err == nil {
+		s.traffic.AddPacket(traffic.Up, len(data))
+	}
+	return err
+}
+
+func (s *packetSession) serveDownstream() {
+	var (
+		n      int
+		from   *net.UDPAddr
+		err    error
+		buf    = s.p.udpBufferPool.Get(math.MaxUint16)
+		packet = s.p.udpBufferPool.Get(math.MaxUint16)
+	)
+	for {
+		if n, from, err = s.conn.ReadFromUDP(buf); err != nil {
+			break
+		}
+		s.activeAt.Store(time.Now())
+		var dst *protocol.Addr
+		if s.p.withDst {
+			s.mu.Lock()
+			dst = s.dsts[from.String()]
+			s.mu.Unlock()
+			if dst == nil {
+				// NOTE(damnever): the replies from the addresses which the src never
+				// talks to are allowed like a full-cone NAT, only if the ACL allows
+				// them as the destinations.
+				dst, _ = protocol.AddrFromNetAddr(from)
+				if err0 := s.p.checkSource(dst); err0 != nil {
+					s.p.logger.Debug("reply dropped", zap.Stringer("src", s.src), zap.Stringer("from", dst), zap.Error(err0))
+					continue
+				}
+			}
+		}
+		b, err0 := protocol.AppendPacket(packet[:0], s.src, dst, buf[:n])
+		if err0 != nil {
+			continue
+		}
+		if err = s.p.writeDownstream(b); err != nil {
+			break
+		}
+		s.traffic.AddPacket(traffic.Down, n)
+	}
+	s.p.udpBufferPool.Put(buf)
+	s.p.udpBufferPool.Put(packet)
+	s.p.logger.Debug("session done", zap.Stringer("src", s.src), zap.Error(err))
+	s.conn.Close()
+	s.p.mu.Lock()
+	if session, ok := s.p.sessions[s.src.String()]; ok && session == s {
+		delete(s.p.sessions, s.src.String())
+	}
+	s.p.mu.Unlock()
+	s.p.done(s.src, s.traffic)
+}
@@ -0,0 +1,129 @@
+package caddy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/damnever/goodog/internal/pkg/protocol"
+)
+
+// isMASQUERequest tells if the request is MASQUE CONNECT-UDP, either the HTTP/1.1 Upgrade
+// or the extended CONNECT(RFC 8441) of HTTP/2, whose :protocol is kept in the header by
+// the HTTP/2 server of Go.
+//
+// NOTE(damnever): the HTTP/2 server of Go accepts the extended CONNECT only if it runs
+// with GODEBUG=http2xconnect=1(Go 1.24+), see extendedConnectEnabled. The HTTP/3 server
+// of quic-go we are using drops the :protocol, the extended CONNECT(RFC 9220) over HTTP/3
+// is not recognized.
+func isMASQUERequest(r *http.Request) bool {
+	if r.Method == http.MethodConnect {
+		return r.Header.Get(":protocol") == protocol.MASQUEUpgradeToken
+	}
+	return r.Method == http.MethodGet && r.ProtoMajor == 1 &&
+		headerHasToken(r.Header, "Connection", "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), protocol.MASQUEUpgradeToken)
+}
+
+// serveMASQUE serves MASQUE CONNECT-UDP, the target is extracted from the URI by the
+// masque_template and checked by the ACL, the UDP packets are carried by the DATAGRAM
+// capsules in the stream.
+func (g *GoodogCaddyAdapter) serveMASQUE(w http.ResponseWriter, r *http.Request) error {
+	dst, err := protocol.MatchMASQUETemplate(g.Options.MASQUETemplate, r.URL)
+	if err != nil {
+		g.logger.Debug("bad MASQUE target", zap.String("uri", r.URL.RequestURI()), zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		r.Body.Close()
+		return nil
+	}
+	upstreamConn, err := g.forwarder.DialDestination(r.Context(), dst)
+	if err != nil {
+		w.WriteHeader(g.dialStatus(r, "udp", dst.String(), err))
+		r.Body.Close()
+		return nil
+	}
+
+	if r.Method == http.MethodConnect { // The extended CONNECT.
+		fw := newFlushWriter(w)
+		w.Header().Set("Capsule-Protocol", "?1")
+		w.WriteHeader(http.StatusOK)
+		fw.Flush()
+		g.forwardMASQUE(r, &caddyStreamWrapper{
+			Reader: r.Body,
+			Writer: fw,
+			Closer: r.Body,
+		}, upstreamConn, dst)
+		return nil
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstreamConn.Close()
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		upstreamConn.Close()
+		return err
+	}
+	_, err = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: " + protocol.MASQUEUpgradeToken + "\r\n" +
+		"Capsule-Protocol: ?1\r\n\r\n")
+	if err == nil {
+		err = brw.Flush()
+	}
+	if err != nil {
+		upstreamConn.Close()
+		conn.Close()
+		return err
+	}
+	g.forwardMASQUE(r, &hijackedConn{Conn: conn, r: brw.Reader}, upstreamConn, dst)
+	return nil
+}
+
+// forwardMASQUE forwards the MASQUE session, the error is in the access record.
+func (g *GoodogCaddyAdapter) forwardMASQUE(r *http.Request, downstream io.ReadWriteCloser, upstreamConn net.Conn,
+	dst *protocol.Addr) {
+	ctx, session := g.startSession(r.Context(), r, "masque", dst.String(), "")
+	err := g.forwarder.ForwardMASQUE(ctx, downstream, upstreamConn, session)
+	g.sessionDone(r, session, err, zap.Stringer("upstream", dst))
+}
+
+// hijackedConn reads the data buffered by the HTTP server first.
+type hijackedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// extendedConnectEnabled tells if the HTTP/2 server of Go accepts the extended CONNECT,
+// it is read once by the net/http at the start.
+func extendedConnectEnabled() bool {
+	for _, setting := range strings.Split(os.Getenv("GODEBUG"), ",") {
+		if strings.TrimSpace(setting) == "http2xconnect=1" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package caddy
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"syscall"
+
+	"github.com/damnever/goodog/internal/pkg/acl"
+	"github.com/damnever/goodog/internal/pkg/compression"
+	"github.com/damnever/goodog/internal/pkg/metrics"
+	"github.com/damnever/goodog/internal/pkg/traffic"
+)
+
+// The metrics are shared by all the handlers, they are published in expvar as
+// "goodog-backend", which is in /debug/vars of the Caddy admin API, and in the
+// Prometheus text format by /goodog/metrics of the admin API.
+var (
+	_registry = metrics.NewRegistry("goodog_backend")
+	_traffic  = map[string]*traffic.Counters{
+		"tcp":    newTrafficCounters("tcp"),
+		"udp":    newTrafficCounters("udp"),
+		"masque": newTrafficCounters("masque"),
+	}
+	_sessionSeconds = map[string]*metrics.Histogram{
+		"tcp":    newSessionSeconds("tcp"),
+		"udp":    newSessionSeconds("udp"),
+		"masque": newSessionSeconds("masque"),
+	}
+	_compression = &compressionCounters{
+		rawBytes:         _registry.Counter("compression_raw_bytes", "The uncompressed bytes."),
+		wireBytes:        _registry.Counter("compression_wire_bytes", "The compressed bytes."),
+		storedBlocks:     _registry.Counter("compression_stored_blocks", "The blocks which are stored uncompressed."),
+		compressedBlocks: _registry.Counter("compression_compressed_blocks", "The blocks which are compressed."),
+		// FIXME(damnever): magic numbers, 10% ~ 110%
+		ratio: _registry.Histogram("compression_ratio", "The wire bytes to the raw bytes of the streams.",
+			metrics.LinearBuckets(0.1, 0.1, 11)),
+	}
+)
+
+func init() {
+	expvar.Publish("goodog-backend", _registry)
+}
+
+// newTrafficCounters registers the traffic counters of the protocol.
+func newTrafficCounters(protocol string) *traffic.Counters {
+	bytesHelp := "The bytes of the sessions by the protocols and the directions."
+	packetsHelp := "The packets of the sessions by the protocols and the directions."
+	return &traffic.Counters{
+		Sessions:    _registry.Counter("traffic_sessions", "The sessions by the protocols.", "protocol", protocol),
+		Active:      _registry.Gauge("traffic_active", "The active sessions by the protocols.", "protocol", protocol),
+		BytesUp:     _registry.Counter("traffic_bytes", bytesHelp, "protocol", protocol, "direction", traffic.Up.String()),
+		BytesDown:   _registry.Counter("traffic_bytes", bytesHelp, "protocol", protocol, "direction", traffic.Down.String()),
+		PacketsUp:   _registry.Counter("traffic_packets", packetsHelp, "protocol", protocol, "direction", traffic.Up.String()),
+		PacketsDown: _registry.Counter("traffic_packets", packetsHelp, "protocol", protocol, "direction", traffic.Down.String()),
+	}
+}
+
+func newSessionSeconds(protocol string) *metrics.Histogram {
+	// FIXME(damnever): magic numbers, 100ms ~ 7h
+	return _registry.Histogram("session_seconds", "The duration of the sessions by the protocols.",
+		metrics.ExponentialBuckets(0.1, 4, 10), "protocol", protocol)
+}
+
+// compressionCounters sum up the compression.Stats of the streams in both directions,
+// the ratio is the wire bytes to the raw bytes of a stream in a direction.
+type compressionCounters struct {
+	rawBytes         *metrics.Counter
+	wireBytes        *metrics.Counter
+	storedBlocks     *metrics.Counter
+	compressedBlocks *metrics.Counter
+	ratio            *metrics.Histogram
+}
+
+func (c *compressionCounters) add(stats compression.Stats) {
+	c.rawBytes.Add(stats.RawBytes)
+	c.wireBytes.Add(stats.WireBytes)
+	c.storedBlocks.Add(stats.StoredBlocks)
+	c.compressedBlocks.Add(stats.CompressedBlocks)
+	if stats.RawBytes > 0 {
+		c.ratio.Observe(float64(stats.WireBytes) / float64(stats.RawBytes))
+	}
+}
+
+// The kinds of the dial errors.
+const (
+	dialErrDenied  = "denied" // By the ACL.
+	dialErrTimeout = "timeout"
+	dialErrRefused = "refused"
+	dialErrOther   = "other"
+)
+
+func dialErrorKind(err error) string {
+	var (
+		derr *acl.DeniedError
+		nerr net.Error
+	)
+	switch {
+	case errors.As(err, &derr):
+		return dialErrDenied
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return dialErrTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return dialErrRefused
+	default:
+		return dialErrOther
+	}
+}
+
+// countDialError counts the dial(or resolve) error of the protocol by the kind.
+func countDialError(protocol string, err error) {
+	_registry.Counter("dial_errors", "The dial errors by the protocols and the kinds.",
+		"protocol", protocol, "kind", dialErrorKind(err)).Inc()
+}
+
+// countRejected counts the rejected requests by the reasons.
+func countRejected(reason string) {
+	_registry.Counter("rejected_requests", "The requests which are rejected by the reasons.", "reason", reason).Inc()
+}
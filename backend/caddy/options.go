@@ -3,26 +3,55 @@ package caddy
 import (
 	"encoding/json"
 	"time"
+
+	"github.com/damnever/goodog/internal/pkg/acl"
+	"github.com/damnever/goodog/internal/pkg/protocol"
 )
 
 type Options struct {
+	Name           string        `json:"name,omitempty"` // Tells the handlers apart in the admin API.
 	UpstreamTCP    string        `json:"upstream_tcp"`
 	UpstreamUDP    string        `json:"upstream_udp"`
 	ConnectTimeout time.Duration `json:"connect_timeout"`
 	Timeout        time.Duration `json:"timeout"`
+
+	// The ACL of the destinations in protocol v2, the upstreams above are trusted.
+	AllowCIDRs   []string `json:"allow_cidrs,omitempty"`
+	DenyCIDRs    []string `json:"deny_cidrs,omitempty"`
+	AllowPorts   []string `json:"allow_ports,omitempty"`
+	DenyPorts    []string `json:"deny_ports,omitempty"`
+	AllowDomains []string `json:"allow_domains,omitempty"`
+	DenyDomains  []string `json:"deny_domains,omitempty"`
+	AllowPrivate bool     `json:"allow_private,omitempty"`
+
+	// MASQUE CONNECT-UDP(RFC 9298) over the HTTP/1.1 Upgrade or the HTTP/2 extended CONNECT,
+	// the targets are checked by the ACL above.
+	MASQUE         bool   `json:"masque,omitempty"`
+	MASQUETemplate string `json:"masque_template,omitempty"`
 }
 
 func (opts *Options) UnmarshalJSON(data []byte) error {
 	var fakeOptions struct {
-		UpstreamTCP    string `json:"upstream_tcp"`
-		UpstreamUDP    string `json:"upstream_udp"`
-		ConnectTimeout string `json:"connect_timeout"`
-		Timeout        string `json:"timeout"`
+		Name           string   `json:"name"`
+		UpstreamTCP    string   `json:"upstream_tcp"`
+		UpstreamUDP    string   `json:"upstream_udp"`
+		ConnectTimeout string   `json:"connect_timeout"`
+		Timeout        string   `json:"timeout"`
+		AllowCIDRs     []string `json:"allow_cidrs"`
+		DenyCIDRs      []string `json:"deny_cidrs"`
+		AllowPorts     []string `json:"allow_ports"`
+		DenyPorts      []string `json:"deny_ports"`
+		AllowDomains   []string `json:"allow_domains"`
+		DenyDomains    []string `json:"deny_domains"`
+		AllowPrivate   bool     `json:"allow_private"`
+		MASQUE         bool     `json:"masque"`
+		MASQUETemplate string   `json:"masque_template"`
 	}
 	if err := json.Unmarshal(data, &fakeOptions); err != nil {
 		return err
 	}
 
+	opts.Name = fakeOptions.Name
 	opts.UpstreamTCP = fakeOptions.UpstreamTCP
 	opts.UpstreamUDP = fakeOptions.UpstreamUDP
 	// FUCK????
@@ -36,14 +65,41 @@ func (opts *Options) UnmarshalJSON(data []byte) error {
 		return err
 	}
 	opts.Timeout = d
+	opts.AllowCIDRs = fakeOptions.AllowCIDRs
+	opts.DenyCIDRs = fakeOptions.DenyCIDRs
+	opts.AllowPorts = fakeOptions.AllowPorts
+	opts.DenyPorts = fakeOptions.DenyPorts
+	opts.AllowDomains = fakeOptions.AllowDomains
+	opts.DenyDomains = fakeOptions.DenyDomains
+	opts.AllowPrivate = fakeOptions.AllowPrivate
+	opts.MASQUE = fakeOptions.MASQUE
+	opts.MASQUETemplate = fakeOptions.MASQUETemplate
 	return nil
 }
 
 func (opts *Options) withDefaults() {
+	if opts.Name == "" {
+		opts.Name = "goodog"
+	}
 	if opts.ConnectTimeout <= 0 {
 		opts.ConnectTimeout = 3 * time.Second
 	}
 	if opts.Timeout <= 0 {
 		opts.Timeout = 1 * time.Minute
 	}
+	if opts.MASQUETemplate == "" {
+		opts.MASQUETemplate = protocol.MASQUEDefaultTemplate
+	}
+}
+
+func (opts Options) aclRules() acl.Rules {
+	return acl.Rules{
+		AllowCIDRs:   opts.AllowCIDRs,
+		DenyCIDRs:    opts.DenyCIDRs,
+		AllowPorts:   opts.AllowPorts,
+		DenyPorts:    opts.DenyPorts,
+		AllowDomains: opts.AllowDomains,
+		DenyDomains:  opts.DenyDomains,
+		AllowPrivate: opts.AllowPrivate,
+	}
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/naoina/toml"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/damnever/goodog/frontend"
+)
+
+// The options which can not be set by the config file.
+var _fileExcluded = map[string]bool{"config": true, "version": true}
+
+// The env vars used by the Dockerfile before the options can be set by the env vars.
+var _legacyEnvs = map[string]string{
+	"server": "GOODOG_SERVER_URI",
+	"listen": "GOODOG_LISTEN_ADDRESS",
+}
+
+// envName returns the env var of the option, e.g. GOODOG_CONNECT_TIMEOUT for connect-timeout.
+func envName(name string) string {
+	return "GOODOG_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// configPath returns the path of the config file, empty if there is none.
+func configPath(explicit map[string]string) string {
+	if path, ok := explicit["config"]; ok {
+		return path
+	}
+	return os.Getenv(envName("config"))
+}
+
+// loadConfig sets the options from the sources in the order of precedence: the flags
+// set explicitly, the GOODOG_* env vars, the config file and the flag defaults. It
+// can be called again to apply the changes of the config file.
+func loadConfig(explicit map[string]string) (frontend.Config, error) {
+	options := map[string]string{}
+	if path := configPath(explicit); path != "" {
+		var err error
+		if options, err = readConfigFile(path); err != nil {
+			return frontend.Config{}, err
+		}
+	}
+
+	var err error
+	flagset.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		value, ok := explicit[f.Name]
+		if !ok {
+			value, ok = os.LookupEnv(envName(f.Name))
+		}
+		if !ok && _legacyEnvs[f.Name] != "" {
+			value, ok = os.LookupEnv(_legacyEnvs[f.Name])
+		}
+		if !ok {
+			value, ok = options[f.Name]
+		}
+		if !ok {
+			value = f.DefValue
+		}
+		if e := flagset.Set(f.Name, value); e != nil {
+			err = fmt.Errorf("invalid value %q for option %s: %v", value, f.Name, e)
+		}
+	})
+	if err != nil {
+		return frontend.Config{}, err
+	}
+	listeners, err := parseListeners(*flagListeners)
+	if err != nil {
+		return frontend.Config{}, err
+	}
+
+	return frontend.Config{
+		Listeners:          listeners,
+		ListenAddr:         *flagListenAddr,
+		SOCKS5ListenAddr:   *flagSOCKS5Addr,
+		HTTPListenAddr:     *flagHTTPAddr,
+		RedirectListenAddr: *flagRedirectAddr,
+		TProxyListenAddr:   *flagTProxyAddr,
+		ServerURIs:         strings.Split(*flagServerURI, ","),
+		Balance:            *flagBalance,
+		Connector:          *flagConnector,
+		Mux:                *flagMux,
+		UDPMux:             *flagUDPMux,
+		MASQUETemplate:     *flagMASQUE,
+		LogLevel:           *flagLogLevel,
+		ConnectTimeout:     *flagConnectTimeout,
+		Timeout:            *flagTimeout,
+		ProbeInterval:      *flagProbeInterval,
+		WarmConns:          *flagWarmConns,
+		MaxConns:           *flagMaxConns,
+		MaxStreamsPerConn:  *flagMaxStreams,
+		ConnIdleTimeout:    *flagConnIdle,
+		Compression:        *flagCompression,
+
+		QUICHandshakeTimeout:   *flagQUICHandshake,
+		QUICIdleTimeout:        *flagQUICIdle,
+		QUICDisableKeepAlive:   !*flagQUICKeepAlive,
+		QUICStreamWindow:       *flagQUICStreamWin,
+		QUICConnWindow:         *flagQUICConnWin,
+		QUICMaxIncomingStreams: *flagQUICInStreams,
+	}, nil
+}
+
+// readConfigFile reads the options from the YAML, JSON or TOML file by the extension,
+// the keys are the names of the flags, the lists are joined by comma.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]interface{}{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, &raw)
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber() // The big integers are not floats.
+		err = decoder.Decode(&raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("unknown config file format: %s", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed config file %s: %v", path, err)
+	}
+
+	options := make(map[string]string, len(raw))
+	for name, v := range raw {
+		if flagset.Lookup(name) == nil || _fileExcluded[name] {
+			return nil, fmt.Errorf("unknown option in config file %s: %s", path, name)
+		}
+		value, err := optionValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid option %s in config file %s: %v", name, path, err)
+		}
+		options[name] = value
+	}
+	return options, nil
+}
+
+func optionValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, elem := range v {
+			switch elem.(type) {
+			case []interface{}, map[string]interface{}, map[interface{}]interface{}:
+				return "", fmt.Errorf("unexpected list or table in the list")
+			}
+			value, _ := optionValue(elem)
+			values = append(values, value)
+		}
+		return strings.Join(values, ","), nil
+	case map[string]interface{}, map[interface{}]interface{}:
+		return "", fmt.Errorf("unexpected table")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// parseListeners parses the listeners in the form of kind://addr separated by comma,
+// e.g. socks5://127.0.0.1:1080,http://127.0.0.1:8080.
+func parseListeners(s string) ([]frontend.Listener, error) {
+	listeners := []frontend.Listener{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "://", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("malformed listener: %s", item)
+		}
+		listeners = append(listeners, frontend.Listener{Kind: parts[0], Addr: parts[1]})
+	}
+	return listeners, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/damnever/goodog/frontend"
+)
+
+// setenvs replaces the GOODOG_* env vars with the envs, the returned function restores them.
+func setenvs(t *testing.T, envs map[string]string) func() {
+	saved := map[string]string{}
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "GOODOG_") {
+			kv := strings.SplitN(kv, "=", 2)
+			saved[kv[0]] = kv[1]
+			require.Nil(t, os.Unsetenv(kv[0]))
+		}
+	}
+	for k, v := range envs {
+		require.Nil(t, os.Setenv(k, v))
+	}
+	return func() {
+		for k := range envs {
+			_ = os.Unsetenv(k)
+		}
+		for k, v := range saved {
+			_ = os.Setenv(k, v)
+		}
+	}
+}
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	require.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goodog-config")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := writeFile(t, dir, "goodog.yaml", "listen: :1\n")
+
+	for _, c := range []struct {
+		name     string
+		explicit map[string]string
+		envs     map[string]string
+		expected string
+	}{
+		{"default", map[string]string{}, nil, ":59487"},
+		{"file", map[string]string{"config": path}, nil, ":1"},
+		{"file-by-env", map[string]string{}, map[string]string{"GOODOG_CONFIG": path}, ":1"},
+		{"legacy-env", map[string]string{"config": path}, map[string]string{"GOODOG_LISTEN_ADDRESS": ":2"}, ":2"},
+		{"env", map[string]string{"config": path},
+			map[string]string{"GOODOG_LISTEN_ADDRESS": ":2", "GOODOG_LISTEN": ":3"}, ":3"},
+		{"flag", map[string]string{"config": path, "listen": ":4"},
+			map[string]string{"GOODOG_LISTEN_ADDRESS": ":2", "GOODOG_LISTEN": ":3"}, ":4"},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			defer setenvs(t, c.envs)()
+			conf, err := loadConfig(c.explicit)
+			require.Nil(t, err)
+			require.Equal(t, c.expected, conf.ListenAddr)
+			require.Equal(t, 10*time.Second, conf.ConnectTimeout) // The default of the others.
+		})
+	}
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	defer setenvs(t, nil)()
+	dir, err := ioutil.TempDir("", "goodog-config")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"goodog.yaml": `
+server:
+  - https://a.example/?version=v1
+  - https://b.example/?version=v2
+timeout: 2m
+max-conns: 8
+quic-keepalive: false
+quic-stream-window: 10000000000
+quic-max-incoming-streams: -1
+listeners: [socks5://127.0.0.1:1080, http://127.0.0.1:8080]
+`,
+		"goodog.json": `{
+  "server": ["https://a.example/?version=v1", "https://b.example/?version=v2"],
+  "timeout": "2m",
+  "max-conns": 8,
+  "quic-keepalive": false,
+  "quic-stream-window": 10000000000,
+  "quic-max-incoming-streams": -1,
+  "listeners": ["socks5://127.0.0.1:1080", "http://127.0.0.1:8080"]
+}`,
+		"goodog.toml": `
+server = ["https://a.example/?version=v1", "https://b.example/?version=v2"]
+timeout = "2m"
+max-conns = 8
+quic-keepalive = false
+quic-stream-window = 10000000000
+quic-max-incoming-streams = -1
+listeners = ["socks5://127.0.0.1:1080", "http://127.0.0.1:8080"]
+`,
+	} {
+		conf, err := loadConfig(map[string]string{"config": writeFile(t, dir, name, content)})
+		require.Nil(t, err, name)
+		require.Equal(t, []string{"https://a.example/?version=v1", "https://b.example/?version=v2"}, conf.ServerURIs, name)
+		require.Equal(t, 2*time.Minute, conf.Timeout, name)
+		require.Equal(t, 8, conf.MaxConns, name)
+		require.True(t, conf.QUICDisableKeepAlive, name)
+		require.Equal(t, uint64(10000000000), conf.QUICStreamWindow, name)
+		require.Equal(t, -1, conf.QUICMaxIncomingStreams, name)
+		require.Equal(t, []frontend.Listener{
+			{Kind: "socks5", Addr: "127.0.0.1:1080"},
+			{Kind: "http", Addr: "127.0.0.1:8080"},
+		}, conf.Listeners, name)
+	}
+}
+
+func TestReadConfigFileRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goodog-config")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		name    string
+		content string
+		reason  string
+	}{
+		{"unknown.yaml", "unknown: 1\n", "unknown option"},
+		{"unknown.json", `{"unknown": 1}`, "unknown option"},
+		{"unknown.toml", "unknown = 1\n", "unknown option"},
+		{"config.yaml", "config: other.yaml\n", "unknown option"},
+		{"version.json", `{"version": true}`, "unknown option"},
+		{"table.yaml", "server: {a: b}\n", "invalid option"},
+		{"nested.json", `{"server": [["a"]]}`, "invalid option"},
+		{"duplicated.yaml", "timeout: 1m\ntimeout: 2m\n", "malformed"},
+		{"malformed.json", "{", "malformed"},
+		{"goodog.ini", "timeout=1m\n", "unknown config file format"},
+	} {
+		_, err := readConfigFile(writeFile(t, dir, c.name, c.content))
+		require.NotNil(t, err, c.name)
+		require.Contains(t, err.Error(), c.reason, c.name)
+	}
+
+	defer setenvs(t, nil)()
+	_, err = loadConfig(map[string]string{"config": writeFile(t, dir, "invalid.yaml", "timeout: abc\n")})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid value")
+}
+
+func TestParseListeners(t *testing.T) {
+	listeners, err := parseListeners(" socks5://127.0.0.1:1080,,tproxy://:8081 ")
+	require.Nil(t, err)
+	require.Equal(t, []frontend.Listener{
+		{Kind: "socks5", Addr: "127.0.0.1:1080"},
+		{Kind: "tproxy", Addr: ":8081"},
+	}, listeners)
+
+	listeners, err = parseListeners("")
+	require.Nil(t, err)
+	require.Empty(t, listeners)
+
+	for _, s := range []string{"127.0.0.1:1080", "raw://"} {
+		_, err := parseListeners(s)
+		require.NotNil(t, err, s)
+	}
+}
@@ -19,25 +19,58 @@ import (
 var (
 	flagset = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 
+	flagConfig = flagset.String("config", "", "The config file in YAML(.yaml, .yml), JSON(.json) or TOML(.toml), the keys are the names of the options, reloaded on SIGHUP")
+
 	flagServerURI = flagset.String("server",
-		"https://<DOMAIN>/?version=v1&compression=snappy", "The remote server URI")
+		"https://<DOMAIN>/?version=v1&compression=snappy", "The remote server URI, separate multiple servers by comma")
+	flagBalance        = flagset.String("balance", "round-robin", "The balancing policy of multiple servers: [round-robin, least-streams, lowest-latency]")
 	flagListenAddr     = flagset.String("listen", ":59487", "The Listen address")
-	flagConnector      = flagset.String("connector", "caddy-http3", "The connector(backend) type: [caddy-http3]")
+	flagListeners      = flagset.String("listeners", "", "More listeners in kind://addr separated by comma, the kinds: [raw, socks5, http, redirect, tproxy]")
+	flagSOCKS5Addr     = flagset.String("socks5-listen", "", "The SOCKS5 listen address, disabled if empty")
+	flagHTTPAddr       = flagset.String("http-listen", "", "The HTTP(CONNECT) proxy listen address, disabled if empty")
+	flagRedirectAddr   = flagset.String("redirect-listen", "", "The listen address for iptables/nftables REDIRECT(TCP), Linux only, disabled if empty")
+	flagTProxyAddr     = flagset.String("tproxy-listen", "", "The listen address for iptables/nftables TPROXY(TCP and UDP), Linux only, disabled if empty")
+	flagConnector      = flagset.String("connector", "caddy-http3", "The connector(backend) type: [caddy-http3, caddy-http2, caddy-auto]")
+	flagMux            = flagset.String("mux", "", "Multiplex the TCP streams over a few long-lived streams: [yamux], disabled if empty")
+	flagUDPMux         = flagset.String("udp-mux", "", "Multiplex the UDP packets of all the peers over a few streams: [packet], disabled if empty")
+	flagMASQUE         = flagset.String("masque", "", "The MASQUE CONNECT-UDP(HTTP/1.1 Upgrade only) URI template for UDP, relative to the server if it is a path, disabled if empty")
+	flagCompression    = flagset.String("compression", "", "The compression method, e.g. snappy, zstd:fastest, lz4 or gzip:6, the one in the server URI if empty")
 	flagLogLevel       = flagset.String("log-level", "info", "The log level: [debug, info, warn, error, panic, fatal]")
 	flagConnectTimeout = flagset.Duration("connect-timeout", 10*time.Second, "The connect timeout")
 	flagTimeout        = flagset.Duration("timeout", 60*time.Second, "The read/write timeout")
-	flagPProfAddr      = flagset.String("pprof-addr", "", "The address to enable golang pprof server")
+	flagProbeInterval  = flagset.Duration("probe-interval", 30*time.Second, "How often the servers are probed, disabled if it is zero")
+	flagWarmConns      = flagset.Int("warm-conns", 1, "The minimum number of the warm QUIC connections per server, HTTP/3 only")
+	flagMaxConns       = flagset.Int("max-conns", 0, "The max number of the QUIC connections per server, unlimited if it is zero")
+	flagMaxStreams     = flagset.Int("max-streams-per-conn", 66, "The max streams per QUIC connection")
+	flagConnIdle       = flagset.Duration("conn-idle-timeout", 3*time.Minute, "The QUIC connections without streams are closed after it")
+	flagQUICHandshake  = flagset.Duration("quic-handshake-timeout", 0, "The QUIC handshake timeout, the connect timeout if it is zero")
+	flagQUICIdle       = flagset.Duration("quic-idle-timeout", 6*time.Minute, "The QUIC connections are closed if nothing is received for it")
+	flagQUICKeepAlive  = flagset.Bool("quic-keepalive", true, "Send the keep-alive packets on the QUIC connections")
+	flagQUICStreamWin  = flagset.Uint64("quic-stream-window", 0, "The max receive window of a QUIC stream in bytes, 6MB if it is zero")
+	flagQUICConnWin    = flagset.Uint64("quic-conn-window", 0, "The max receive window of a QUIC connection in bytes, 15MB if it is zero")
+	flagQUICInStreams  = flagset.Int("quic-max-incoming-streams", 0, "The max bidirectional streams the server can open per QUIC connection, 100 if it is zero, none if it is negative")
+	flagPProfAddr      = flagset.String("pprof-addr", "", "The address to enable golang pprof server, expvar and the server status(/status)")
+	flagMetricsAddr    = flagset.String("metrics-addr", "", "The address to expose the metrics in the Prometheus text format(/metrics), disabled if empty")
+	flagAdminAddr      = flagset.String("admin-addr", "", "The address of the admin API(/sessions, /log-level and /http3-pools), disabled if empty")
 	flagVersion        = flagset.Bool("version", false, "Print the version")
 )
 
 func main() {
 	_ = flagset.Parse(os.Args[1:])
+	explicit := map[string]string{} // They take precedence over the others.
+	flagset.Visit(func(f *flag.Flag) { explicit[f.Name] = f.Value.String() })
 
 	if *flagVersion {
 		fmt.Println(goodog.VersionInfo())
 		return
 	}
 
+	conf, err := loadConfig(explicit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Init failed: %v", err)
+		os.Exit(1)
+	}
+	// The addresses below are not reloaded.
 	if *flagPProfAddr != "" {
 		go func() {
 			if err := http.ListenAndServe(*flagPProfAddr, nil); err != nil {
@@ -45,20 +78,30 @@ func main() {
 			}
 		}()
 	}
+	if *flagMetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", frontend.MetricsHandler())
+		go func() {
+			if err := http.ListenAndServe(*flagMetricsAddr, mux); err != nil {
+				fmt.Printf("metrics server exit abnormally: %v\n", err)
+			}
+		}()
+	}
 
-	proxy, err := frontend.NewProxy(frontend.Config{
-		ListenAddr:     *flagListenAddr,
-		ServerURI:      *flagServerURI,
-		Connector:      *flagConnector,
-		LogLevel:       *flagLogLevel,
-		ConnectTimeout: *flagConnectTimeout,
-		Timeout:        *flagTimeout,
-	})
+	proxy, err := frontend.NewProxy(conf)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Init failed: %v", err)
 		os.Exit(1)
 	}
 	defer proxy.Close()
+	http.Handle("/status", proxy.StatusHandler())
+	if *flagAdminAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(*flagAdminAddr, proxy.AdminHandler()); err != nil {
+				fmt.Printf("admin server exit abnormally: %v\n", err)
+			}
+		}()
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -70,12 +113,37 @@ func main() {
 	}()
 
 	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
-	select {
-	case sig := <-sigc:
-		fmt.Printf("[SIGNAL] %v\n", sig)
-		cancel() // Graceful??
-	case <-errc:
-		os.Exit(1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case sig := <-sigc:
+			fmt.Printf("[SIGNAL] %v\n", sig)
+			if sig == syscall.SIGHUP {
+				reload(proxy, explicit)
+				continue
+			}
+			cancel() // Graceful??
+		case <-errc:
+			os.Exit(1)
+		}
+		return
+	}
+}
+
+// reload applies the changes of the config file, the new sessions use them and
+// the existing ones are not affected.
+func reload(proxy *frontend.Proxy, explicit map[string]string) {
+	if *flagConfig == "" {
+		fmt.Println("No config file to reload")
+		return
+	}
+	conf, err := loadConfig(explicit)
+	if err == nil {
+		err = proxy.Reload(conf)
+	}
+	if err != nil {
+		fmt.Printf("Reload failed, the previous config is kept: %v\n", err)
+		return
 	}
+	fmt.Println("Config reloaded")
 }
@@ -0,0 +1,199 @@
+package frontend
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/damnever/goodog/internal/pkg/traffic"
+)
+
+// closeReasonAdmin is the close reason of the sessions closed by the admin API.
+const closeReasonAdmin = "admin"
+
+// sessionTable tracks the live sessions of the relays, so that they can be
+// inspected and closed by the admin API.
+type sessionTable struct {
+	mu       sync.Mutex
+	nextID   uint64
+	sessions map[*traffic.Session]*liveSession
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{sessions: map[*traffic.Session]*liveSession{}}
+}
+
+type liveSession struct {
+	id          uint64
+	network     string
+	downstream  string
+	destination string // Empty if the upstream is configured in the backend.
+	upstream    string
+	session     *traffic.Session
+	close       func()
+}
+
+func (t *sessionTable) add(s *liveSession) {
+	t.mu.Lock()
+	t.nextID++
+	s.id = t.nextID
+	t.sessions[s.session] = s
+	t.mu.Unlock()
+}
+
+func (t *sessionTable) remove(session *traffic.Session) {
+	t.mu.Lock()
+	delete(t.sessions, session)
+	t.mu.Unlock()
+}
+
+// closeMatched closes the sessions which match, it returns the number of them.
+func (t *sessionTable) closeMatched(match func(*liveSession) bool) int {
+	matched := []*liveSession{}
+	t.mu.Lock()
+	for _, s := range t.sessions {
+		if match(s) {
+			matched = append(matched, s)
+		}
+	}
+	t.mu.Unlock()
+	// They are removed once they are done.
+	for _, s := range matched {
+		s.close()
+	}
+	return len(matched)
+}
+
+func (t *sessionTable) list() []sessionInfo {
+	t.mu.Lock()
+	infos := make([]sessionInfo, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		stats := s.session.Stats()
+		infos = append(infos, sessionInfo{
+			ID:          s.id,
+			Network:     s.network,
+			Downstream:  s.downstream,
+			Destination: s.destination,
+			Upstream:    s.upstream,
+			Start:       s.session.Start(),
+			Age:         stats.Duration.Round(time.Millisecond).String(),
+			BytesUp:     stats.BytesUp,
+			BytesDown:   stats.BytesDown,
+			PacketsUp:   stats.PacketsUp,
+			PacketsDown: stats.PacketsDown,
+		})
+	}
+	t.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+type sessionInfo struct {
+	ID          uint64    `json:"id"`
+	Network     string    `json:"network"`
+	Downstream  string    `json:"downstream"`
+	Destination string    `json:"destination,omitempty"`
+	Upstream    string    `json:"upstream"`
+	Start       time.Time `json:"start"`
+	Age         string    `json:"age"`
+	BytesUp     uint64    `json:"bytes_up"`
+	BytesDown   uint64    `json:"bytes_down"`
+	PacketsUp   uint64    `json:"packets_up,omitempty"`
+	PacketsDown uint64    `json:"packets_down,omitempty"`
+}
+
+// http3PoolDumper is implemented by the connectors which have the HTTP/3 pools,
+// the wrappers of them delegate to the wrapped ones.
+type http3PoolDumper interface {
+	dumpHTTP3Pools() []http3PoolInfo
+}
+
+type http3PoolInfo struct {
+	Network string          `json:"network"`
+	Server  string          `json:"server"`
+	Conns   []http3ConnInfo `json:"conns"`
+}
+
+type http3ConnInfo struct {
+	Streams int    `json:"streams"`
+	Idle    string `json:"idle,omitempty"` // How long it has no streams.
+}
+
+// AdminHandler serves the admin API, it should not be exposed to the public:
+//
+//	GET    /sessions                       lists the live sessions in JSON
+//	DELETE /sessions/{id}                  closes a session
+//	DELETE /sessions?downstream={addr}     closes the sessions of a downstream address(host:port, or host)
+//	GET    /log-level                      responds with the log level, e.g. {"level":"info"}
+//	PUT    /log-level                      changes the log level, e.g. {"level":"debug"}
+//	GET    /http3-pools                    dumps the HTTP/3 connection pools
+func (p *Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", p.handleSessions)
+	mux.HandleFunc("/sessions/", p.handleSession)
+	mux.Handle("/log-level", _loggerConfig.Level)
+	mux.HandleFunc("/http3-pools", p.handleHTTP3Pools)
+	return mux
+}
+
+func (p *Proxy) handleSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, p.sessions.list())
+	case http.MethodDelete:
+		downstream := r.URL.Query().Get("downstream")
+		if downstream == "" {
+			http.Error(w, "downstream is required", http.StatusBadRequest)
+			return
+		}
+		closed := p.sessions.closeMatched(func(s *liveSession) bool {
+			return s.downstream == downstream || strings.HasPrefix(s.downstream, downstream+":") ||
+				strings.HasPrefix(s.downstream, "["+downstream+"]:")
+		})
+		writeJSON(w, http.StatusOK, map[string]int{"closed": closed})
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *Proxy) handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/sessions/"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid session id", http.StatusBadRequest)
+		return
+	}
+	if p.sessions.closeMatched(func(s *liveSession) bool { return s.id == id }) == 0 {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"closed": 1})
+}
+
+func (p *Proxy) handleHTTP3Pools(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	pools := []http3PoolInfo{}
+	g := p.generation()
+	for _, connector := range []Connector{g.tcpconnector, g.udpconnector} {
+		if dumper, ok := connector.(http3PoolDumper); ok {
+			pools = append(pools, dumper.dumpHTTP3Pools()...)
+		}
+	}
+	writeJSON(w, http.StatusOK, pools)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -5,22 +5,51 @@ import (
 	"io"
 	"sync"
 
-	ioext "github.com/damnever/libext-go/io"
-	"github.com/golang/snappy"
-
-	"github.com/damnever/goodog/internal/pkg/snappypool"
+	"github.com/damnever/goodog/internal/pkg/compression"
+	"github.com/damnever/goodog/internal/pkg/metrics"
 )
 
-func tryWrapWithCompression(rwc io.ReadWriteCloser, compressMethod string) io.ReadWriteCloser {
-	switch compressMethod {
-	default:
+func tryWrapWithCompression(rwc io.ReadWriteCloser, codec compression.Codec) io.ReadWriteCloser {
+	if codec == nil {
 		return rwc
-	case "snappy":
-		return &withCompression{
-			closer: rwc,
-			reader: snappypool.GetReader(rwc),
-			writer: snappypool.GetWriter(rwc),
-		}
+	}
+	return &withCompression{
+		closer: rwc,
+		reader: codec.NewReader(rwc),
+		writer: codec.NewWriter(rwc),
+	}
+}
+
+// compressionCounters sum up the compression.Stats of the streams in both directions,
+// the ratio is the wire bytes to the raw bytes of a stream in a direction.
+type compressionCounters struct {
+	rawBytes         *metrics.Counter
+	wireBytes        *metrics.Counter
+	storedBlocks     *metrics.Counter
+	compressedBlocks *metrics.Counter
+	ratio            *metrics.Histogram
+}
+
+var _compressionCounters = &compressionCounters{
+	rawBytes:         newCounter("compression.raw-bytes", "The uncompressed bytes."),
+	wireBytes:        newCounter("compression.wire-bytes", "The compressed bytes."),
+	storedBlocks:     newCounter("compression.stored-blocks", "The blocks which are stored uncompressed."),
+	compressedBlocks: newCounter("compression.compressed-blocks", "The blocks which are compressed."),
+	ratio:            newHistogram("compression.ratio", "The wire bytes to the raw bytes of the streams.", _ratioBuckets),
+}
+
+func (c *compressionCounters) add(v interface{}) {
+	reporter, ok := v.(compression.StatsReporter)
+	if !ok {
+		return
+	}
+	stats := reporter.Stats()
+	c.rawBytes.Add(stats.RawBytes)
+	c.wireBytes.Add(stats.WireBytes)
+	c.storedBlocks.Add(stats.StoredBlocks)
+	c.compressedBlocks.Add(stats.CompressedBlocks)
+	if stats.RawBytes > 0 {
+		c.ratio.Observe(float64(stats.WireBytes) / float64(stats.RawBytes))
 	}
 }
 
@@ -33,9 +62,9 @@ type withCompression struct {
 	closer io.Closer
 
 	rmu    sync.Mutex
-	reader io.Reader
+	reader compression.Reader
 	wmu    sync.Mutex
-	writer io.Writer
+	writer compression.Writer
 }
 
 func (c *withCompression) Read(p []byte) (n int, err error) {
@@ -54,9 +83,7 @@ func (c *withCompression) Write(p []byte) (n int, err error) {
 	if c.writer != nil {
 		n, err = c.writer.Write(p)
 		if err == nil {
-			if f, ok := c.writer.(ioext.Flusher); ok {
-				err = f.Flush()
-			}
+			err = c.writer.Flush()
 		}
 	} else {
 		err = errWriterClosed
@@ -70,21 +97,16 @@ func (c *withCompression) Close() error {
 
 	c.rmu.Lock()
 	if c.reader != nil {
-		if snappyr, ok := c.reader.(*snappy.Reader); ok {
-			snappypool.PutReader(snappyr)
-		}
+		_compressionCounters.add(c.reader)
+		c.reader.Release()
 		c.reader = nil
 	}
 	c.rmu.Unlock()
 
 	c.wmu.Lock()
 	if c.writer != nil {
-		if wc, ok := c.writer.(io.Closer); ok {
-			_ = wc.Close()
-		}
-		if snappyw, ok := c.writer.(*snappy.Writer); ok {
-			snappypool.PutWriter(snappyw)
-		}
+		_compressionCounters.add(c.writer)
+		c.writer.Release()
 		c.writer = nil
 	}
 	c.wmu.Unlock()
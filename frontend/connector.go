@@ -1,117 +1,510 @@
 package frontend
 
 import (
+	"bytes"
 	"container/heap"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	quic "github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/http3"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+
+	"github.com/damnever/goodog/internal/pkg/metrics"
+	"github.com/damnever/goodog/internal/pkg/protocol"
 )
 
+var errHTTP3ConnectorClosed = errors.New("goodog/frontend: HTTP/3 connector closed")
+
 type Connector interface {
-	Connect(context.Context) (io.ReadWriteCloser, error)
+	// Connect connects to the backend, the dst is the destination which the
+	// backend dials, it is nil if the upstream is configured in the backend.
+	Connect(ctx context.Context, dst *protocol.Addr) (io.ReadWriteCloser, error)
 	Close() error
 }
 
+// connectURLs are the URLs of the same backend in different protocol versions.
+type connectURLs struct {
+	v1 string // e.g. goodog.x.io/?version=v1&protocol=tcp&compression=snappy
+	v2 string
+}
+
+// resolve returns the URL and the preamble for the dst,
+// protocol v2 is used if the dst is not nil.
+func (urls connectURLs) resolve(dst *protocol.Addr) (string, []byte, error) {
+	if dst == nil {
+		return urls.v1, nil, nil
+	}
+	preamble, err := protocol.AppendPreamble(nil, dst)
+	if err != nil {
+		return "", nil, err
+	}
+	return urls.v2, preamble, nil
+}
+
+// streamConnector is a Connector which can open the raw streams for the mux sessions.
+type streamConnector interface {
+	Connector
+	// openStream opens a stream to the uri without any preamble.
+	openStream(ctx context.Context, uri string) (io.ReadWriteCloser, error)
+}
+
+// datagramConnector is a Connector which carries every UDP packet as a message(e.g.
+// the DATAGRAM capsules of MASQUE) instead of the size-prefixed packets of the goodog
+// protocol, only the MASQUE connector implements it. The messages still go through a
+// reliable stream, a lost packet stalls the later ones as well.
+//
+// NOTE(damnever): the unreliable datagrams(RFC 9221/9297) are not supported, the
+// quic-go we are using supports neither the QUIC DATAGRAM frames nor the HTTP/3 datagrams.
+type datagramConnector interface {
+	Connector
+	// connectDatagrams is the same as Connect except that every Read/Write is a whole packet.
+	connectDatagrams(ctx context.Context, dst *protocol.Addr) (io.ReadWriteCloser, error)
+}
+
+// Kinds of the connect errors.
+const (
+	connectErrTimeout   = "timeout"
+	connectErrTLS       = "tls"
+	connectErrStatus    = "status"
+	connectErrForbidden = "forbidden" // Denied by the ACL of the backend.
+	connectErrNegotiate = "negotiate" // The backend does not accept what is requested.
+	connectErrOther     = "other"
+)
+
+// connectError tells why a Connector failed to connect.
+type connectError struct {
+	kind string
+	err  error
+}
+
+func (e *connectError) Error() string {
+	return e.err.Error()
+}
+
+func (e *connectError) Unwrap() error {
+	return e.err
+}
+
+func connectErrorKind(err error) string {
+	var cerr *connectError
+	if errors.As(err, &cerr) {
+		return cerr.kind
+	}
+	return connectErrOther
+}
+
+// newStatusError creates the error for the status responded by the backend.
+func newStatusError(status int) *connectError {
+	kind := connectErrStatus
+	if status == http.StatusForbidden {
+		kind = connectErrForbidden
+	}
+	return &connectError{kind: kind, err: fmt.Errorf("connect failed: %d %s", status, http.StatusText(status))}
+}
+
+// reachable tells if the server is reachable by the connect error, the other
+// servers do not help then.
+func reachable(err error) bool {
+	kind := connectErrorKind(err)
+	return kind == connectErrStatus || kind == connectErrForbidden || kind == connectErrNegotiate
+}
+
+// checkNegotiation checks if the backend accepts what is requested by the uri, see
+// protocol.HeaderFeatures. The older backends respond without the headers, the
+// compressions other than snappy are not supported by them.
+func checkNegotiation(uri *url.URL, header http.Header) error {
+	q := uri.Query()
+	method := strings.ToLower(q.Get("compression"))
+	if method == "" {
+		method = protocol.CompressionNone
+	}
+	name := strings.SplitN(method, ":", 2)[0]
+	features := header.Get(protocol.HeaderFeatures)
+	if features == "" {
+		if name == protocol.CompressionNone || name == "snappy" {
+			return nil
+		}
+		return &connectError{kind: connectErrNegotiate,
+			err: fmt.Errorf("goodog/frontend: compression %s may not be supported by the backend, upgrade it", method)}
+	}
+
+	if name != protocol.CompressionNone && !protocol.ParseFeatures(features)["compression="+name] {
+		return &connectError{kind: connectErrNegotiate,
+			err: fmt.Errorf("goodog/frontend: compression %s is not supported by the backend: %s", method, features)}
+	}
+	if accepted := header.Get(protocol.HeaderCompression); accepted != "" && accepted != method {
+		return &connectError{kind: connectErrNegotiate,
+			err: fmt.Errorf("goodog/frontend: compression mismatch: %s requested, %s accepted", method, accepted)}
+	}
+	if accepted := header.Get(protocol.HeaderVersion); accepted != "" && accepted != q.Get("version") {
+		return &connectError{kind: connectErrNegotiate,
+			err: fmt.Errorf("goodog/frontend: version mismatch: %s requested, %s accepted", q.Get("version"), accepted)}
+	}
+	return nil
+}
+
+func classifyConnectError(err error) *connectError {
+	var (
+		cryptoErr interface{ IsCryptoError() bool } // *qerr.QuicError is internal
+		netErr    net.Error
+		unknownCA x509.UnknownAuthorityError
+		hostErr   x509.HostnameError
+		certErr   x509.CertificateInvalidError
+		recordErr tls.RecordHeaderError
+	)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return &connectError{kind: connectErrTimeout, err: err}
+	case errors.As(err, &cryptoErr) && cryptoErr.IsCryptoError(),
+		errors.As(err, &unknownCA), errors.As(err, &hostErr),
+		errors.As(err, &certErr), errors.As(err, &recordErr):
+		return &connectError{kind: connectErrTLS, err: err}
+	default:
+		return &connectError{kind: connectErrOther, err: err}
+	}
+}
+
+// http3PoolConfig sizes the QUIC connections of caddyHTTP3Connector.
+type http3PoolConfig struct {
+	warmConns   int           // The minimum number of the connections, they are kept warm.
+	maxConns    int           // Unlimited if it is zero.
+	maxStreams  int           // The max streams per connection, exceeded if maxConns is reached.
+	idleTimeout time.Duration // The connections without streams are evicted after it.
+}
+
+// caddyHTTP3Connector spreads the streams over a few QUIC connections, at least
+// warmConns of them are connected in advance and health-checked periodically, so that
+// the streams do not pay the handshake. The TLS sessions are shared by the connections
+// to resume the later handshakes.
+//
+// NOTE(damnever): the quic-go we are using resumes the sessions by the tickets but it
+// does not support 0-RTT, the resumed handshake still takes a round trip.
 type caddyHTTP3Connector struct {
-	url                string // e.g. goodog.x.io/?version=v1&protocol=tcp&compression=snappy
+	urls               connectURLs
 	insecureSkipVerify bool
-	timeout            time.Duration
+	connectTimeout     time.Duration
+	pool               http3PoolConfig
+	quicConfig         *quic.Config
+	sessionCache       tls.ClientSessionCache
+	network            string
+	host               string
+	logger             *zap.Logger
 
 	mu      sync.Mutex
+	closed  bool
 	clients *http3ClientsPriorityQueue
+
+	closeOnce sync.Once
+	closec    chan struct{}
+
+	// NOTE(damnever): the gauges are shared by the generations of the same server
+	// during a reload, every connector adds what it has changed since the last
+	// update, so that the old one which is draining does not overwrite them.
+	connsCounter   *metrics.Gauge
+	streamsCounter *metrics.Gauge
+	busiestCounter *metrics.Gauge // The streams of the busiest connection.
+	evictedCounter *metrics.Counter
+	reported       struct{ conns, streams, busiest int64 } // Added to the gauges, guarded by mu.
 }
 
-func newCaddyHTTP3Connector(serverURL string, insecureSkipVerify bool, timeout time.Duration) *caddyHTTP3Connector {
-	return &caddyHTTP3Connector{
-		url:                serverURL,
+func newCaddyHTTP3Connector(urls connectURLs, insecureSkipVerify bool, connectTimeout time.Duration,
+	pool http3PoolConfig, quicConfig *quic.Config, network, host string, logger *zap.Logger) *caddyHTTP3Connector {
+	prefix := network + ".http3.{server}"
+	c := &caddyHTTP3Connector{
+		urls:               urls,
 		insecureSkipVerify: insecureSkipVerify,
-		timeout:            timeout,
+		connectTimeout:     connectTimeout,
+		pool:               pool,
+		quicConfig:         quicConfig,
+		sessionCache:       tls.NewLRUClientSessionCache(0),
+		network:            network,
+		host:               host,
+		logger:             logger,
 		clients:            &http3ClientsPriorityQueue{},
+		closec:             make(chan struct{}),
+
+		connsCounter:   newGauge(prefix+".conns", "The QUIC connections in the pool.", host),
+		streamsCounter: newGauge(prefix+".streams", "The active streams in the pool.", host),
+		busiestCounter: newGauge(prefix+".busiest-conn-streams", "The streams of the busiest connection.", host),
+		evictedCounter: newCounter(prefix+".evicted-conns", "The idle connections which are evicted.", host),
 	}
+	go c.maintainLoop()
+	return c
 }
 
-func (c *caddyHTTP3Connector) Connect(ctx context.Context) (io.ReadWriteCloser, error) {
-	reqr, reqw := io.Pipe()
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, reqr)
+// Connect opens a new stream, the connect timeout covers the QUIC handshake(TLS included)
+// and the response header, the stream itself is not limited by it.
+func (c *caddyHTTP3Connector) Connect(ctx context.Context, dst *protocol.Addr) (io.ReadWriteCloser, error) {
+	uri, preamble, err := c.urls.resolve(dst)
 	if err != nil {
-		reqr.Close()
-		reqw.Close()
 		return nil, err
 	}
-	// req.Header.Set("Transfer-Encoding", "chunked")
+	client, err := c.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return connectStream(ctx, client.Client, uri, preamble, c.connectTimeout, func() { c.release(client) })
+}
+
+func (c *caddyHTTP3Connector) openStream(ctx context.Context, uri string) (io.ReadWriteCloser, error) {
+	client, err := c.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return connectStream(ctx, client.Client, uri, nil, c.connectTimeout, func() { c.release(client) })
+}
+
+// probe checks if the server is reachable over HTTP/3, any response is fine.
+func (c *caddyHTTP3Connector) probe(ctx context.Context) error {
+	client, err := c.getClient()
+	if err != nil {
+		return err
+	}
+	defer c.release(client)
+	return c.ping(ctx, client)
+}
+
+func (c *caddyHTTP3Connector) ping(ctx context.Context, client *http3ClientWrapper) error {
+	ctx, cancel := context.WithTimeout(ctx, c.connectTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.urls.v1, nil)
+	if err != nil {
+		return err
+	}
 	req.Header.Set("User-Agent", "goodog/frontend")
 
-	// TODO(damnever); connect timeout
-	client := c.getClient()
 	resp, err := client.Do(req)
 	if err != nil {
-		reqr.Close()
-		reqw.Close()
-		if resp != nil {
-			_, _ = io.Copy(ioutil.Discard, resp.Body)
-			resp.Body.Close()
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// maintainLoop evicts the idle connections and keeps at least warmConns connections,
+// the broken ones are replaced.
+func (c *caddyHTTP3Connector) maintainLoop() {
+	// FIXME(damnever): magic numbers
+	interval := 30 * time.Second
+	if c.pool.idleTimeout < 2*interval {
+		interval = c.pool.idleTimeout / 2
+	}
+	if interval < 100*time.Millisecond { // A tiny idle timeout must not spin the loop.
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if c.pool.warmConns > 0 {
+			c.warm()
 		}
-		c.release(client)
-		return nil, err
+		select {
+		case <-c.closec:
+			return
+		case <-ticker.C:
+		}
+		c.evict(time.Now())
 	}
-	if resp.StatusCode != http.StatusOK {
-		reqr.Close()
-		reqw.Close()
-		_, _ = io.Copy(ioutil.Discard, resp.Body)
-		resp.Body.Close()
-		c.release(client)
-		return nil, fmt.Errorf("connect failed: %s", resp.Status)
+}
+
+// warm creates the missing clients and pings all of them, the first ping of a new
+// client makes the connection, the later ones keep it healthy.
+func (c *caddyHTTP3Connector) warm() {
+	c.mu.Lock()
+	for !c.closed && c.clients.Len() < c.pool.warmConns {
+		heap.Push(c.clients, c.newClient())
 	}
+	c.updateMetrics()
+	clients := append([]*http3ClientWrapper(nil), *c.clients...)
+	c.mu.Unlock()
 
-	once := sync.Once{}
-	return &withReqResp{
-		reqr:    reqr,
-		reqw:    reqw,
-		respr:   resp.Body,
-		onClose: func() { once.Do(func() { c.release(client) }) },
-	}, nil
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.closec:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for _, client := range clients {
+		err := c.ping(ctx, client)
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+		c.mu.Lock()
+		if err == nil {
+			client.pingFailures = 0
+		} else {
+			client.pingFailures++
+		}
+		c.mu.Unlock()
+		if err != nil {
+			c.logger.Debug("QUIC connection failed to ping", zap.Error(err))
+			c.replace(client)
+		}
+	}
+}
+
+// evict closes the clients which have no streams for idleTimeout, the warm ones are kept.
+func (c *caddyHTTP3Connector) evict(now time.Time) {
+	evicted := []*http3ClientWrapper{}
+	c.mu.Lock()
+	for _, client := range append([]*http3ClientWrapper(nil), *c.clients...) {
+		if c.clients.Len() <= c.pool.warmConns {
+			break
+		}
+		if client.streams == 0 && now.Sub(client.idleSince) >= c.pool.idleTimeout {
+			heap.Remove(c.clients, client.index)
+			evicted = append(evicted, client)
+		}
+	}
+	c.updateMetrics()
+	c.mu.Unlock()
+
+	for _, client := range evicted {
+		client.close()
+	}
+	c.evictedCounter.Add(uint64(len(evicted)))
+}
+
+// FIXME(damnever): magic number
+const maxPingFailures = 3
+
+// replace replaces the client which failed to ping with a new one, if it is idle or it
+// has failed maxPingFailures pings in a row, a lost ping does not break the streams.
+// The replaced client is closed once its streams are drained.
+func (c *caddyHTTP3Connector) replace(client *http3ClientWrapper) {
+	c.mu.Lock()
+	if client.index < 0 || (client.streams > 0 && client.pingFailures < maxPingFailures) {
+		c.mu.Unlock()
+		return
+	}
+	heap.Remove(c.clients, client.index)
+	if !c.closed {
+		heap.Push(c.clients, c.newClient())
+	}
+	c.updateMetrics()
+	drained := client.streams == 0
+	client.draining = !drained
+	c.mu.Unlock()
+
+	c.logger.Debug("QUIC connection is broken, re-establish it", zap.Bool("drained", drained))
+	if drained {
+		client.close()
+	}
 }
 
 func (c *caddyHTTP3Connector) Close() error {
+	c.closeOnce.Do(func() { close(c.closec) })
 	c.mu.Lock()
-	for _, client := range *c.clients {
-		client.CloseIdleConnections()
+	c.closed = true
+	for c.clients.Len() > 0 {
+		heap.Pop(c.clients).(*http3ClientWrapper).close()
 	}
+	c.updateMetrics()
 	c.mu.Unlock()
 	return nil
 }
 
-func (c *caddyHTTP3Connector) getClient() *http3ClientWrapper {
-	// FIXME(damnever): magic number
-	// Ref: https://github.com/lucas-clemente/quic-go/wiki/DoS-mitigations
-	const maxStreamsPreConn = 66
+// activeStreams sums up the streams of the clients.
+func (c *caddyHTTP3Connector) activeStreams() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, client := range *c.clients {
+		n += client.streams
+	}
+	return n
+}
 
+// getClient picks the client with the least streams, a new one is created if all of
+// them are full, unless there are maxConns clients already.
+func (c *caddyHTTP3Connector) getClient() (*http3ClientWrapper, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.clients.Len() == 0 || (*c.clients)[0].streams >= maxStreamsPreConn {
-		client := &http3ClientWrapper{Client: c.newHTTPClient()}
-		heap.Push(c.clients, client)
-		return client
+	if c.closed {
+		return nil, errHTTP3ConnectorClosed
+	}
+	if c.clients.Len() == 0 || ((*c.clients)[0].streams >= c.pool.maxStreams &&
+		(c.pool.maxConns <= 0 || c.clients.Len() < c.pool.maxConns)) {
+		heap.Push(c.clients, c.newClient())
 	}
 	client := (*c.clients)[0] // DO NOT pop it.
 	client.streams++          // Increase the counter immediately to avoid bursting..
 	heap.Fix(c.clients, client.index)
-	return client
+	c.updateMetrics()
+	return client, nil
 }
 
 func (c *caddyHTTP3Connector) release(client *http3ClientWrapper) {
 	c.mu.Lock()
 	client.streams--
-	heap.Fix(c.clients, client.index)
+	drained := false
+	if client.streams == 0 {
+		client.idleSince = time.Now()
+		drained = client.draining
+	}
+	if client.index >= 0 { // It may have been replaced or evicted.
+		heap.Fix(c.clients, client.index)
+		c.updateMetrics()
+	}
 	c.mu.Unlock()
+	if drained {
+		client.close()
+	}
+}
+
+func (c *caddyHTTP3Connector) dumpHTTP3Pools() []http3PoolInfo {
+	pool := http3PoolInfo{Network: c.network, Server: c.host, Conns: []http3ConnInfo{}}
+	now := time.Now()
+	c.mu.Lock()
+	for _, client := range *c.clients {
+		conn := http3ConnInfo{Streams: client.streams}
+		if client.streams == 0 {
+			conn.Idle = now.Sub(client.idleSince).Round(time.Millisecond).String()
+		}
+		pool.Conns = append(pool.Conns, conn)
+	}
+	c.mu.Unlock()
+	sort.Slice(pool.Conns, func(i, j int) bool { return pool.Conns[i].Streams > pool.Conns[j].Streams })
+	return []http3PoolInfo{pool}
+}
+
+// updateMetrics must be called with the c.mu held, the gauges drop what this
+// connector has added once all the clients are closed.
+func (c *caddyHTTP3Connector) updateMetrics() {
+	conns, streams, busiest := int64(c.clients.Len()), int64(0), int64(0)
+	for _, client := range *c.clients {
+		streams += int64(client.streams)
+		if int64(client.streams) > busiest {
+			busiest = int64(client.streams)
+		}
+	}
+	c.connsCounter.Add(conns - c.reported.conns)
+	c.streamsCounter.Add(streams - c.reported.streams)
+	c.busiestCounter.Add(busiest - c.reported.busiest)
+	c.reported.conns, c.reported.streams, c.reported.busiest = conns, streams, busiest
+}
+
+func (c *caddyHTTP3Connector) newClient() *http3ClientWrapper {
+	return &http3ClientWrapper{Client: c.newHTTPClient(), idleSince: time.Now()}
 }
 
 func (c *caddyHTTP3Connector) newHTTPClient() *http.Client {
@@ -120,16 +513,137 @@ func (c *caddyHTTP3Connector) newHTTPClient() *http.Client {
 			DisableCompression: true,
 			TLSClientConfig: &tls.Config{
 				InsecureSkipVerify: c.insecureSkipVerify,
+				ClientSessionCache: c.sessionCache,
 			},
-			QuicConfig: &quic.Config{
-				IdleTimeout: 6 * time.Minute,
-				KeepAlive:   true,
-			},
+			QuicConfig: c.quicConfig,
+		},
+	}
+}
+
+// caddyHTTP2Connector is the fallback of caddyHTTP3Connector if UDP is blocked,
+// the semantics are the same, the multiplexing is done by the http2.Transport.
+type caddyHTTP2Connector struct {
+	urls           connectURLs
+	connectTimeout time.Duration
+	transport      *http2.Transport
+	client         *http.Client
+}
+
+func newCaddyHTTP2Connector(urls connectURLs, insecureSkipVerify bool, connectTimeout time.Duration) *caddyHTTP2Connector {
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+	transport := &http2.Transport{
+		DisableCompression: true,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: insecureSkipVerify,
+		},
+		// The timeout of the dialer covers the TLS handshake as well.
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return tls.DialWithDialer(dialer, network, addr, cfg)
 		},
-		Timeout: c.timeout,
+	}
+	return &caddyHTTP2Connector{
+		urls:           urls,
+		connectTimeout: connectTimeout,
+		transport:      transport,
+		client:         &http.Client{Transport: transport},
 	}
 }
 
+func (c *caddyHTTP2Connector) Connect(ctx context.Context, dst *protocol.Addr) (io.ReadWriteCloser, error) {
+	uri, preamble, err := c.urls.resolve(dst)
+	if err != nil {
+		return nil, err
+	}
+	return connectStream(ctx, c.client, uri, preamble, c.connectTimeout, func() {})
+}
+
+func (c *caddyHTTP2Connector) openStream(ctx context.Context, uri string) (io.ReadWriteCloser, error) {
+	return connectStream(ctx, c.client, uri, nil, c.connectTimeout, func() {})
+}
+
+func (c *caddyHTTP2Connector) Close() error {
+	c.transport.CloseIdleConnections()
+	return nil
+}
+
+// connectStream sends a POST request whose body and response body make up a
+// bidirectional stream, the connect timeout covers everything before the
+// response header arrives, the stream itself is not limited by it.
+// The preamble goes first if it is not empty.
+func connectStream(ctx context.Context, client *http.Client, uri string, preamble []byte,
+	connectTimeout time.Duration, release func()) (io.ReadWriteCloser, error) {
+	reqr, reqw := io.Pipe()
+	body := io.Reader(reqr)
+	if len(preamble) > 0 {
+		body = io.MultiReader(bytes.NewReader(preamble), reqr)
+	}
+
+	// NOTE(damnever): the context lives as long as the stream does, so we can not
+	// use context.WithTimeout or http.Client.Timeout here.
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, body)
+	if err != nil {
+		cancel()
+		reqr.Close()
+		reqw.Close()
+		release()
+		return nil, err
+	}
+	// req.Header.Set("Transfer-Encoding", "chunked")
+	req.Header.Set("User-Agent", "goodog/frontend")
+
+	timer := time.AfterFunc(connectTimeout, cancel)
+	resp, err := client.Do(req)
+	timedout := !timer.Stop()
+	if err == nil && timedout {
+		// The ctx is canceled already, the stream would die on the first use.
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		cancel()
+		reqr.Close()
+		reqw.Close()
+		if resp != nil {
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		release()
+		if timedout {
+			return nil, &connectError{kind: connectErrTimeout, err: fmt.Errorf("connect timed out: %w", err)}
+		}
+		return nil, classifyConnectError(err)
+	}
+	// The backend rejects the unsupported options with 400.
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusBadRequest {
+		err = checkNegotiation(req.URL, resp.Header)
+	}
+	if err != nil || resp.StatusCode != http.StatusOK {
+		cancel()
+		reqr.Close()
+		reqw.Close()
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		release()
+		if err != nil {
+			return nil, err
+		}
+		return nil, newStatusError(resp.StatusCode)
+	}
+
+	once := sync.Once{}
+	return &withReqResp{
+		reqr:  reqr,
+		reqw:  reqw,
+		respr: resp.Body,
+		onClose: func() {
+			once.Do(func() {
+				cancel()
+				release()
+			})
+		},
+	}, nil
+}
+
 type withReqResp struct {
 	reqr    *io.PipeReader
 	reqw    *io.PipeWriter
@@ -162,8 +676,18 @@ func (rr *withReqResp) Close() error {
 
 type http3ClientWrapper struct {
 	*http.Client
-	streams int
-	index   int
+	streams      int
+	idleSince    time.Time // Since the streams dropped to zero.
+	pingFailures int       // The failed pings in a row.
+	draining     bool      // It has been replaced, closed once the streams are drained.
+	index        int
+}
+
+// close closes the QUIC connections, the http3.RoundTripper has no idle connections to close.
+func (c *http3ClientWrapper) close() {
+	if closer, ok := c.Transport.(io.Closer); ok {
+		closer.Close()
+	}
 }
 
 type http3ClientsPriorityQueue []*http3ClientWrapper
@@ -0,0 +1,119 @@
+package frontend
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	errorsext "github.com/damnever/libext-go/errors"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+
+	"github.com/damnever/goodog/internal/pkg/protocol"
+)
+
+// caddyAutoConnector prefers HTTP/3, it falls back to HTTP/2 after a few
+// consecutive failures (e.g. UDP/443 is blocked), then it keeps probing
+// HTTP/3 in the background and switches back once HTTP/3 works again.
+type caddyAutoConnector struct {
+	h3     *caddyHTTP3Connector
+	h2     *caddyHTTP2Connector
+	logger *zap.Logger
+
+	maxFailures   uint32
+	probeInterval time.Duration
+
+	failures  atomic.Uint32
+	fallback  atomic.Bool
+	closeOnce sync.Once
+	closec    chan struct{}
+}
+
+func newCaddyAutoConnector(h3 *caddyHTTP3Connector, h2 *caddyHTTP2Connector, logger *zap.Logger) *caddyAutoConnector {
+	return &caddyAutoConnector{
+		h3:     h3,
+		h2:     h2,
+		logger: logger,
+		// FIXME(damnever): magic numbers
+		maxFailures:   3,
+		probeInterval: 30 * time.Second,
+		closec:        make(chan struct{}),
+	}
+}
+
+func (c *caddyAutoConnector) Connect(ctx context.Context, dst *protocol.Addr) (io.ReadWriteCloser, error) {
+	return c.connect(ctx, func(connector streamConnector) (io.ReadWriteCloser, error) {
+		return connector.Connect(ctx, dst)
+	})
+}
+
+func (c *caddyAutoConnector) openStream(ctx context.Context, uri string) (io.ReadWriteCloser, error) {
+	return c.connect(ctx, func(connector streamConnector) (io.ReadWriteCloser, error) {
+		return connector.openStream(ctx, uri)
+	})
+}
+
+func (c *caddyAutoConnector) connect(ctx context.Context,
+	connect func(streamConnector) (io.ReadWriteCloser, error)) (io.ReadWriteCloser, error) {
+	if !c.fallback.Load() {
+		rwc, err := connect(c.h3)
+		if err == nil {
+			c.failures.Store(0)
+			return rwc, nil
+		}
+		// The server is reachable over HTTP/3 if it responds with a status.
+		if reachable(err) || ctx.Err() != nil {
+			return nil, err
+		}
+		if failures := c.failures.Inc(); failures < c.maxFailures {
+			return nil, err
+		}
+		c.fallbackToHTTP2(err)
+	}
+	return connect(c.h2)
+}
+
+func (c *caddyAutoConnector) fallbackToHTTP2(err error) {
+	if !c.fallback.CAS(false, true) {
+		return
+	}
+	c.logger.Warn("HTTP/3 keeps failing, fall back to HTTP/2",
+		zap.Uint32("failures", c.failures.Load()),
+		zap.Error(err),
+	)
+	go c.probeLoop()
+}
+
+func (c *caddyAutoConnector) probeLoop() {
+	ticker := time.NewTicker(c.probeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closec:
+			return
+		case <-ticker.C:
+		}
+		if err := c.h3.probe(context.Background()); err != nil {
+			c.logger.Debug("HTTP/3 probe failed", zap.Error(err))
+			continue
+		}
+		c.failures.Store(0)
+		c.fallback.Store(false)
+		c.logger.Info("HTTP/3 works again, switch back to it")
+		return
+	}
+}
+
+func (c *caddyAutoConnector) Close() error {
+	c.closeOnce.Do(func() { close(c.closec) })
+	multierr := &errorsext.MultiErr{}
+	multierr.Append(c.h3.Close())
+	multierr.Append(c.h2.Close())
+	return multierr.Err()
+}
+
+func (c *caddyAutoConnector) dumpHTTP3Pools() []http3PoolInfo {
+	return c.h3.dumpHTTP3Pools()
+}
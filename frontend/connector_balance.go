@@ -0,0 +1,217 @@
+package frontend
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	errorsext "github.com/damnever/libext-go/errors"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+
+	"github.com/damnever/goodog/internal/pkg/metrics"
+	"github.com/damnever/goodog/internal/pkg/protocol"
+)
+
+// Balancing policies of the servers.
+const (
+	balanceRoundRobin    = "round-robin"
+	balanceLeastStreams  = "least-streams"
+	balanceLowestLatency = "lowest-latency"
+)
+
+// streamCounter is a Connector which knows how many streams are active.
+type streamCounter interface {
+	activeStreams() int
+}
+
+// balancedConnector spreads the streams over multiple servers by the policy. A server
+// is marked unhealthy for a while after a few consecutive connect failures, the
+// unhealthy servers are tried only if the healthy ones fail. The connect is retried
+// on the other servers before giving up.
+type balancedConnector struct {
+	policy  string
+	servers []*balancedServer
+	logger  *zap.Logger
+
+	maxFailures uint32
+	cooldown    time.Duration
+	next        atomic.Uint32
+	closed      atomic.Bool
+
+	failovers *metrics.Counter
+	unhealthy *metrics.Gauge
+}
+
+func newBalancedConnector(network string, policy string, connectors []Connector, hosts []string, logger *zap.Logger) *balancedConnector {
+	servers := make([]*balancedServer, 0, len(connectors))
+	for i, connector := range connectors {
+		servers = append(servers, &balancedServer{host: hosts[i], connector: connector})
+	}
+	return &balancedConnector{
+		policy:  policy,
+		servers: servers,
+		logger:  logger.Named(network),
+		// FIXME(damnever): magic numbers
+		maxFailures: 3,
+		cooldown:    30 * time.Second,
+
+		failovers: newCounter(network+".servers.failovers", "The connects which fail over to the other servers."),
+		unhealthy: newGauge(network+".servers.unhealthy", "The servers which are marked unhealthy."),
+	}
+}
+
+func (c *balancedConnector) Connect(ctx context.Context, dst *protocol.Addr) (io.ReadWriteCloser, error) {
+	var err error
+	for i, server := range c.pick() {
+		if i > 0 {
+			c.failovers.Inc()
+			c.logger.Debug("connect failed, try the next server",
+				zap.String("server", server.host), zap.Error(err))
+		}
+		start := time.Now()
+		var rwc io.ReadWriteCloser
+		if rwc, err = server.connector.Connect(ctx, dst); err == nil {
+			c.succeed(server, time.Since(start))
+			return server.track(rwc), nil
+		}
+		// The server is reachable if it responds with a status.
+		if reachable(err) || ctx.Err() != nil {
+			return nil, err
+		}
+		c.fail(server, err)
+	}
+	return nil, err
+}
+
+// pick orders the servers by the policy, the unhealthy ones go last.
+func (c *balancedConnector) pick() []*balancedServer {
+	n := len(c.servers)
+	start := int(c.next.Inc() % uint32(n))
+	now := time.Now()
+	healthy := make([]*balancedServer, 0, n)
+	unhealthy := []*balancedServer{}
+	for i := 0; i < n; i++ {
+		server := c.servers[(start+i)%n]
+		if server.healthy(now) {
+			healthy = append(healthy, server)
+		} else {
+			unhealthy = append(unhealthy, server)
+		}
+	}
+
+	// The rotation above breaks the ties.
+	switch c.policy {
+	case balanceLeastStreams:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].activeStreams() < healthy[j].activeStreams()
+		})
+	case balanceLowestLatency:
+		sort.SliceStable(healthy, func(i, j int) bool { // The unmeasured ones go first.
+			return healthy[i].latency.Load() < healthy[j].latency.Load()
+		})
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (c *balancedConnector) succeed(server *balancedServer, latency time.Duration) {
+	server.failures.Store(0)
+	if old := server.latency.Load(); old == 0 {
+		server.latency.Store(int64(latency))
+	} else { // EWMA
+		server.latency.Store(old - old/8 + int64(latency)/8)
+	}
+	if server.down.CAS(true, false) {
+		c.unhealthy.Dec()
+		c.logger.Info("server is healthy again", zap.String("server", server.host))
+	}
+}
+
+func (c *balancedConnector) fail(server *balancedServer, err error) {
+	if failures := server.failures.Inc(); failures < c.maxFailures {
+		return
+	}
+	server.downUntil.Store(time.Now().Add(c.cooldown).UnixNano())
+	if server.down.CAS(false, true) {
+		c.unhealthy.Inc()
+		if c.closed.Load() { // Close may have missed it.
+			c.unmark(server)
+			return
+		}
+		c.logger.Warn("server keeps failing, mark it unhealthy",
+			zap.String("server", server.host),
+			zap.Uint32("failures", server.failures.Load()),
+			zap.Duration("cooldown", c.cooldown),
+			zap.Error(err),
+		)
+	}
+}
+
+// unmark takes back the unhealthy mark of the server from the gauge, the gauge is
+// shared by the other generations after a reload.
+func (c *balancedConnector) unmark(server *balancedServer) {
+	if server.down.CAS(true, false) {
+		c.unhealthy.Dec()
+	}
+}
+
+func (c *balancedConnector) Close() error {
+	c.closed.Store(true)
+	multierr := &errorsext.MultiErr{}
+	for _, server := range c.servers {
+		c.unmark(server)
+		multierr.Append(server.connector.Close())
+	}
+	return multierr.Err()
+}
+
+func (c *balancedConnector) dumpHTTP3Pools() []http3PoolInfo {
+	pools := []http3PoolInfo{}
+	for _, server := range c.servers {
+		if dumper, ok := server.connector.(http3PoolDumper); ok {
+			pools = append(pools, dumper.dumpHTTP3Pools()...)
+		}
+	}
+	return pools
+}
+
+type balancedServer struct {
+	host      string
+	connector Connector
+
+	streams   atomic.Int32
+	latency   atomic.Int64 // The EWMA of the connect latency.
+	failures  atomic.Uint32
+	down      atomic.Bool
+	downUntil atomic.Int64 // In Unix nanoseconds.
+}
+
+// healthy tells if the server is healthy, or it is cooled down and deserves another try.
+func (s *balancedServer) healthy(now time.Time) bool {
+	return !s.down.Load() || now.UnixNano() >= s.downUntil.Load()
+}
+
+func (s *balancedServer) activeStreams() int {
+	if sc, ok := s.connector.(streamCounter); ok {
+		return sc.activeStreams()
+	}
+	return int(s.streams.Load())
+}
+
+func (s *balancedServer) track(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	s.streams.Inc()
+	return &trackedStream{ReadWriteCloser: rwc, onClose: func() { s.streams.Dec() }}
+}
+
+type trackedStream struct {
+	io.ReadWriteCloser
+	once    sync.Once
+	onClose func()
+}
+
+func (s *trackedStream) Close() error {
+	s.once.Do(s.onClose)
+	return s.ReadWriteCloser.Close()
+}
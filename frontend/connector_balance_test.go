@@ -0,0 +1,49 @@
+package frontend
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/damnever/goodog/internal/pkg/protocol"
+)
+
+type failingConnector struct{}
+
+func (failingConnector) Connect(context.Context, *protocol.Addr) (io.ReadWriteCloser, error) {
+	return nil, &connectError{kind: connectErrTimeout, err: errors.New("timeout")}
+}
+
+func (failingConnector) Close() error {
+	return nil
+}
+
+func TestBalancedConnectorUnhealthyGauge(t *testing.T) {
+	newConnector := func() *balancedConnector {
+		return newBalancedConnector("test-unhealthy", balanceRoundRobin,
+			[]Connector{failingConnector{}, failingConnector{}}, []string{"a", "b"}, zap.NewNop())
+	}
+	old, current := newConnector(), newConnector() // The generations share the gauge.
+	for i := 0; i < 3; i++ {
+		_, err := old.Connect(context.Background(), nil)
+		require.NotNil(t, err)
+	}
+	require.Equal(t, int64(2), old.unhealthy.Load())
+	for i := 0; i < 3; i++ {
+		_, err := current.Connect(context.Background(), nil)
+		require.NotNil(t, err)
+	}
+	require.Equal(t, int64(4), current.unhealthy.Load())
+
+	require.Nil(t, old.Close())
+	require.Equal(t, int64(2), current.unhealthy.Load())
+	_, err := old.Connect(context.Background(), nil) // Too late to mark them again.
+	require.NotNil(t, err)
+	require.Equal(t, int64(2), current.unhealthy.Load())
+	require.Nil(t, current.Close())
+	require.Zero(t, current.unhealthy.Load())
+}
@@ -0,0 +1,275 @@
+package frontend
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	errorsext "github.com/damnever/libext-go/errors"
+	"github.com/hashicorp/yamux"
+	"go.uber.org/zap"
+
+	"github.com/damnever/goodog/internal/pkg/metrics"
+	"github.com/damnever/goodog/internal/pkg/protocol"
+)
+
+var errMuxConnectorClosed = errors.New("goodog/frontend: mux connector closed")
+
+// muxConnector multiplexes the TCP streams over a few long-lived streams of the
+// connector(protocol.MuxYamux), so that the bursts of short connections skip the
+// HTTP request round trip. A session takes at most maxStreams sub-streams.
+type muxConnector struct {
+	connector      streamConnector
+	urls           connectURLs // With the mux query.
+	connectTimeout time.Duration
+	maxStreams     int
+	logger         *zap.Logger
+
+	ctx    context.Context // The sessions live as long as the connector does.
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	closed   bool
+	sessions map[string][]*muxSession   // By the URL.
+	pendings map[string]*pendingSession // The sessions being created, by the URL.
+
+	sessionsCounter *metrics.Gauge
+}
+
+func newMuxConnector(connector streamConnector, urls connectURLs, connectTimeout time.Duration, logger *zap.Logger) *muxConnector {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &muxConnector{
+		connector:      connector,
+		urls:           urls,
+		connectTimeout: connectTimeout,
+		// FIXME(damnever): magic number
+		maxStreams: 128,
+		logger:     logger.Named("mux"),
+		ctx:        ctx,
+		cancel:     cancel,
+		sessions:   map[string][]*muxSession{},
+		pendings:   map[string]*pendingSession{},
+
+		sessionsCounter: newGauge("tcp.mux.sessions", "The active mux sessions."),
+	}
+}
+
+func (c *muxConnector) dumpHTTP3Pools() []http3PoolInfo {
+	if dumper, ok := c.connector.(http3PoolDumper); ok {
+		return dumper.dumpHTTP3Pools()
+	}
+	return nil
+}
+
+// Connect opens a sub-stream. The backend responds with a status in every
+// sub-stream, it is waited if the dst is not nil, since the caller may reply
+// it to the client, otherwise it is checked by the first read.
+func (c *muxConnector) Connect(ctx context.Context, dst *protocol.Addr) (io.ReadWriteCloser, error) {
+	uri, preamble, err := c.urls.resolve(dst)
+	if err != nil {
+		return nil, err
+	}
+	session, err := c.getSession(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.OpenStream()
+	c.unreserve(session)
+	if err != nil {
+		return nil, classifyConnectError(err)
+	}
+	if len(preamble) == 0 {
+		return &lazyStatusStream{Stream: stream}, nil
+	}
+
+	if _, err := stream.Write(preamble); err != nil {
+		stream.Close()
+		return nil, classifyConnectError(err)
+	}
+	_ = stream.SetReadDeadline(time.Now().Add(c.connectTimeout))
+	status, err := protocol.ReadStatus(stream)
+	_ = stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		stream.Close()
+		if err == yamux.ErrTimeout {
+			return nil, &connectError{kind: connectErrTimeout, err: err}
+		}
+		return nil, classifyConnectError(err)
+	}
+	if status != http.StatusOK {
+		stream.Close()
+		return nil, newStatusError(int(status))
+	}
+	return stream, nil
+}
+
+func (c *muxConnector) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	multierr := &errorsext.MultiErr{}
+	for uri, sessions := range c.sessions {
+		for _, session := range sessions {
+			multierr.Append(session.Close())
+			c.sessionsCounter.Dec()
+		}
+		delete(c.sessions, uri)
+	}
+	c.mu.Unlock()
+	c.cancel()
+	multierr.Append(c.connector.Close())
+	return multierr.Err()
+}
+
+// muxSession is a session with the sub-streams which are reserved under c.mu but not
+// opened yet, so that it is neither overused nor closed as an idle one meanwhile.
+// A sub-stream is counted twice until it is unreserved, which is harmless.
+type muxSession struct {
+	*yamux.Session
+	reserved int
+}
+
+func (s *muxSession) load() int {
+	return s.NumStreams() + s.reserved
+}
+
+// pendingSession is a session being created, done is closed once it is created or failed.
+type pendingSession struct {
+	done chan struct{}
+	err  error
+}
+
+// getSession reserves a sub-stream in the session with the fewest sub-streams, a new
+// session is created if all of them are full. The redundant idle sessions are closed.
+// The caller must unreserve it once the sub-stream is opened or failed.
+func (c *muxConnector) getSession(ctx context.Context, uri string) (*muxSession, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return nil, errMuxConnectorClosed
+		}
+		if best := c.pickSessionLocked(uri); best != nil {
+			best.reserved++
+			c.mu.Unlock()
+			return best, nil
+		}
+		pending, ok := c.pendings[uri]
+		if !ok {
+			if err := ctx.Err(); err != nil {
+				c.mu.Unlock()
+				return nil, err
+			}
+			pending = &pendingSession{done: make(chan struct{})}
+			c.pendings[uri] = pending
+		}
+		c.mu.Unlock()
+
+		if !ok {
+			return c.createSession(uri, pending)
+		}
+		// NOTE(damnever): other callers of the same URL wait for the session being
+		// created, they are going to use it anyway, the other URLs are not blocked.
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-pending.done:
+		}
+		if pending.err != nil {
+			return nil, pending.err
+		}
+	}
+}
+
+// pickSessionLocked returns the session with the fewest sub-streams, nil if all of
+// them are full, c.mu must be held.
+func (c *muxConnector) pickSessionLocked(uri string) *muxSession {
+	var (
+		best     *muxSession
+		idle     *muxSession
+		sessions = c.sessions[uri][:0]
+	)
+	for _, session := range c.sessions[uri] {
+		if session.IsClosed() {
+			c.sessionsCounter.Dec()
+			continue
+		}
+		n := session.load()
+		if n == 0 {
+			if idle != nil {
+				session.Close()
+				c.sessionsCounter.Dec()
+				continue
+			}
+			idle = session
+		}
+		sessions = append(sessions, session)
+		if n < c.maxStreams && (best == nil || n < best.load()) {
+			best = session
+		}
+	}
+	c.sessions[uri] = sessions
+	return best
+}
+
+// createSession dials a new session without holding c.mu and wakes up the callers
+// waiting for the pending one.
+func (c *muxConnector) createSession(uri string, pending *pendingSession) (session *muxSession, err error) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.pendings, uri)
+		if err == nil && c.closed {
+			session.Close()
+			session, err = nil, errMuxConnectorClosed
+		}
+		if err == nil {
+			session.reserved++
+			c.sessions[uri] = append(c.sessions[uri], session)
+			c.sessionsCounter.Inc()
+			c.logger.Debug("session created", zap.Int("sessions", len(c.sessions[uri])))
+		}
+		c.mu.Unlock()
+		pending.err = err
+		close(pending.done)
+	}()
+
+	stream, err := c.connector.openStream(c.ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	ysession, err := yamux.Client(stream, protocol.NewYamuxConfig())
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return &muxSession{Session: ysession}, nil
+}
+
+func (c *muxConnector) unreserve(session *muxSession) {
+	c.mu.Lock()
+	session.reserved--
+	c.mu.Unlock()
+}
+
+// lazyStatusStream checks the status before the first read.
+type lazyStatusStream struct {
+	*yamux.Stream
+	once sync.Once
+	err  error
+}
+
+func (s *lazyStatusStream) Read(p []byte) (int, error) {
+	s.once.Do(func() {
+		status, err := protocol.ReadStatus(s.Stream)
+		if err == nil && status != http.StatusOK {
+			err = newStatusError(int(status))
+		}
+		s.err = err
+	})
+	if s.err != nil {
+		return 0, s.err
+	}
+	return s.Stream.Read(p)
+}
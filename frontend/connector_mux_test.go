@@ -0,0 +1,154 @@
+package frontend
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/damnever/goodog/internal/pkg/protocol"
+)
+
+// pipeStreamConnector opens the streams over net.Pipe, the other ends are served
+// by the yamux servers which reply the status and echo the sub-streams.
+type pipeStreamConnector struct{}
+
+func (c *pipeStreamConnector) Connect(context.Context, *protocol.Addr) (io.ReadWriteCloser, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *pipeStreamConnector) Close() error {
+	return nil
+}
+
+func (c *pipeStreamConnector) openStream(ctx context.Context, uri string) (io.ReadWriteCloser, error) {
+	local, remote := net.Pipe()
+	session, err := yamux.Server(remote, protocol.NewYamuxConfig())
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			stream, err := session.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				if err := protocol.WriteStatus(stream, http.StatusOK); err == nil {
+					_, _ = io.Copy(stream, stream)
+				}
+			}()
+		}
+	}()
+	return local, nil
+}
+
+func TestMuxConnectorBurst(t *testing.T) {
+	const (
+		maxStreams = 4
+		n          = 100
+	)
+	connector := newMuxConnector(&pipeStreamConnector{}, connectURLs{v1: "v1", v2: "v2"}, time.Second, zap.NewNop())
+	connector.maxStreams = maxStreams
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		streams []io.ReadWriteCloser
+		errs    = make(chan error, n)
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := connector.Connect(context.Background(), nil)
+			if err == nil {
+				_, err = stream.Write([]byte{'x'})
+			}
+			if err == nil {
+				_, err = io.ReadFull(stream, make([]byte, 1))
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+			mu.Lock()
+			streams = append(streams, stream)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.Nil(t, err)
+	}
+	require.Len(t, streams, n)
+
+	connector.mu.Lock()
+	total := 0
+	for _, session := range connector.sessions["v1"] {
+		require.False(t, session.IsClosed()) // None of them is closed as an idle one.
+		require.True(t, session.NumStreams() <= maxStreams)
+		require.Zero(t, session.reserved)
+		total += session.NumStreams()
+	}
+	connector.mu.Unlock()
+	require.Equal(t, n, total)
+
+	for _, stream := range streams {
+		require.Nil(t, stream.Close())
+	}
+	require.Eventually(t, func() bool {
+		connector.mu.Lock()
+		defer connector.mu.Unlock()
+		for _, session := range connector.sessions["v1"] {
+			if session.NumStreams() != 0 {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 10*time.Millisecond)
+	stream, err := connector.Connect(context.Background(), nil)
+	require.Nil(t, err)
+	connector.mu.Lock()
+	require.Len(t, connector.sessions["v1"], 1) // The redundant idle sessions are closed.
+	connector.mu.Unlock()
+	require.Nil(t, stream.Close())
+
+	require.Nil(t, connector.Close())
+	_, err = connector.Connect(context.Background(), nil)
+	require.Equal(t, errMuxConnectorClosed, err)
+}
+
+func TestMuxConnectorConnectWhileClosing(t *testing.T) {
+	connector := newMuxConnector(&pipeStreamConnector{}, connectURLs{v1: "v1", v2: "v2"}, time.Second, zap.NewNop())
+	connector.maxStreams = 2
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := connector.Connect(context.Background(), nil)
+			if err == nil {
+				stream.Close()
+			}
+		}()
+	}
+	require.Nil(t, connector.Close())
+	wg.Wait()
+
+	connector.mu.Lock()
+	defer connector.mu.Unlock()
+	require.Empty(t, connector.sessions)
+	require.Empty(t, connector.pendings)
+}
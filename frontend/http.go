@@ -0,0 +1,172 @@
+package frontend
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	netext "github.com/damnever/libext-go/net"
+	"go.uber.org/zap"
+
+	"github.com/damnever/goodog/internal/pkg/protocol"
+)
+
+// httpProxy is a HTTP/1.1 proxy, it tunnels the CONNECT requests and forwards
+// the requests in absolute-URI form, the destinations are dialed by the backend.
+type httpProxy struct {
+	logger *zap.Logger
+	relays relays
+	server *netext.Server
+}
+
+func newHTTPProxy(listenAddr string, relays relays, logger *zap.Logger) (*httpProxy, error) {
+	p := &httpProxy{
+		logger: logger.Named("http"),
+		relays: relays,
+	}
+	server, err := netext.NewTCPServer(listenAddr, p.handle)
+	if err != nil {
+		return nil, err
+	}
+	p.server = server
+	return p, nil
+}
+
+func (p *httpProxy) Serve(ctx context.Context) error {
+	return p.server.Serve(netext.WithContext(ctx))
+}
+
+func (p *httpProxy) Close() error {
+	return p.server.Close()
+}
+
+func (p *httpProxy) handle(ctx context.Context, conn net.Conn) {
+	tcprelay := p.relays.tcp()
+	_ = conn.SetReadDeadline(time.Now().Add(tcprelay.conf.ConnectTimeout))
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		conn.Close()
+		p.logger.Debug("read request failed",
+			zap.String("downstream", conn.RemoteAddr().String()),
+			zap.Error(err),
+		)
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	if req.Method == http.MethodConnect {
+		dst, err := protocol.ParseAddr("tcp", req.RequestURI)
+		if err != nil {
+			p.fail(conn, http.StatusBadRequest, err)
+			return
+		}
+		// The client may send data before the response arrives.
+		downstream := &readerConn{Conn: conn, r: br}
+		tcprelay.relay(ctx, downstream, dst, func(err error) error {
+			if err != nil {
+				return p.writeStatus(conn, httpStatusOf(err))
+			}
+			_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			return err
+		})
+		return
+	}
+
+	if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+		p.fail(conn, http.StatusBadRequest, fmt.Errorf("not a proxy request: %s", req.RequestURI))
+		return
+	}
+	hostport := req.URL.Host
+	if req.URL.Port() == "" {
+		hostport = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	dst, err := protocol.ParseAddr("tcp", hostport)
+	if err != nil {
+		p.fail(conn, http.StatusBadRequest, err)
+		return
+	}
+	removeProxyHeaders(req.Header)
+	// One request per connection, the destination may be changed by the next one.
+	req.Close = true
+
+	pr, pw := io.Pipe()
+	go func() { _ = pw.CloseWithError(req.Write(pw)) }() // In origin-form.
+	downstream := &readerConn{Conn: conn, r: io.MultiReader(pr, br)}
+	tcprelay.relay(ctx, downstream, dst, func(err error) error {
+		if err != nil {
+			pr.Close()
+			return p.writeStatus(conn, httpStatusOf(err))
+		}
+		return nil
+	})
+}
+
+func (p *httpProxy) fail(conn net.Conn, status int, err error) {
+	_ = p.writeStatus(conn, status)
+	conn.Close()
+	p.logger.Debug("bad request",
+		zap.String("downstream", conn.RemoteAddr().String()),
+		zap.Error(err),
+	)
+}
+
+func (p *httpProxy) writeStatus(conn net.Conn, status int) error {
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n",
+		status, http.StatusText(status))
+	return err
+}
+
+func httpStatusOf(err error) int {
+	switch connectErrorKind(err) {
+	case connectErrTimeout:
+		return http.StatusGatewayTimeout
+	case connectErrForbidden:
+		return http.StatusForbidden
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// Ref: https://tools.ietf.org/html/rfc7230#section-6.1
+var _hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeProxyHeaders removes the hop-by-hop headers, the ones listed in the
+// Connection header included.
+func removeProxyHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range _hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// readerConn reads from the r instead of the net.Conn.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,22 @@
+package frontend
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoveProxyHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Add("Connection", "keep-alive, X-Hop")
+	header.Add("Connection", " x-other ,")
+	header.Set("X-Hop", "1")
+	header.Set("X-Other", "2")
+	header.Set("Proxy-Authorization", "Basic a25vY2s6a25vY2s=")
+	header.Set("Keep-Alive", "timeout=5")
+	header.Set("X-End-To-End", "3")
+
+	removeProxyHeaders(header)
+	require.Equal(t, http.Header{"X-End-To-End": {"3"}}, header)
+}
@@ -3,16 +3,26 @@ package frontend
 import (
 	"expvar"
 	"fmt"
-	"strconv"
+	"net/http"
 	"strings"
 	"sync"
 
-	"go.uber.org/atomic"
+	"github.com/damnever/goodog/internal/pkg/metrics"
+	"github.com/damnever/goodog/internal/pkg/traffic"
 )
 
 var (
 	_metricMu = sync.Mutex{}
 	_metric   = metricMap{}
+	_registry = metrics.NewRegistry("goodog_frontend")
+)
+
+// FIXME(damnever): magic numbers
+var (
+	_latencyBuckets  = metrics.ExponentialBuckets(0.005, 2, 12) // 5ms ~ 10s
+	_durationBuckets = metrics.ExponentialBuckets(0.1, 4, 10)   // 100ms ~ 7h
+	_bytesBuckets    = metrics.ExponentialBuckets(256, 4, 12)   // 256B ~ 1GB
+	_ratioBuckets    = metrics.LinearBuckets(0.1, 0.1, 11)      // 10% ~ 110%
 )
 
 func init() {
@@ -36,15 +46,55 @@ func (m metricMap) String() string {
 	return b.String()
 }
 
-type counter struct {
-	atomic.Uint32
+// newCounter registers the counter by the dotted name in expvar, and by the name
+// which joins the parts by underscores in Prometheus. The "{label}" parts of the
+// name are replaced by the labelValues in expvar, they are the labels in Prometheus,
+// e.g. "probes.{server}.failures" is "probes.a_com.failures" in expvar and
+// goodog_frontend_probes_failures_total{server="a.com"} in Prometheus.
+func newCounter(name, help string, labelValues ...string) *metrics.Counter {
+	path, promName, labels := metricNames(name, labelValues)
+	c := _registry.Counter(promName, help, labels...)
+	register(path, c)
+	return c
+}
+
+func newGauge(name, help string, labelValues ...string) *metrics.Gauge {
+	path, promName, labels := metricNames(name, labelValues)
+	g := _registry.Gauge(promName, help, labels...)
+	register(path, g)
+	return g
+}
+
+func newHistogram(name, help string, buckets []float64, labelValues ...string) *metrics.Histogram {
+	path, promName, labels := metricNames(name, labelValues)
+	h := _registry.Histogram(promName, help, buckets, labels...)
+	register(path, h)
+	return h
+}
+
+func metricNames(name string, labelValues []string) (path, promName string, labels []string) {
+	parts := strings.Split(name, ".")
+	paths := make([]string, 0, len(parts))
+	promNames := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			value := labelValues[len(labels)/2]
+			labels = append(labels, part[1:len(part)-1], value)
+			paths = append(paths, metricName(value))
+			continue
+		}
+		paths = append(paths, part)
+		promNames = append(promNames, strings.ReplaceAll(part, "-", "_"))
+	}
+	return strings.Join(paths, "."), strings.Join(promNames, "_"), labels
 }
 
-func (c *counter) String() string {
-	return strconv.Itoa(int(c.Load()))
+// MetricsHandler serves the metrics of the frontend in the Prometheus text format.
+func MetricsHandler() http.Handler {
+	return _registry
 }
 
-func newCounter(name string) *counter {
+func register(name string, v expvar.Var) {
 	parts := strings.Split(name, ".")
 	n := len(parts)
 
@@ -59,8 +109,64 @@ func newCounter(name string) *counter {
 		}
 		next = m
 	}
+	next[parts[n-1]] = v
+}
 
-	c := &counter{}
-	next[parts[n-1]] = c
-	return c
+// metricName sanitizes the name(e.g. a host) since the dots split the metric names.
+func metricName(name string) string {
+	return strings.NewReplacer(".", "_", ":", "_").Replace(name)
+}
+
+type connectErrorCounters struct {
+	timeout   *metrics.Counter
+	tls       *metrics.Counter
+	status    *metrics.Counter
+	forbidden *metrics.Counter
+	negotiate *metrics.Counter
+	other     *metrics.Counter
+}
+
+// newConnectErrorCounters registers the counters by the kinds of the errors.
+func newConnectErrorCounters(prefix string) *connectErrorCounters {
+	name := prefix + ".{kind}"
+	help := "The connect errors by the kinds."
+	return &connectErrorCounters{
+		timeout:   newCounter(name, help, connectErrTimeout),
+		tls:       newCounter(name, help, connectErrTLS),
+		status:    newCounter(name, help, connectErrStatus),
+		forbidden: newCounter(name, help, connectErrForbidden),
+		negotiate: newCounter(name, help, connectErrNegotiate),
+		other:     newCounter(name, help, connectErrOther),
+	}
+}
+
+func (c *connectErrorCounters) Inc(err error) {
+	switch connectErrorKind(err) {
+	case connectErrTimeout:
+		c.timeout.Inc()
+	case connectErrTLS:
+		c.tls.Inc()
+	case connectErrStatus:
+		c.status.Inc()
+	case connectErrForbidden:
+		c.forbidden.Inc()
+	case connectErrNegotiate:
+		c.negotiate.Inc()
+	default:
+		c.other.Inc()
+	}
+}
+
+// newTrafficCounters registers the traffic counters of the protocol.
+func newTrafficCounters(protocol string) *traffic.Counters {
+	bytesHelp := "The bytes of the sessions by the protocols and the directions."
+	packetsHelp := "The packets of the sessions by the protocols and the directions."
+	return &traffic.Counters{
+		Sessions:    newCounter("traffic.{protocol}.sessions", "The sessions by the protocols.", protocol),
+		Active:      newGauge("traffic.{protocol}.active", "The active sessions by the protocols.", protocol),
+		BytesUp:     newCounter("traffic.{protocol}.bytes.{direction}", bytesHelp, protocol, traffic.Up.String()),
+		BytesDown:   newCounter("traffic.{protocol}.bytes.{direction}", bytesHelp, protocol, traffic.Down.String()),
+		PacketsUp:   newCounter("traffic.{protocol}.packets.{direction}", packetsHelp, protocol, traffic.Up.String()),
+		PacketsDown: newCounter("traffic.{protocol}.packets.{direction}", packetsHelp, protocol, traffic.Down.String()),
+	}
 }
@@ -0,0 +1,244 @@
+package frontend
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+
+	"github.com/damnever/goodog/internal/pkg/metrics"
+	"github.com/damnever/goodog/internal/pkg/protocol"
+)
+
+// prober checks the servers periodically with protocol=ping, every probe uses a new
+// connection so that the handshake is measured as well, then the RTT is measured by
+// another request on the same connection.
+//
+// NOTE(damnever): the results are for the observation only, they are independent of
+// the balancedConnector: the lowest-latency policy uses the EWMA of the connect
+// latency of the real streams, and the servers are marked unhealthy by the connect
+// failures rather than the failed probes.
+type prober struct {
+	targets  []*probeTarget
+	interval time.Duration
+	logger   *zap.Logger
+}
+
+func newProber(conf Config, logger *zap.Logger) *prober {
+	p := &prober{interval: conf.ProbeInterval, logger: logger.Named("probe")}
+	for _, server := range conf.servers() {
+		host := server.serverURL.Host
+		p.targets = append(p.targets, &probeTarget{
+			host:               host,
+			uri:                server.makeURI("ping", protocol.V1, ""),
+			http2:              conf.Connector == "caddy-http2",
+			insecureSkipVerify: conf.InsecureSkipVerify,
+			timeout:            conf.ConnectTimeout,
+			quicConfig:         conf.quicConfig(),
+
+			rttMillis:       newGauge("probes.{server}.rtt-ms", "The RTT of the last probe.", host),
+			handshakeMillis: newGauge("probes.{server}.handshake-ms", "The handshake time of the last probe.", host),
+			successes:       newCounter("probes.{server}.successes", "The successful probes.", host),
+			failures:        newCounter("probes.{server}.failures", "The failed probes.", host),
+		})
+	}
+	return p
+}
+
+func (p *prober) loop(ctx context.Context) {
+	p.probe(ctx)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.probe(ctx)
+		}
+	}
+}
+
+func (p *prober) probe(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for _, target := range p.targets {
+		wg.Add(1)
+		go func(target *probeTarget) {
+			defer wg.Done()
+			if err := target.probe(ctx); err != nil {
+				p.logger.Warn("probe failed", zap.String("server", target.host), zap.Error(err))
+			}
+		}(target)
+	}
+	wg.Wait()
+}
+
+// ServeHTTP responds with the latest results in JSON.
+func (p *prober) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	results := make([]probeResult, 0, len(p.targets))
+	for _, target := range p.targets {
+		results = append(results, target.result())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(results)
+}
+
+type probeResult struct {
+	Server      string    `json:"server"`
+	Healthy     bool      `json:"healthy"`
+	RTT         string    `json:"rtt"`
+	Handshake   string    `json:"handshake"`
+	SuccessRate float64   `json:"success_rate"` // Of the recent probes.
+	LastError   string    `json:"last_error,omitempty"`
+	Features    string    `json:"features,omitempty"` // See protocol.HeaderFeatures.
+	ProbedAt    time.Time `json:"probed_at"`
+}
+
+type probeTarget struct {
+	host               string
+	uri                string
+	http2              bool
+	insecureSkipVerify bool
+	timeout            time.Duration
+	quicConfig         *quic.Config
+
+	mu        sync.Mutex
+	rtt       time.Duration
+	handshake time.Duration
+	recent    []bool // The recent results, at most probeWindow.
+	lastErr   error
+	probedAt  time.Time
+	features  string
+
+	rttMillis       *metrics.Gauge
+	handshakeMillis *metrics.Gauge
+	successes       *metrics.Counter
+	failures        *metrics.Counter
+}
+
+// FIXME(damnever): magic number
+const probeWindow = 20
+
+func (t *probeTarget) probe(ctx context.Context) error {
+	rtt, handshake, features, err := t.ping(ctx)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.probedAt = time.Now()
+	t.lastErr = err
+	t.recent = append(t.recent, err == nil)
+	if len(t.recent) > probeWindow {
+		t.recent = t.recent[1:]
+	}
+	if err != nil {
+		t.failures.Inc()
+		return err
+	}
+	t.successes.Inc()
+	t.rtt, t.handshake, t.features = rtt, handshake, features
+	t.rttMillis.Set(rtt.Milliseconds())
+	t.handshakeMillis.Set(handshake.Milliseconds())
+	return nil
+}
+
+func (t *probeTarget) result() probeResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	successes := 0
+	for _, ok := range t.recent {
+		if ok {
+			successes++
+		}
+	}
+	r := probeResult{
+		Server:    t.host,
+		Healthy:   len(t.recent) > 0 && t.recent[len(t.recent)-1],
+		RTT:       t.rtt.String(),
+		Handshake: t.handshake.String(),
+		ProbedAt:  t.probedAt,
+		Features:  t.features,
+	}
+	if len(t.recent) > 0 {
+		r.SuccessRate = float64(successes) / float64(len(t.recent))
+	}
+	if t.lastErr != nil {
+		r.LastError = t.lastErr.Error()
+	}
+	return r
+}
+
+// ping sends two requests over a new connection, the first one includes the handshake.
+func (t *probeTarget) ping(ctx context.Context) (rtt time.Duration, handshake time.Duration, features string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: t.insecureSkipVerify}
+	var transport http.RoundTripper
+	if t.http2 {
+		dialer := &net.Dialer{Timeout: t.timeout}
+		h2 := &http2.Transport{
+			TLSClientConfig: tlsConfig,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				start := time.Now()
+				conn, err := tls.DialWithDialer(dialer, network, addr, cfg)
+				handshake = time.Since(start)
+				return conn, err
+			},
+		}
+		defer h2.CloseIdleConnections()
+		transport = h2
+	} else {
+		h3 := &http3.RoundTripper{
+			TLSClientConfig: tlsConfig,
+			QuicConfig:      t.quicConfig,
+			Dial: func(network, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.Session, error) {
+				start := time.Now()
+				session, err := quic.DialAddr(addr, tlsCfg, cfg)
+				handshake = time.Since(start)
+				return session, err
+			},
+		}
+		defer h3.Close()
+		transport = h3
+	}
+
+	client := &http.Client{Transport: transport}
+	if _, err := t.request(ctx, client); err != nil {
+		return 0, 0, "", err
+	}
+	start := time.Now()
+	header, err := t.request(ctx, client)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	return time.Since(start), handshake, header.Get(protocol.HeaderFeatures), nil
+}
+
+func (t *probeTarget) request(ctx context.Context, client *http.Client) (http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "goodog/frontend")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return resp.Header, nil
+}
@@ -3,46 +3,200 @@ package frontend
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	errorsext "github.com/damnever/libext-go/errors"
+	quic "github.com/lucas-clemente/quic-go"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+
+	"github.com/damnever/goodog/internal/pkg/compression"
+	"github.com/damnever/goodog/internal/pkg/protocol"
+)
+
+// The kinds of the listeners.
+const (
+	ListenerRaw      = "raw" // The TCP and UDP, the upstreams are configured in the backend.
+	ListenerSOCKS5   = "socks5"
+	ListenerHTTP     = "http"
+	ListenerRedirect = "redirect"
+	ListenerTProxy   = "tproxy"
 )
 
+type Listener struct {
+	Kind string
+	Addr string
+}
+
 type Config struct {
-	ListenAddr         string
+	Listeners          []Listener // More listeners besides the ones below.
+	ListenAddr         string     // The raw TCP and UDP listeners, the upstreams are configured in the backend.
+	SOCKS5ListenAddr   string
+	HTTPListenAddr     string // The HTTP proxy(CONNECT and absolute-URI).
+	RedirectListenAddr string // The TCP connections redirected by iptables/nftables REDIRECT, Linux only.
+	TProxyListenAddr   string // The TCP and UDP redirected by iptables/nftables TPROXY, Linux only.
 	ServerURI          string
+	ServerURIs         []string // More servers besides the ServerURI, the streams are balanced by the Balance.
+	Balance            string   // The balancing policy of the servers: [round-robin, least-streams, lowest-latency].
 	Connector          string
+	Mux                string // The mux mode of the TCP streams, disabled if empty.
+	UDPMux             string // The mux mode of the UDP packets, disabled if empty.
+	MASQUETemplate     string // The UDP goes through MASQUE CONNECT-UDP if it is not empty, see masqueTemplate.
 	LogLevel           string
 	InsecureSkipVerify bool // This is for testing purpose.
 	ConnectTimeout     time.Duration
 	Timeout            time.Duration
+	ProbeInterval      time.Duration // How often the servers are probed, disabled if it is zero.
+	WarmConns          int           // The minimum number of the warm QUIC connections per server.
+	MaxConns           int           // The max number of the QUIC connections per server, unlimited if it is zero.
+	MaxStreamsPerConn  int           // The max streams per QUIC connection, exceeded if the MaxConns is reached.
+	ConnIdleTimeout    time.Duration // The QUIC connections without streams are evicted after it.
+
+	// The QUIC transport of HTTP/3, the zeros are the defaults of quic-go unless noted.
+	QUICHandshakeTimeout time.Duration // The ConnectTimeout if it is zero.
+	QUICIdleTimeout      time.Duration // 6 minutes if it is zero.
+	QUICDisableKeepAlive bool
+	QUICStreamWindow     uint64 // The max receive window of a stream in bytes.
+	QUICConnWindow       uint64 // The max receive window of a connection in bytes.
+	// The max bidirectional streams opened by the backend per connection, none if it
+	// is negative. The backend opens none for now, the streams opened by the frontend
+	// are limited by the backend.
+	QUICMaxIncomingStreams int
 
-	Compression string
+	Compression string // The compression method, e.g. snappy, zstd:fastest, lz4 or gzip:6.
+	codec       compression.Codec
 	serverURL   *url.URL
 }
 
 func (conf Config) ServerHost() string {
-	return conf.serverURL.Host
+	if len(conf.ServerURIs) == 0 {
+		return conf.serverURL.Host
+	}
+	hosts := []string{conf.serverURL.Host}
+	for _, server := range conf.servers()[1:] {
+		hosts = append(hosts, server.serverURL.Host)
+	}
+	return strings.Join(hosts, ",")
+}
+
+// listeners returns all the listeners without the duplicates.
+func (conf Config) listeners() []Listener {
+	listeners := []Listener{}
+	seen := map[Listener]bool{}
+	for _, l := range append([]Listener{
+		{Kind: ListenerRaw, Addr: conf.ListenAddr},
+		{Kind: ListenerSOCKS5, Addr: conf.SOCKS5ListenAddr},
+		{Kind: ListenerHTTP, Addr: conf.HTTPListenAddr},
+		{Kind: ListenerRedirect, Addr: conf.RedirectListenAddr},
+		{Kind: ListenerTProxy, Addr: conf.TProxyListenAddr},
+	}, conf.Listeners...) {
+		if l.Addr != "" && !seen[l] {
+			seen[l] = true
+			listeners = append(listeners, l)
+		}
+	}
+	return listeners
 }
 
 func (conf *Config) resolve() error {
+	listeners := conf.listeners()
+	if len(listeners) == 0 {
+		return fmt.Errorf("goodog/frontend: no listen address")
+	}
+	for _, l := range listeners {
+		switch l.Kind {
+		case ListenerRaw, ListenerSOCKS5, ListenerHTTP, ListenerRedirect, ListenerTProxy:
+		default:
+			return fmt.Errorf("goodog/frontend: unknown listener: %s", l.Kind)
+		}
+	}
+	if conf.ServerURI == "" && len(conf.ServerURIs) > 0 {
+		conf.ServerURI, conf.ServerURIs = conf.ServerURIs[0], conf.ServerURIs[1:]
+	}
 	u, err := url.Parse(conf.ServerURI) // Whatever
 	if err != nil {
 		return err
 	}
+	for _, uri := range conf.ServerURIs {
+		if _, err := url.Parse(uri); err != nil {
+			return err
+		}
+	}
+	if conf.Balance == "" {
+		conf.Balance = balanceRoundRobin
+	}
+	if conf.Balance != balanceRoundRobin && conf.Balance != balanceLeastStreams && conf.Balance != balanceLowestLatency {
+		return fmt.Errorf("goodog/frontend: unknown balance policy: %s", conf.Balance)
+	}
 	if conf.Compression == "" {
 		conf.Compression = u.Query().Get("compression")
 	}
+	if conf.codec, err = compression.Lookup(conf.Compression); err != nil {
+		return err
+	}
+	if conf.Mux == "" {
+		conf.Mux = u.Query().Get("mux")
+	}
+	if conf.UDPMux == "" {
+		conf.UDPMux = u.Query().Get("udp-mux")
+	}
+	if conf.ConnectTimeout <= 0 {
+		conf.ConnectTimeout = 10 * time.Second
+	}
+	if conf.MaxStreamsPerConn <= 0 {
+		// FIXME(damnever): magic number
+		// Ref: https://github.com/lucas-clemente/quic-go/wiki/DoS-mitigations
+		conf.MaxStreamsPerConn = 66
+	}
+	if conf.ConnIdleTimeout <= 0 {
+		conf.ConnIdleTimeout = 3 * time.Minute
+	}
+	if conf.QUICHandshakeTimeout <= 0 {
+		conf.QUICHandshakeTimeout = conf.ConnectTimeout
+	}
+	if conf.QUICIdleTimeout <= 0 {
+		conf.QUICIdleTimeout = 6 * time.Minute
+	}
+	if conf.QUICStreamWindow > 0 && conf.QUICConnWindow > 0 && conf.QUICStreamWindow > conf.QUICConnWindow {
+		return fmt.Errorf("goodog/frontend: QUIC stream window(%d) exceeds the connection window(%d)", conf.QUICStreamWindow, conf.QUICConnWindow)
+	}
+	if conf.MaxConns > 0 && conf.WarmConns > conf.MaxConns {
+		return fmt.Errorf("goodog/frontend: warm connections(%d) exceed the max connections(%d)", conf.WarmConns, conf.MaxConns)
+	}
 	conf.serverURL = u
 	return nil
 }
 
-func (conf Config) makeURI(protocol string) string {
+// servers returns the configs of every server, the options in the query of the
+// ServerURI apply to all of them.
+func (conf Config) servers() []Config {
+	servers := []Config{conf}
+	for _, uri := range conf.ServerURIs {
+		server := conf
+		server.ServerURI, server.ServerURIs = uri, nil
+		server.serverURL, _ = url.Parse(uri) // Checked by resolve.
+		servers = append(servers, server)
+	}
+	servers[0].ServerURIs = nil
+	return servers
+}
+
+func (conf Config) makeURI(network string, version string, mux string) string {
 	rawQuery := conf.serverURL.RawQuery
 
 	q := conf.serverURL.Query()
-	q.Add("protocol", protocol)
+	q.Add("protocol", network)
+	q.Set("version", version)
+	if mux != "" {
+		q.Set("mux", mux)
+	} else {
+		q.Del("mux")
+	}
+	q.Del("udp-mux")
 	if conf.Compression != "" {
 		q.Set("compression", conf.Compression)
 	}
@@ -53,74 +207,485 @@ func (conf Config) makeURI(protocol string) string {
 	return uri
 }
 
+func (conf Config) quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeTimeout:                      conf.QUICHandshakeTimeout,
+		IdleTimeout:                           conf.QUICIdleTimeout,
+		KeepAlive:                             !conf.QUICDisableKeepAlive,
+		MaxReceiveStreamFlowControlWindow:     conf.QUICStreamWindow,
+		MaxReceiveConnectionFlowControlWindow: conf.QUICConnWindow,
+		MaxIncomingStreams:                    conf.QUICMaxIncomingStreams,
+	}
+}
+
+// masqueTemplate returns the absolute URI template of MASQUE, the template is
+// relative to the server URI(the credentials included) if it is a path.
+func (conf Config) masqueTemplate() string {
+	if !strings.HasPrefix(conf.MASQUETemplate, "/") {
+		return conf.MASQUETemplate
+	}
+	u := *conf.serverURL
+	u.Path, u.RawPath, u.RawQuery, u.Fragment = "", "", "", ""
+	return u.String() + conf.MASQUETemplate
+}
+
+// newBalancedConnector creates the connectors of all the servers, they are balanced
+// if there are more than one servers.
+func (conf Config) newBalancedConnector(network string, logger *zap.Logger) (Connector, error) {
+	servers := conf.servers()
+	if len(servers) == 1 {
+		return conf.newConnector(network, logger)
+	}
+	connectors := make([]Connector, 0, len(servers))
+	hosts := make([]string, 0, len(servers))
+	for _, server := range servers {
+		connector, err := server.newConnector(network, logger)
+		if err != nil {
+			for _, c := range connectors {
+				c.Close()
+			}
+			return nil, err
+		}
+		connectors = append(connectors, connector)
+		hosts = append(hosts, server.serverURL.Host)
+	}
+	return newBalancedConnector(network, conf.Balance, connectors, hosts, logger), nil
+}
+
+func (conf Config) newConnector(network string, logger *zap.Logger) (Connector, error) {
+	urls := connectURLs{
+		v1: conf.makeURI(network, protocol.V1, ""),
+		v2: conf.makeURI(network, protocol.V2, ""),
+	}
+	pool := http3PoolConfig{
+		warmConns:   conf.WarmConns,
+		maxConns:    conf.MaxConns,
+		maxStreams:  conf.MaxStreamsPerConn,
+		idleTimeout: conf.ConnIdleTimeout,
+	}
+	var connector streamConnector
+	switch conf.Connector {
+	case "caddy-http3":
+		connector = newCaddyHTTP3Connector(urls, conf.InsecureSkipVerify, conf.ConnectTimeout, pool, conf.quicConfig(), network, conf.serverURL.Host, logger.Named(network))
+	case "caddy-http2":
+		connector = newCaddyHTTP2Connector(urls, conf.InsecureSkipVerify, conf.ConnectTimeout)
+	case "caddy-auto":
+		connector = newCaddyAutoConnector(
+			newCaddyHTTP3Connector(urls, conf.InsecureSkipVerify, conf.ConnectTimeout, pool, conf.quicConfig(), network, conf.serverURL.Host, logger.Named(network)),
+			newCaddyHTTP2Connector(urls, conf.InsecureSkipVerify, conf.ConnectTimeout),
+			logger.Named(network),
+		)
+	default:
+		return nil, fmt.Errorf("goodog/frontend: unknown connector: %s", conf.Connector)
+	}
+
+	if network != "tcp" || conf.Mux == "" {
+		return connector, nil
+	}
+	switch conf.Mux {
+	case protocol.MuxYamux:
+		muxURLs := connectURLs{
+			v1: conf.makeURI(network, protocol.V1, conf.Mux),
+			v2: conf.makeURI(network, protocol.V2, conf.Mux),
+		}
+		return newMuxConnector(connector, muxURLs, conf.ConnectTimeout, logger), nil
+	default:
+		connector.Close()
+		return nil, fmt.Errorf("goodog/frontend: unknown mux: %s", conf.Mux)
+	}
+}
+
+func (conf Config) newUDPMux(relay *udpRelay, connector Connector) (*udpMux, error) {
+	if conf.UDPMux != protocol.MuxPacket {
+		return nil, fmt.Errorf("goodog/frontend: unknown UDP mux: %s", conf.UDPMux)
+	}
+	if len(conf.ServerURIs) > 0 {
+		return nil, fmt.Errorf("goodog/frontend: UDP mux does not work with multiple servers")
+	}
+	sc, ok := connector.(streamConnector)
+	if !ok {
+		return nil, fmt.Errorf("goodog/frontend: connector does not support mux: %s", conf.Connector)
+	}
+	urls := connectURLs{
+		v1: conf.makeURI("udp", protocol.V1, conf.UDPMux),
+		v2: conf.makeURI("udp", protocol.V2, conf.UDPMux),
+	}
+	return newUDPMux(relay, sc, urls), nil
+}
+
+type server interface {
+	Serve(context.Context) error
+	Close() error
+}
+
+type namedServer struct {
+	name       string
+	listenAddr string
+	server
+}
+
+// relays returns the relays of the current config, the listeners pick them
+// for every new session.
+type relays interface {
+	tcp() *tcpRelay
+	udp() *udpRelay
+}
+
+// generation is everything built from a config except the listeners, the
+// listeners pick the current one for every new session, the replaced ones are
+// closed once their sessions are done.
+type generation struct {
+	conf         Config
+	tcpconnector Connector
+	udpconnector Connector
+	tcprelay     *tcpRelay
+	udprelay     *udpRelay
+	prober       *prober // Nil if disabled.
+	cancel       context.CancelFunc
+}
+
+// newGeneration builds the generation of the resolved conf, the sessions live as long as the ctx.
+func newGeneration(ctx context.Context, conf Config, sessions *sessionTable) (*generation, error) {
+	setDefaultLogLevel(conf.LogLevel)
+	logger := _DefaultLogger.Named("connector")
+
+	g := &generation{conf: conf, cancel: func() {}}
+	var err error
+	if g.tcpconnector, err = conf.newBalancedConnector("tcp", logger); err != nil {
+		return nil, err
+	}
+	if conf.MASQUETemplate != "" {
+		g.udpconnector = newMASQUEConnector(conf.masqueTemplate(), conf.InsecureSkipVerify, conf.ConnectTimeout)
+	} else if g.udpconnector, err = conf.newBalancedConnector("udp", logger); err != nil {
+		g.tcpconnector.Close()
+		return nil, err
+	}
+	g.tcprelay = newTCPRelay(ctx, conf, g.tcpconnector, sessions, _DefaultLogger)
+	g.udprelay = newUDPRelay(conf, g.udpconnector, sessions, _DefaultLogger)
+	if conf.MASQUETemplate != "" { // The datagrams only.
+		g.udprelay.datagrams = g.udpconnector.(datagramConnector)
+	}
+	if conf.UDPMux != "" {
+		if g.udprelay.mux, err = conf.newUDPMux(g.udprelay, g.udpconnector); err != nil {
+			g.Close()
+			return nil, err
+		}
+	}
+	if conf.ProbeInterval > 0 {
+		g.prober = newProber(conf, _DefaultLogger)
+	}
+	return g, nil
+}
+
+func (g *generation) start(ctx context.Context) {
+	ctx, g.cancel = context.WithCancel(ctx)
+	go g.udprelay.timeoutLoop(ctx)
+	if g.prober != nil {
+		go g.prober.loop(ctx)
+	}
+}
+
+// drained tells if all the sessions are done.
+func (g *generation) drained() bool {
+	return g.tcprelay.active.Load() == 0 && g.udprelay.active.Load() == 0
+}
+
+func (g *generation) Close() error {
+	g.cancel()
+	multierr := &errorsext.MultiErr{}
+	if g.udprelay != nil {
+		multierr.Append(g.udprelay.Close())
+	}
+	multierr.Append(g.tcpconnector.Close())
+	multierr.Append(g.udpconnector.Close())
+	return multierr.Err()
+}
+
+// Proxy serves the listeners of the config, the config can be reloaded without
+// dropping the sessions, see Reload.
 type Proxy struct {
-	conf      Config
-	tcpserver *tcpProxy
-	udpserver *udpProxy
+	ctx      context.Context // The sessions live as long as it.
+	cancel   context.CancelFunc
+	sessions *sessionTable
+	current  atomic.Value // *generation
+
+	mu       sync.Mutex
+	draining map[*generation]struct{}
+	servers  map[Listener][]namedServer
+	removed  map[server]struct{} // The stopped servers are not errors.
+	serveCtx context.Context     // Nil until it is serving.
+	errs     *errorsext.MultiErr
+	wg       sync.WaitGroup
 }
 
 func NewProxy(conf Config) (*Proxy, error) {
 	if err := (&conf).resolve(); err != nil {
 		return nil, err
 	}
-	if conf.Connector != "caddy-http3" {
-		return nil, fmt.Errorf("goodog/frontend: only caddy-http3 supported")
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Proxy{
+		ctx:      ctx,
+		cancel:   cancel,
+		sessions: newSessionTable(),
+		draining: map[*generation]struct{}{},
+		servers:  map[Listener][]namedServer{},
+		removed:  map[server]struct{}{},
+		errs:     &errorsext.MultiErr{},
 	}
-	setDefaultLogLevel(conf.LogLevel)
-
-	tcpconnector := newCaddyHTTP3Connector(conf.makeURI("tcp"), conf.InsecureSkipVerify, conf.Timeout)
-	tcpserver, err := newTCPProxy(conf, tcpconnector, _DefaultLogger)
+	g, err := newGeneration(ctx, conf, p.sessions)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
-	udpconnector := newCaddyHTTP3Connector(conf.makeURI("udp"), conf.InsecureSkipVerify, conf.Timeout)
-	udpserver, err := newUDPProxy(conf, udpconnector, _DefaultLogger)
-	if err != nil {
-		tcpserver.Close()
-		return nil, err
+	p.current.Store(g)
+	for _, l := range conf.listeners() {
+		servers, err := p.newServers(l)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.servers[l] = servers
 	}
+	return p, nil
+}
+
+func (p *Proxy) generation() *generation {
+	return p.current.Load().(*generation)
+}
+
+func (p *Proxy) tcp() *tcpRelay {
+	return p.generation().tcprelay
+}
+
+func (p *Proxy) udp() *udpRelay {
+	return p.generation().udprelay
+}
 
-	return &Proxy{
-		conf:      conf,
-		tcpserver: tcpserver,
-		udpserver: udpserver,
-	}, nil
+func (p *Proxy) newServers(l Listener) ([]namedServer, error) {
+	servers := []namedServer{}
+	closeAll := func() {
+		for _, s := range servers {
+			s.Close()
+		}
+	}
+	switch l.Kind {
+	case ListenerRaw:
+		tcpserver, err := newTCPProxy(l.Addr, p)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, namedServer{name: "TCP", listenAddr: l.Addr, server: tcpserver})
+		udpserver, err := newUDPProxy(l.Addr, p)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		servers = append(servers, namedServer{name: "UDP", listenAddr: l.Addr, server: udpserver})
+	case ListenerSOCKS5:
+		socks5server, err := newSOCKS5Proxy(l.Addr, p, _DefaultLogger)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, namedServer{name: "SOCKS5", listenAddr: l.Addr, server: socks5server})
+	case ListenerHTTP:
+		httpserver, err := newHTTPProxy(l.Addr, p, _DefaultLogger)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, namedServer{name: "HTTP", listenAddr: l.Addr, server: httpserver})
+	case ListenerRedirect:
+		redirectserver, err := newRedirectProxy(l.Addr, p, _DefaultLogger)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, namedServer{name: "REDIRECT", listenAddr: l.Addr, server: redirectserver})
+	case ListenerTProxy:
+		tcpserver, err := newTProxyTCPProxy(l.Addr, p, _DefaultLogger)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, namedServer{name: "TPROXY-TCP", listenAddr: l.Addr, server: tcpserver})
+		udpserver, err := newTProxyUDPProxy(l.Addr, p, _DefaultLogger)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		servers = append(servers, namedServer{name: "TPROXY-UDP", listenAddr: l.Addr, server: udpserver})
+	default: // Checked by resolve.
+		return nil, fmt.Errorf("goodog/frontend: unknown listener: %s", l.Kind)
+	}
+	return servers, nil
 }
 
+// Serve serves until all the listeners are stopped, the sessions are canceled once it returns.
 func (p *Proxy) Serve(ctx context.Context) error {
+	defer p.cancel()
+	p.mu.Lock()
+	if p.serveCtx != nil {
+		p.mu.Unlock()
+		return fmt.Errorf("goodog/frontend: proxy is serving")
+	}
+	p.serveCtx = ctx
+	p.generation().start(ctx)
+	for _, servers := range p.servers {
+		for _, s := range servers {
+			p.serve(s)
+		}
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.errs.Err()
+}
+
+// serve must be called with the p.mu held.
+func (p *Proxy) serve(s namedServer) {
 	logger := _DefaultLogger.Sugar()
-	errc := make(chan error, 2)
+	p.wg.Add(1)
 	go func() {
-		logger.Infof("TCP listen at: %s", p.conf.ListenAddr)
-		err := p.tcpserver.Serve(ctx)
+		defer p.wg.Done()
+		logger.Infof("%s listen at: %s", s.name, s.listenAddr)
+		err := s.Serve(p.serveCtx)
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if _, ok := p.removed[s.server]; ok {
+			delete(p.removed, s.server)
+			logger.Infof("%s server at %s removed", s.name, s.listenAddr)
+			return
+		}
 		if err != nil {
-			logger.Errorf("TCP server stopped with: %v", err)
+			logger.Errorf("%s server stopped with: %v", s.name, err)
 		} else {
-			logger.Errorf("TCP server stopped")
+			logger.Errorf("%s server stopped", s.name)
 		}
-		errc <- err
+		p.errs.Append(err)
 	}()
-	go func() {
-		logger.Infof("UDP listen at: %s", p.conf.ListenAddr)
-		err := p.udpserver.Serve(ctx)
+}
+
+// Reload applies the conf, the new sessions use it, the sessions of the previous
+// config are done as usual. The removed listeners stop accepting, their TCP sessions
+// are not affected, nothing is changed if it fails.
+func (p *Proxy) Reload(conf Config) error {
+	if err := (&conf).resolve(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ctx.Err() != nil {
+		return fmt.Errorf("goodog/frontend: proxy is closed")
+	}
+
+	g, err := newGeneration(p.ctx, conf, p.sessions)
+	if err != nil {
+		setDefaultLogLevel(p.generation().conf.LogLevel)
+		return err
+	}
+	listeners := map[Listener]struct{}{}
+	added := map[Listener][]namedServer{}
+	for _, l := range conf.listeners() {
+		listeners[l] = struct{}{}
+		if _, ok := p.servers[l]; ok {
+			continue
+		}
+		servers, err := p.newServers(l)
 		if err != nil {
-			logger.Errorf("UDP server stopped with: %v", err)
-		} else {
-			logger.Errorf("UDP server stopped")
+			for _, servers := range added {
+				for _, s := range servers {
+					s.Close()
+				}
+			}
+			g.Close()
+			setDefaultLogLevel(p.generation().conf.LogLevel)
+			return err
 		}
-		errc <- err
-	}()
+		added[l] = servers
+	}
 
-	multierr := &errorsext.MultiErr{}
-	for i := 0; i < 2; i++ {
-		multierr.Append(<-errc)
+	if p.serveCtx != nil {
+		g.start(p.serveCtx)
 	}
-	return multierr.Err()
+	old := p.generation()
+	p.current.Store(g)
+	p.draining[old] = struct{}{}
+	go p.drain(old)
+
+	for l, servers := range p.servers {
+		if _, ok := listeners[l]; ok {
+			continue
+		}
+		delete(p.servers, l)
+		for _, s := range servers {
+			p.removed[s.server] = struct{}{}
+			go s.Close() // It waits for the Serve.
+		}
+	}
+	for l, servers := range added {
+		p.servers[l] = servers
+		if p.serveCtx != nil {
+			for _, s := range servers {
+				p.serve(s)
+			}
+		}
+	}
+	return nil
+}
+
+// drain closes the generation once its sessions are done.
+func (p *Proxy) drain(g *generation) {
+	// FIXME(damnever): magic number
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return // Closed by the Close.
+		case <-ticker.C:
+		}
+		if !g.drained() {
+			continue
+		}
+		p.mu.Lock()
+		_, ok := p.draining[g]
+		delete(p.draining, g)
+		p.mu.Unlock()
+		if ok {
+			g.Close()
+		}
+		return
+	}
+}
+
+// StatusHandler responds with the probe results of the servers in JSON.
+func (p *Proxy) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prober := p.generation().prober
+		if prober == nil {
+			http.Error(w, "probe is disabled", http.StatusNotFound)
+			return
+		}
+		prober.ServeHTTP(w, r)
+	})
 }
 
 func (p *Proxy) Close() error {
+	p.cancel()
 	multierr := &errorsext.MultiErr{}
-	multierr.Append(p.tcpserver.Close())
-	multierr.Append(p.udpserver.Close())
+	p.mu.Lock()
+	for l, servers := range p.servers {
+		for _, s := range servers {
+			p.removed[s.server] = struct{}{}
+			multierr.Append(s.Close())
+		}
+		delete(p.servers, l)
+	}
+	for g := range p.draining {
+		multierr.Append(g.Close())
+		delete(p.draining, g)
+	}
+	p.mu.Unlock()
+	multierr.Append(p.generation().Close())
 	return multierr.Err()
 }
@@ -0,0 +1,248 @@
+package frontend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	netext "github.com/damnever/libext-go/net"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+
+	"github.com/damnever/goodog/internal/pkg/protocol"
+)
+
+// Ref: https://tools.ietf.org/html/rfc1928
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodNoAcceptable = 0xff
+
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+
+	socks5RepSucceeded           = 0x00
+	socks5RepGeneralFailure      = 0x01
+	socks5RepNotAllowed          = 0x02
+	socks5RepHostUnreachable     = 0x04
+	socks5RepTTLExpired          = 0x06
+	socks5RepCmdNotSupported     = 0x07
+	socks5RepAddrTypeUnsupported = 0x08
+)
+
+var _socks5ZeroAddr = &protocol.Addr{Host: "0.0.0.0", Port: 0}
+
+// socks5Proxy is a SOCKS5 server without authentication, it supports CONNECT
+// and UDP ASSOCIATE, the destinations are dialed by the backend(protocol v2).
+type socks5Proxy struct {
+	logger *zap.Logger
+	relays relays
+	server *netext.Server
+	assocs atomic.Uint64
+}
+
+func newSOCKS5Proxy(listenAddr string, relays relays, logger *zap.Logger) (*socks5Proxy, error) {
+	p := &socks5Proxy{
+		logger: logger.Named("socks5"),
+		relays: relays,
+	}
+	server, err := netext.NewTCPServer(listenAddr, p.handle)
+	if err != nil {
+		return nil, err
+	}
+	p.server = server
+	return p, nil
+}
+
+func (p *socks5Proxy) Serve(ctx context.Context) error {
+	return p.server.Serve(netext.WithContext(ctx))
+}
+
+func (p *socks5Proxy) Close() error {
+	return p.server.Close()
+}
+
+func (p *socks5Proxy) handle(ctx context.Context, conn net.Conn) {
+	tcprelay := p.relays.tcp()
+	_ = conn.SetDeadline(time.Now().Add(tcprelay.conf.ConnectTimeout))
+	cmd, dst, err := p.handshake(conn)
+	if err != nil {
+		conn.Close()
+		p.logger.Debug("handshake failed",
+			zap.String("downstream", conn.RemoteAddr().String()),
+			zap.Error(err),
+		)
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	switch cmd {
+	case socks5CmdConnect:
+		tcprelay.relay(ctx, conn, dst, func(err error) error {
+			return p.reply(conn, socks5ReplyOf(err), _socks5ZeroAddr)
+		})
+	case socks5CmdUDPAssociate:
+		p.associate(tcprelay.ctx, conn) // It survives the listener as the TCP sessions.
+	}
+}
+
+// handshake negotiates the method and reads the request.
+func (p *socks5Proxy) handshake(conn net.Conn) (byte, *protocol.Addr, error) {
+	var buf [255]byte
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return 0, nil, err
+	}
+	if buf[0] != socks5Version {
+		return 0, nil, fmt.Errorf("bad version: %d", buf[0])
+	}
+	nmethods := int(buf[1])
+	if _, err := io.ReadFull(conn, buf[:nmethods]); err != nil {
+		return 0, nil, err
+	}
+	if bytes.IndexByte(buf[:nmethods], socks5MethodNoAuth) < 0 {
+		_, _ = conn.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+		return 0, nil, fmt.Errorf("no acceptable methods")
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5MethodNoAuth}); err != nil {
+		return 0, nil, err
+	}
+
+	// | ver | cmd | rsv | atyp | dst.addr | dst.port |
+	if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+		return 0, nil, err
+	}
+	if buf[0] != socks5Version {
+		return 0, nil, fmt.Errorf("bad version: %d", buf[0])
+	}
+	cmd := buf[1]
+	network := "tcp"
+	if cmd == socks5CmdUDPAssociate {
+		network = "udp"
+	}
+	dst, err := protocol.ReadAddr(conn, network)
+	if err != nil {
+		if err == protocol.ErrBadAddrType {
+			_ = p.reply(conn, socks5RepAddrTypeUnsupported, _socks5ZeroAddr)
+		}
+		return 0, nil, err
+	}
+	if cmd != socks5CmdConnect && cmd != socks5CmdUDPAssociate { // BIND is not supported
+		_ = p.reply(conn, socks5RepCmdNotSupported, _socks5ZeroAddr)
+		return 0, nil, fmt.Errorf("command not supported: %d", cmd)
+	}
+	return cmd, dst, nil
+}
+
+// reply sends: | ver | rep | rsv | atyp | bnd.addr | bnd.port |
+func (p *socks5Proxy) reply(conn net.Conn, rep byte, bnd *protocol.Addr) error {
+	b, err := protocol.AppendAddr([]byte{socks5Version, rep, 0x00}, bnd)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(b)
+	return err
+}
+
+func socks5ReplyOf(err error) byte {
+	if err == nil {
+		return socks5RepSucceeded
+	}
+	switch connectErrorKind(err) {
+	case connectErrTimeout:
+		return socks5RepTTLExpired
+	case connectErrStatus:
+		return socks5RepHostUnreachable
+	case connectErrForbidden:
+		return socks5RepNotAllowed
+	default:
+		return socks5RepGeneralFailure
+	}
+}
+
+// associate relays the UDP packets until the TCP connection closes.
+func (p *socks5Proxy) associate(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	pconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: conn.LocalAddr().(*net.TCPAddr).IP})
+	if err != nil {
+		_ = p.reply(conn, socks5RepGeneralFailure, _socks5ZeroAddr)
+		p.logger.Error("listen UDP failed", zap.Error(err))
+		return
+	}
+	bnd, _ := protocol.AddrFromNetAddr(pconn.LocalAddr())
+	if err := p.reply(conn, socks5RepSucceeded, bnd); err != nil {
+		pconn.Close()
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		// The association terminates when the TCP connection terminates.
+		_, _ = io.Copy(ioutil.Discard, conn)
+		cancel()
+		pconn.Close()
+	}()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	udprelay := p.relays.udp() // The association sticks to it.
+	id := strconv.FormatUint(p.assocs.Inc(), 10)
+	keys := map[string]struct{}{}
+	buf := make([]byte, math.MaxUint16, math.MaxUint16)
+	for {
+		n, addr, err := pconn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		if !addr.IP.Equal(clientIP) {
+			continue
+		}
+		// | rsv | frag | atyp | dst.addr | dst.port | data |
+		if n < 3 || buf[2] != 0x00 { // Fragmentation is not supported.
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		dst, err := protocol.ReadAddr(r, "udp")
+		if err != nil {
+			continue
+		}
+		header, _ := protocol.AppendAddr([]byte{0x00, 0x00, 0x00}, dst)
+		key := "socks5/" + id + "/" + addr.String() + "/" + dst.String()
+		keys[key] = struct{}{}
+
+		data := udprelay.pool.Get(r.Len())
+		_, _ = r.Read(data)
+		go func(addr *net.UDPAddr, data []byte) {
+			udprelay.relay(ctx, udpDownstream{
+				key:  key,
+				addr: addr,
+				dst:  dst,
+				reply: func(b []byte) error {
+					packet := udprelay.pool.Get(len(header) + len(b))
+					copy(packet, header)
+					copy(packet[len(header):], b)
+					_, err := pconn.WriteToUDP(packet, addr)
+					udprelay.pool.Put(packet)
+					return err
+				},
+			}, data)
+			udprelay.pool.Put(data)
+		}(addr, data)
+	}
+
+	closing := make([]string, 0, len(keys))
+	for key := range keys {
+		closing = append(closing, key)
+	}
+	udprelay.closeKeys(closing...)
+}
@@ -4,93 +4,176 @@ import (
 	"context"
 	"io"
 	"net"
+	"time"
 
 	netext "github.com/damnever/libext-go/net"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 
 	goodogioutil "github.com/damnever/goodog/internal/pkg/ioutil"
+	"github.com/damnever/goodog/internal/pkg/metrics"
+	"github.com/damnever/goodog/internal/pkg/protocol"
+	"github.com/damnever/goodog/internal/pkg/traffic"
 )
 
-type tcpProxy struct {
+// tcpRelay relays the TCP connections to the backend, it is shared by
+// all the TCP based listeners.
+type tcpRelay struct {
+	ctx       context.Context // The sessions live as long as it, regardless of the listeners.
 	conf      Config
 	logger    *zap.Logger
 	connector Connector
-	server    *netext.Server
+	sessions  *sessionTable
+	active    atomic.Int64 // The sessions, the connecting ones included.
 
-	downstreams     *counter
-	upstreams       *counter
-	connectErrors   *counter
-	readWriteErrors *counter
+	downstreams     *metrics.Gauge
+	upstreams       *metrics.Gauge
+	connectErrors   *connectErrorCounters
+	readWriteErrors *metrics.Counter
+	connectSeconds  *metrics.Histogram
+	sessionSeconds  *metrics.Histogram
+	bytesUp         *metrics.Histogram // Per session, downstream->upstream.
+	bytesDown       *metrics.Histogram
+	traffic         *traffic.Counters
 }
 
-func newTCPProxy(conf Config, connector Connector, logger *zap.Logger) (*tcpProxy, error) {
-	p := &tcpProxy{
+func newTCPRelay(ctx context.Context, conf Config, connector Connector, sessions *sessionTable, logger *zap.Logger) *tcpRelay {
+	return &tcpRelay{
+		ctx:       ctx,
 		conf:      conf,
 		logger:    logger.Named("tcp"),
 		connector: connector,
+		sessions:  sessions,
 
-		downstreams:     newCounter("tcp.downstreams"),
-		upstreams:       newCounter("tcp.upstreams"),
-		connectErrors:   newCounter("tcp.errors.connect"),
-		readWriteErrors: newCounter("tcp.errors.read-write"),
-	}
-	server, err := netext.NewTCPServer(conf.ListenAddr, p.handle)
-	if err != nil {
-		return nil, err
+		downstreams:     newGauge("tcp.downstreams", "The active downstream connections."),
+		upstreams:       newGauge("tcp.upstreams", "The active upstream streams."),
+		connectErrors:   newConnectErrorCounters("tcp.errors.connect"),
+		readWriteErrors: newCounter("tcp.errors.read-write", "The streams which end with errors."),
+		connectSeconds:  newHistogram("tcp.connect-seconds", "The latency to connect to the upstream.", _latencyBuckets),
+		sessionSeconds:  newHistogram("tcp.session-seconds", "The duration of the sessions.", _durationBuckets),
+		bytesUp: newHistogram("tcp.session-bytes.{direction}", "The bytes of the sessions by the directions.",
+			_bytesBuckets, "up"),
+		bytesDown: newHistogram("tcp.session-bytes.{direction}", "The bytes of the sessions by the directions.",
+			_bytesBuckets, "down"),
+		traffic: newTrafficCounters("tcp"),
 	}
-	p.server = server
-	return p, nil
 }
 
-func (p *tcpProxy) Serve(ctx context.Context) error {
-	return p.server.Serve(netext.WithContext(ctx))
-}
-
-func (p *tcpProxy) Close() error {
-	return p.server.Close()
-}
+// relay connects to the dst through the backend and relays the data,
+// the dst is nil if the upstream is configured in the backend.
+// The onConnect is called with the result of the connect if it is not nil,
+// the relay stops if it returns an error. The session is not bound to the
+// context of the listener, it survives the listener.
+func (r *tcpRelay) relay(_ context.Context, downstreamConn net.Conn, dst *protocol.Addr, onConnect func(error) error) {
+	r.active.Inc()
+	r.downstreams.Inc()
+	logFields := []zap.Field{
+		zap.String("upstream", r.conf.ServerHost()),
+		zap.String("downstream", downstreamConn.RemoteAddr().String()),
+	}
+	if dst != nil {
+		logFields = append(logFields, zap.Stringer("destination", dst))
+	}
 
-func (p *tcpProxy) handle(ctx context.Context, downstreamConn net.Conn) {
-	p.downstreams.Inc()
-	upstream, err := p.connector.Connect(ctx)
+	start := time.Now()
+	upstream, err := r.connector.Connect(r.ctx, dst)
+	r.connectSeconds.Observe(time.Since(start).Seconds())
+	if onConnect != nil {
+		if err0 := onConnect(err); err0 != nil && err == nil {
+			upstream.Close()
+			err = err0
+		}
+	}
 	if err != nil {
-		p.connectErrors.Inc()
-		p.downstreams.Dec()
+		r.connectErrors.Inc(err)
+		r.downstreams.Dec()
+		r.active.Dec()
 		downstreamConn.Close()
-		p.logger.Error("connect to upstream failed",
-			zap.String("upstream", p.conf.ServerHost()),
-			zap.String("downstream", downstreamConn.RemoteAddr().String()),
-			zap.Error(err),
-		)
+		r.logger.Error("connect to upstream failed", append(logFields, zap.Error(err))...)
 		return
 	}
-	p.upstreams.Inc()
+	r.upstreams.Inc()
+	session := traffic.NewSession("tcp", r.traffic)
 
 	errc := make(chan error, 2)
-	streamFunc := func(dst, src io.ReadWriter, msg string) {
+	streamFunc := func(dst io.Writer, src io.Reader, msg string) {
 		_, err := goodogioutil.Copy(dst, src, false)
-		p.logger.Debug(msg,
-			zap.String("upstream", p.conf.ServerHost()),
-			zap.String("downstream", downstreamConn.RemoteAddr().String()),
-			zap.Error(err),
-		)
+		r.logger.Debug(msg, append(logFields, zap.Error(err))...)
 		if err != nil {
-			p.readWriteErrors.Inc()
+			r.readWriteErrors.Inc()
 		}
 		errc <- err
 	}
 
-	downstream := netext.NewTimedConn(downstreamConn, p.conf.Timeout, p.conf.Timeout)
-	upstream = tryWrapWithCompression(upstream, p.conf.Compression)
-	go streamFunc(downstream, upstream, "upstream->downstream done")
-	go streamFunc(upstream, downstream, "downstream->upstream done")
+	downstream := netext.NewTimedConn(downstreamConn, r.conf.Timeout, r.conf.Timeout)
+	upstream = tryWrapWithCompression(upstream, r.conf.codec)
+	live := &liveSession{
+		network:    "tcp",
+		downstream: downstreamConn.RemoteAddr().String(),
+		upstream:   r.conf.ServerHost(),
+		session:    session,
+		close: func() {
+			session.SetCloseReason(closeReasonAdmin)
+			upstream.Close()
+			downstream.Close()
+		},
+	}
+	if dst != nil {
+		live.destination = dst.String()
+	}
+	r.sessions.add(live)
+	go streamFunc(session.Writer(traffic.Down, downstream), upstream, "upstream->downstream done")
+	go streamFunc(session.Writer(traffic.Up, upstream), downstream, "downstream->upstream done")
 
+	pending := 2
 	select {
-	case <-ctx.Done():
+	case <-r.ctx.Done():
 	case <-errc:
+		pending--
 	}
 	upstream.Close()
 	downstream.Close()
-	p.downstreams.Dec()
-	p.upstreams.Dec()
+	r.downstreams.Dec()
+	r.upstreams.Dec()
+
+	go func() { // The other one may be still writing what it has read.
+		for ; pending > 0; pending-- {
+			<-errc
+		}
+		r.sessions.remove(session)
+		stats := session.Close("")
+		r.sessionSeconds.Observe(stats.Duration.Seconds())
+		r.bytesUp.Observe(float64(stats.BytesUp))
+		r.bytesDown.Observe(float64(stats.BytesDown))
+		r.logger.Info("session done", append(logFields, stats.Fields()...)...)
+		r.active.Dec()
+	}()
+}
+
+// tcpProxy forwards everything to the upstream configured in the backend.
+type tcpProxy struct {
+	relays relays
+	server *netext.Server
+}
+
+func newTCPProxy(listenAddr string, relays relays) (*tcpProxy, error) {
+	p := &tcpProxy{relays: relays}
+	server, err := netext.NewTCPServer(listenAddr, p.handle)
+	if err != nil {
+		return nil, err
+	}
+	p.server = server
+	return p, nil
+}
+
+func (p *tcpProxy) Serve(ctx context.Context) error {
+	return p.server.Serve(netext.WithContext(ctx))
+}
+
+func (p *tcpProxy) Close() error {
+	return p.server.Close()
+}
+
+func (p *tcpProxy) handle(ctx context.Context, downstreamConn net.Conn) {
+	p.relays.tcp().relay(ctx, downstreamConn, nil, nil)
 }
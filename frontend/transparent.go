@@ -0,0 +1,197 @@
+package frontend
+
+import (
+	"context"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	netext "github.com/damnever/libext-go/net"
+	"go.uber.org/zap"
+
+	"github.com/damnever/goodog/internal/pkg/protocol"
+	"github.com/damnever/goodog/internal/pkg/transparent"
+)
+
+// transparentTCPProxy accepts the TCP connections redirected by iptables/nftables,
+// the original destinations are dialed by the backend(protocol v2):
+//   - REDIRECT: the destinations are recovered by SO_ORIGINAL_DST.
+//   - TPROXY: the destinations are the local addresses(IP_TRANSPARENT).
+type transparentTCPProxy struct {
+	logger      *zap.Logger
+	relays      relays
+	server      *netext.Server
+	originalDst func(net.Conn) (*net.TCPAddr, error)
+}
+
+func newRedirectProxy(listenAddr string, relays relays, logger *zap.Logger) (*transparentTCPProxy, error) {
+	p := &transparentTCPProxy{
+		logger:      logger.Named("redirect"),
+		relays:      relays,
+		originalDst: transparent.OriginalDst,
+	}
+	server, err := netext.NewTCPServer(listenAddr, p.handle)
+	if err != nil {
+		return nil, err
+	}
+	p.server = server
+	return p, nil
+}
+
+func newTProxyTCPProxy(listenAddr string, relays relays, logger *zap.Logger) (*transparentTCPProxy, error) {
+	l, err := transparent.ListenTCP(listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	p := &transparentTCPProxy{
+		logger: logger.Named("tproxy"),
+		relays: relays,
+		originalDst: func(conn net.Conn) (*net.TCPAddr, error) {
+			return conn.LocalAddr().(*net.TCPAddr), nil
+		},
+	}
+	p.server = netext.NewServerFromListener(l, p.handle)
+	return p, nil
+}
+
+func (p *transparentTCPProxy) Serve(ctx context.Context) error {
+	return p.server.Serve(netext.WithContext(ctx))
+}
+
+func (p *transparentTCPProxy) Close() error {
+	return p.server.Close()
+}
+
+func (p *transparentTCPProxy) handle(ctx context.Context, conn net.Conn) {
+	addr, err := p.originalDst(conn)
+	if err != nil {
+		conn.Close()
+		p.logger.Warn("get original destination failed",
+			zap.String("downstream", conn.RemoteAddr().String()),
+			zap.Error(err),
+		)
+		return
+	}
+	dst, _ := protocol.AddrFromNetAddr(addr)
+	p.relays.tcp().relay(ctx, conn, dst, nil)
+}
+
+// transparentUDPProxy accepts the UDP packets redirected by the TPROXY target,
+// the original destinations are recovered by IP_RECVORIGDSTADDR and dialed by
+// the backend(protocol v2), the replies are sent from the original destinations.
+type transparentUDPProxy struct {
+	logger *zap.Logger
+	conn   *net.UDPConn
+	relays relays
+
+	mu      sync.Mutex
+	replies map[string]*transparentReplyConn
+}
+
+type transparentReplyConn struct {
+	conn     *net.UDPConn
+	activeAt time.Time
+}
+
+func newTProxyUDPProxy(listenAddr string, relays relays, logger *zap.Logger) (*transparentUDPProxy, error) {
+	conn, err := transparent.ListenUDP(listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &transparentUDPProxy{
+		logger:  logger.Named("tproxy"),
+		conn:    conn,
+		relays:  relays,
+		replies: map[string]*transparentReplyConn{},
+	}, nil
+}
+
+func (p *transparentUDPProxy) Close() error {
+	err := p.conn.Close()
+	p.mu.Lock()
+	for key, reply := range p.replies {
+		reply.conn.Close()
+		delete(p.replies, key)
+	}
+	p.mu.Unlock()
+	return err
+}
+
+func (p *transparentUDPProxy) Serve(ctx context.Context) error {
+	go p.timeoutLoop(ctx)
+
+	buf := make([]byte, math.MaxUint16, math.MaxUint16)
+	oob := make([]byte, transparent.OOBSize)
+	for {
+		n, src, dstAddr, err := transparent.ReadFromUDPWithDst(p.conn, buf, oob)
+		if err != nil {
+			return err
+		}
+		if dstAddr == nil {
+			p.logger.Debug("no original destination", zap.Stringer("downstream", src))
+			continue
+		}
+		dst, _ := protocol.AddrFromNetAddr(dstAddr)
+
+		relay := p.relays.udp()
+		data := relay.pool.Get(n)
+		copy(data, buf[:n])
+		go func(data []byte) {
+			relay.relay(ctx, udpDownstream{
+				key:  "tproxy/" + src.String() + "/" + dst.String(),
+				addr: src,
+				dst:  dst,
+				reply: func(b []byte) error {
+					conn, err := p.replyConn(dstAddr)
+					if err != nil {
+						return err
+					}
+					_, err = conn.WriteToUDP(b, src)
+					return err
+				},
+			}, data)
+			relay.pool.Put(data)
+		}(data)
+	}
+}
+
+func (p *transparentUDPProxy) replyConn(addr *net.UDPAddr) (*net.UDPConn, error) {
+	key := addr.String()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if reply, ok := p.replies[key]; ok {
+		reply.activeAt = time.Now()
+		return reply.conn, nil
+	}
+	conn, err := transparent.ListenUDPAt(addr)
+	if err != nil {
+		return nil, err
+	}
+	p.replies[key] = &transparentReplyConn{conn: conn, activeAt: time.Now()}
+	return conn, nil
+}
+
+// timeoutLoop closes the idle reply connections.
+func (p *transparentUDPProxy) timeoutLoop(ctx context.Context) {
+	timeout := p.relays.udp().idleTimeout()
+	ticker := time.NewTicker(timeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			timedout := time.Now().Add(-timeout)
+			p.mu.Lock()
+			for key, reply := range p.replies {
+				if !reply.activeAt.After(timedout) {
+					reply.conn.Close()
+					delete(p.replies, key)
+				}
+			}
+			p.mu.Unlock()
+		}
+	}
+}
@@ -14,93 +14,118 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/damnever/goodog/internal/pkg/encoding"
+	"github.com/damnever/goodog/internal/pkg/metrics"
+	"github.com/damnever/goodog/internal/pkg/protocol"
+	"github.com/damnever/goodog/internal/pkg/traffic"
 )
 
-// udpProxy can not guarantee every single packet will be written to backend.
+// udpDownstream is where the packets come from and go back to.
+type udpDownstream struct {
+	key   string         // Identifies the upstream stream.
+	addr  net.Addr       // The downstream address.
+	dst   *protocol.Addr // It is nil if the upstream is configured in the backend.
+	reply func([]byte) error
+}
+
+// udpRelay can not guarantee every single packet will be written to backend,
+// it is shared by all the UDP based listeners.
 //
 // IDEA: we could send UDP packet like this `| addr | size | data |`, so that
 // there is no need to keep checking stream if it is idle, just maintains a pool
 // of upstream streams, but this requires backend to keep tracking the address
 // related packet, this way looks same to me and it consumes more bandwidth.
-type udpProxy struct {
+// UPDATE: it is the mux mode(udpMux) now, the cost of an upstream stream per
+// downstream address is too much for a lot of short-lived peers(e.g. DNS).
+type udpRelay struct {
 	conf   Config
 	logger *zap.Logger
 
-	conn      net.PacketConn
 	connector Connector
 	pool      *bytesext.Pool
+	sessions  *sessionTable
 
 	retrier retry.Retrier
 	upmu    sync.RWMutex
 	ups     map[string]*udpUpstreamWrapper
-
-	pendingUpstreams *counter
-	upstreams        *counter
-	idleClosed       *counter
-	connectErrors    *counter
-	readWriteErrors  *counter
+	mux     *udpMux // The ups are not used if it is not nil.
+
+	datagrams datagramConnector // Nil if the streams are used.
+	active    atomic.Int64      // The sessions and the packets being relayed.
+
+	pendingUpstreams *metrics.Gauge
+	upstreams        *metrics.Gauge
+	idleClosed       *metrics.Counter
+	connectErrors    *connectErrorCounters
+	readWriteErrors  *metrics.Counter
+	connectSeconds   *metrics.Histogram
+	sessionSeconds   *metrics.Histogram
+	traffic          *traffic.Counters
 }
 
-func newUDPProxy(conf Config, connector Connector, logger *zap.Logger) (*udpProxy, error) {
-	conn, err := net.ListenPacket("udp", conf.ListenAddr)
-	if err != nil {
-		return nil, err
-	}
-	return &udpProxy{
+func newUDPRelay(conf Config, connector Connector, sessions *sessionTable, logger *zap.Logger) *udpRelay {
+	return &udpRelay{
 		conf:      conf,
 		logger:    logger.Named("udp"),
-		conn:      conn,
 		connector: connector,
 		pool:      bytesext.NewPoolWith(7, 512), // Max: math.MaxUint16
+		sessions:  sessions,
 		retrier:   retry.New(retry.ConstantBackoffs(2, 10*time.Millisecond)),
 		ups:       map[string]*udpUpstreamWrapper{},
 
-		pendingUpstreams: newCounter("udp.pending-upstreams"),
-		upstreams:        newCounter("udp.upstreams"),
-		idleClosed:       newCounter("udp.idle-timeouts"),
-		connectErrors:    newCounter("udp.errors.connect"),
-		readWriteErrors:  newCounter("udp.errors.read-write"),
-	}, nil
+		pendingUpstreams: newGauge("udp.pending-upstreams", "The upstream streams which are connecting."),
+		upstreams:        newGauge("udp.upstreams", "The active upstream streams."),
+		idleClosed:       newCounter("udp.idle-timeouts", "The peers which are forgotten since they are idle."),
+		connectErrors:    newConnectErrorCounters("udp.errors.connect"),
+		readWriteErrors:  newCounter("udp.errors.read-write", "The streams which end with errors."),
+		connectSeconds:   newHistogram("udp.connect-seconds", "The latency to connect to the upstream.", _latencyBuckets),
+		sessionSeconds:   newHistogram("udp.session-seconds", "The duration of the sessions.", _durationBuckets),
+		traffic:          newTrafficCounters("udp"),
+	}
 }
 
-func (p *udpProxy) Close() error {
-	p.upmu.Lock()
-	defer p.upmu.Unlock()
-	for _, w := range p.ups {
+func (r *udpRelay) Close() error {
+	if r.mux != nil {
+		r.mux.Close()
+	}
+	r.upmu.Lock()
+	defer r.upmu.Unlock()
+	for key, w := range r.ups {
 		w.Close()
+		delete(r.ups, key)
 	}
-	return p.conn.Close()
+	return nil
 }
 
-func (p *udpProxy) Serve(ctx context.Context) error {
-	go p.timeoutLoop(ctx)
-
-	buf := make([]byte, math.MaxUint16, math.MaxUint16)
-	for {
-		n, addr, err := p.conn.ReadFrom(buf)
-		if err != nil {
-			return err
+// closeKeys closes the upstreams of the given keys.
+func (r *udpRelay) closeKeys(keys ...string) {
+	if r.mux != nil {
+		r.mux.closeKeys(keys...)
+	}
+	r.upmu.Lock()
+	defer r.upmu.Unlock()
+	for _, key := range keys {
+		if w, ok := r.ups[key]; ok {
+			w.Close()
+			delete(r.ups, key)
 		}
-
-		data := p.pool.Get(n)
-		copy(data, buf[:n])
-		go func(data []byte) {
-			// FIXME(damnever): try to resuse this goroutine?
-			p.handle(ctx, addr, data)
-			p.pool.Put(data)
-		}(data)
 	}
 }
 
-func (p *udpProxy) timeoutLoop(ctx context.Context) {
+// idleTimeout is how long an upstream can be idle.
+func (r *udpRelay) idleTimeout() time.Duration {
 	// FIXME(damnever): magic number
 	timeout := 10 * time.Second
-	if p.conf.Timeout > timeout { // Is that ok?
-		timeout = p.conf.Timeout
+	if r.conf.Timeout > timeout { // Is that ok?
+		timeout = r.conf.Timeout
 	}
+	return timeout
+}
+
+func (r *udpRelay) timeoutLoop(ctx context.Context) {
+	timeout := r.idleTimeout()
 	ticker := time.NewTicker(3 * time.Second)
 	defer ticker.Stop()
-	addrs := []string{}
+	keys := []string{}
 
 	for {
 		select {
@@ -108,160 +133,269 @@ func (p *udpProxy) timeoutLoop(ctx context.Context) {
 			return
 		case <-ticker.C:
 			timedout := time.Now().Add(-timeout)
-			p.upmu.RLock()
-			for _, up := range p.ups {
+			r.upmu.RLock()
+			for _, up := range r.ups {
 				if !up.ActiveAt().After(timedout) {
-					addrs = append(addrs, up.Addr())
+					keys = append(keys, up.Key())
 				}
 			}
-			p.upmu.RUnlock()
+			r.upmu.RUnlock()
 
-			if len(addrs) > 0 {
-				count := 0
-				p.upmu.Lock()
-				for _, addr := range addrs {
-					up, ok := p.ups[addr]
+			count := 0
+			if len(keys) > 0 {
+				r.upmu.Lock()
+				for _, key := range keys {
+					up, ok := r.ups[key]
 					if ok && !up.ActiveAt().After(timedout) {
 						up.Close()
-						delete(p.ups, addr)
+						delete(r.ups, key)
 						count++
 					}
 				}
-				p.upmu.Unlock()
-				addrs = addrs[:0]
-				if count > 0 {
-					p.logger.Info("idle check", zap.Int("closed", count))
-					p.idleClosed.Add(uint32(count))
-				}
+				r.upmu.Unlock()
+				keys = keys[:0]
+			}
+			if r.mux != nil {
+				count += r.mux.expire(timedout)
+			}
+			if count > 0 {
+				r.logger.Info("idle check", zap.Int("closed", count))
+				r.idleClosed.Add(uint64(count))
 			}
 		}
 	}
 }
 
-func (p *udpProxy) handle(ctx context.Context, downstreamAddr net.Addr, data []byte) {
-	err := p.retrier.Run(ctx, func() (st retry.State, err0 error) {
+// relay relays the data, the pool owns the data.
+func (r *udpRelay) relay(ctx context.Context, downstream udpDownstream, data []byte) {
+	r.active.Inc()
+	defer r.active.Dec()
+	err := r.retrier.Run(ctx, func() (st retry.State, err0 error) {
+		if r.mux != nil {
+			err0 = r.mux.write(ctx, downstream, data)
+			return
+		}
 		var upstream *udpUpstreamWrapper
-		upstream, err0 = p.getRemoteWriter(ctx, downstreamAddr)
+		upstream, err0 = r.getRemoteWriter(ctx, downstream)
 		if err0 != nil {
 			return
 		}
 
 		if err0 = upstream.WritePacket(data); err0 != nil {
 			upstream.Close()
-			p.upmu.Lock()
-			delete(p.ups, downstreamAddr.String())
-			p.upmu.Unlock()
+			r.upmu.Lock()
+			delete(r.ups, downstream.key)
+			r.upmu.Unlock()
 		}
 		return
 	})
 	if err != nil {
-		p.readWriteErrors.Inc()
-		p.logger.Debug("downstream->upstream done",
-			zap.String("upstream", p.conf.ServerHost()),
-			zap.String("downstream", downstreamAddr.String()),
-			zap.Error(err),
-		)
+		r.readWriteErrors.Inc()
+		r.logger.Debug("downstream->upstream done", append(r.logFields(downstream), zap.Error(err))...)
+	}
+}
+
+// track tracks the session of the downstream until it is done, closing it
+// forgets the downstream.
+func (r *udpRelay) track(downstream udpDownstream, session *traffic.Session) {
+	live := &liveSession{
+		network:    "udp",
+		downstream: downstream.addr.String(),
+		upstream:   r.conf.ServerHost(),
+		session:    session,
+		close: func() {
+			session.SetCloseReason(closeReasonAdmin)
+			r.closeKeys(downstream.key)
+		},
+	}
+	if downstream.dst != nil {
+		live.destination = downstream.dst.String()
+	}
+	r.sessions.add(live)
+	r.active.Inc()
+}
+
+// sessionDone logs the session of the downstream once it is done.
+func (r *udpRelay) sessionDone(downstream udpDownstream, session *traffic.Session) {
+	r.sessions.remove(session)
+	stats := session.Close("")
+	r.sessionSeconds.Observe(stats.Duration.Seconds())
+	r.logger.Info("session done", append(r.logFields(downstream), stats.Fields()...)...)
+	r.active.Dec()
+}
+
+func (r *udpRelay) logFields(downstream udpDownstream) []zap.Field {
+	fields := []zap.Field{
+		zap.String("upstream", r.conf.ServerHost()),
+		zap.String("downstream", downstream.addr.String()),
+	}
+	if downstream.dst != nil {
+		fields = append(fields, zap.Stringer("destination", downstream.dst))
 	}
+	return fields
 }
 
-func (p *udpProxy) getRemoteWriter(ctx context.Context, downstreamAddr net.Addr) (*udpUpstreamWrapper, error) {
-	addrStr := downstreamAddr.String()
-	p.upmu.RLock()
-	w, ok := p.ups[addrStr]
-	p.upmu.RUnlock()
+func (r *udpRelay) getRemoteWriter(ctx context.Context, downstream udpDownstream) (*udpUpstreamWrapper, error) {
+	r.upmu.RLock()
+	w, ok := r.ups[downstream.key]
+	r.upmu.RUnlock()
 	if ok {
 		return w, nil
 	}
 
-	p.pendingUpstreams.Inc()
-	upstream, err := p.connector.Connect(ctx)
+	r.pendingUpstreams.Inc()
+	start := time.Now()
+	upstream, datagram, err := r.connect(ctx, downstream.dst)
+	r.connectSeconds.Observe(time.Since(start).Seconds())
 	if err != nil {
-		p.pendingUpstreams.Dec()
-		p.connectErrors.Inc()
-		p.logger.Error("connect to upstream failed",
-			zap.String("upstream", p.conf.ServerHost()),
-			zap.String("downstream", downstreamAddr.String()),
-			zap.Error(err),
-		)
+		r.pendingUpstreams.Dec()
+		r.connectErrors.Inc(err)
+		r.logger.Error("connect to upstream failed", append(r.logFields(downstream), zap.Error(err))...)
 		return nil, err
 	}
-	p.pendingUpstreams.Dec()
+	r.pendingUpstreams.Dec()
 
-	p.upmu.Lock()
-	defer p.upmu.Unlock()
-	if w, ok := p.ups[addrStr]; ok {
+	r.upmu.Lock()
+	defer r.upmu.Unlock()
+	if w, ok := r.ups[downstream.key]; ok {
 		upstream.Close()
 		return w, nil
 	}
-	p.upstreams.Inc()
+	r.upstreams.Inc()
 
-	upstream = tryWrapWithCompression(upstream, p.conf.Compression)
-	upstreamWrapper := newUDPUpstreamWrapper(addrStr, upstream)
-	p.ups[addrStr] = upstreamWrapper
-	go p.serveAddr(ctx, downstreamAddr, upstreamWrapper)
+	if !datagram { // The datagrams are not compressed, the compression needs a stream.
+		upstream = tryWrapWithCompression(upstream, r.conf.codec)
+	}
+	upstreamWrapper := newUDPUpstreamWrapper(downstream.key, upstream, datagram, traffic.NewSession("udp", r.traffic))
+	r.ups[downstream.key] = upstreamWrapper
+	r.track(downstream, upstreamWrapper.session)
+	go r.serveDownstream(ctx, downstream, upstreamWrapper)
 	return upstreamWrapper, nil
 }
 
-func (p *udpProxy) serveAddr(_ context.Context, downstreamAddr net.Addr, upstream *udpUpstreamWrapper) {
+// connect connects with the datagrams if the connector carries them only(MASQUE),
+// with the stream otherwise.
+func (r *udpRelay) connect(ctx context.Context, dst *protocol.Addr) (upstream io.ReadWriteCloser, datagram bool, err error) {
+	if r.datagrams != nil {
+		upstream, err = r.datagrams.connectDatagrams(ctx, dst)
+		return upstream, err == nil, err
+	}
+	upstream, err = r.connector.Connect(ctx, dst)
+	return upstream, false, err
+}
+
+func (r *udpRelay) serveDownstream(_ context.Context, downstream udpDownstream, upstream *udpUpstreamWrapper) {
 	var (
 		n   int
 		err error
-		buf = p.pool.Get(math.MaxUint16)
+		buf = r.pool.Get(math.MaxUint16)
 	)
 	for {
 		// TODO: timeout??
 		if n, err = upstream.ReadPacket(buf); err != nil {
-			p.readWriteErrors.Inc()
+			r.readWriteErrors.Inc()
 			break
 		}
-		if _, err = p.conn.WriteTo(buf[:n], downstreamAddr); err != nil {
-			p.readWriteErrors.Inc()
+		if err = downstream.reply(buf[:n]); err != nil {
+			r.readWriteErrors.Inc()
 			break
 		}
 	}
-	p.pool.Put(buf)
-	p.logger.Debug("upstream->downstream done",
-		zap.String("upstream", p.conf.ServerHost()),
-		zap.String("downstream", downstreamAddr.String()),
-		zap.Error(err),
-	)
+	r.pool.Put(buf)
+	r.logger.Debug("upstream->downstream done", append(r.logFields(downstream), zap.Error(err))...)
 
-	p.upmu.Lock()
-	delete(p.ups, downstreamAddr.String())
-	p.upmu.Unlock()
+	r.upmu.Lock()
+	if w, ok := r.ups[downstream.key]; ok && w == upstream {
+		delete(r.ups, downstream.key)
+	}
+	r.upmu.Unlock()
 	upstream.Close()
-	p.upstreams.Dec()
+	r.upstreams.Dec()
+	r.sessionDone(downstream, upstream.session)
+}
+
+// udpProxy forwards everything to the upstream configured in the backend.
+type udpProxy struct {
+	conn   net.PacketConn
+	relays relays
+}
+
+func newUDPProxy(listenAddr string, relays relays) (*udpProxy, error) {
+	conn, err := net.ListenPacket("udp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpProxy{conn: conn, relays: relays}, nil
+}
+
+func (p *udpProxy) Close() error {
+	return p.conn.Close()
+}
+
+func (p *udpProxy) Serve(ctx context.Context) error {
+	buf := make([]byte, math.MaxUint16, math.MaxUint16)
+	for {
+		n, addr, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		relay := p.relays.udp()
+		data := relay.pool.Get(n)
+		copy(data, buf[:n])
+		go func(data []byte) {
+			// FIXME(damnever): try to resuse this goroutine?
+			relay.relay(ctx, udpDownstream{
+				key:   addr.String(),
+				addr:  addr,
+				reply: func(b []byte) error { _, err := p.conn.WriteTo(b, addr); return err },
+			}, data)
+			relay.pool.Put(data)
+		}(data)
+	}
 }
 
 type udpUpstreamWrapper struct {
-	addr     string
+	key      string
 	activeAt atomic.Value
+	datagram bool // Every Read/Write of the upstream is a whole packet.
+	session  *traffic.Session
 
 	upstream io.ReadWriteCloser
 }
 
-func newUDPUpstreamWrapper(addr string, upstream io.ReadWriteCloser) *udpUpstreamWrapper {
-	u := &udpUpstreamWrapper{addr: addr, upstream: upstream}
+func newUDPUpstreamWrapper(key string, upstream io.ReadWriteCloser, datagram bool, session *traffic.Session) *udpUpstreamWrapper {
+	u := &udpUpstreamWrapper{key: key, upstream: upstream, datagram: datagram, session: session}
 	u.activeAt.Store(time.Now())
 	return u
 }
 
-func (u *udpUpstreamWrapper) Addr() string {
-	return u.addr
+func (u *udpUpstreamWrapper) Key() string {
+	return u.key
 }
 
-func (u *udpUpstreamWrapper) ReadPacket(p []byte) (int, error) {
-	n, err := encoding.ReadU16SizedBytes(u.upstream, p)
+func (u *udpUpstreamWrapper) ReadPacket(p []byte) (n int, err error) {
+	if u.datagram {
+		n, err = u.upstream.Read(p)
+	} else {
+		n, err = encoding.ReadU16SizedBytes(u.upstream, p)
+	}
 	if err == nil {
 		u.activeAt.Store(time.Now())
+		u.session.AddPacket(traffic.Down, n)
 	}
 	return n, err
 }
 
-func (u *udpUpstreamWrapper) WritePacket(p []byte) error {
-	err := encoding.WriteU16SizedBytes(u.upstream, p)
+func (u *udpUpstreamWrapper) WritePacket(p []byte) (err error) {
+	if u.datagram {
+		_, err = u.upstream.Write(p)
+	} else {
+		err = encoding.WriteU16SizedBytes(u.upstream, p)
+	}
 	if err == nil {
 		u.activeAt.Store(time.Now())
+		u.session.AddPacket(traffic.Up, len(p))
 	}
 	return err
 }
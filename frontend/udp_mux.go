@@ -0,0 +1,330 @@
+package frontend
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/damnever/goodog/internal/pkg/metrics"
+	"github.com/damnever/goodog/internal/pkg/protocol"
+	"github.com/damnever/goodog/internal/pkg/traffic"
+)
+
+var errUDPMuxClosed = errors.New("goodog/frontend: udp mux closed")
+
+// udpMux multiplexes the UDP packets of all the downstreams over a few upstream
+// streams(protocol.MuxPacket), the packets of a downstream always go through the
+// same stream, since the backend tracks the sessions per stream.
+type udpMux struct {
+	relay     *udpRelay
+	connector streamConnector
+	urls      connectURLs // With the mux query.
+	size      int         // The number of streams per protocol version.
+
+	mu       sync.Mutex
+	closed   bool
+	streams  map[string]*udpMuxStream        // By version/index.
+	pendings map[string]*pendingUDPMuxStream // The streams being opened, by version/index.
+
+	streamsCounter *metrics.Gauge
+}
+
+func newUDPMux(relay *udpRelay, connector streamConnector, urls connectURLs) *udpMux {
+	return &udpMux{
+		relay:     relay,
+		connector: connector,
+		urls:      urls,
+		// FIXME(damnever): magic number
+		size:     4,
+		streams:  map[string]*udpMuxStream{},
+		pendings: map[string]*pendingUDPMuxStream{},
+
+		streamsCounter: newGauge("udp.mux.streams", "The active mux streams."),
+	}
+}
+
+func (m *udpMux) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	for key, stream := range m.streams {
+		stream.Close()
+		delete(m.streams, key)
+	}
+	return nil
+}
+
+// write writes the data of the downstream.
+func (m *udpMux) write(ctx context.Context, downstream udpDownstream, data []byte) error {
+	src, err := protocol.AddrFromNetAddr(downstream.addr)
+	if err != nil {
+		return err
+	}
+	stream, err := m.getStream(ctx, src, downstream.dst != nil)
+	if err != nil {
+		return err
+	}
+	key := udpMuxKey(src, downstream.dst)
+	session := stream.register(key, downstream, m.relay.track)
+
+	buf := m.relay.pool.Get(math.MaxUint16)
+	defer m.relay.pool.Put(buf)
+	packet, err := protocol.AppendPacket(buf[:0], src, downstream.dst, data)
+	if err != nil {
+		return err
+	}
+	if err := stream.write(packet); err != nil {
+		m.removeStream(stream)
+		return err
+	}
+	session.AddPacket(traffic.Up, len(data))
+	return nil
+}
+
+// pendingUDPMuxStream is a stream being opened, done is closed once it is opened or failed.
+type pendingUDPMuxStream struct {
+	done chan struct{}
+	err  error
+}
+
+func (m *udpMux) getStream(ctx context.Context, src *protocol.Addr, withDst bool) (*udpMuxStream, error) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(src.String()))
+	uri, version := m.urls.v1, protocol.V1
+	if withDst {
+		uri, version = m.urls.v2, protocol.V2
+	}
+	key := version + "/" + strconv.Itoa(int(h.Sum32()%uint32(m.size)))
+
+	for {
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return nil, errUDPMuxClosed
+		}
+		if stream, ok := m.streams[key]; ok {
+			m.mu.Unlock()
+			return stream, nil
+		}
+		pending, ok := m.pendings[key]
+		if !ok {
+			pending = &pendingUDPMuxStream{done: make(chan struct{})}
+			m.pendings[key] = pending
+		}
+		m.mu.Unlock()
+
+		if !ok {
+			return m.openStream(ctx, key, uri, withDst, pending)
+		}
+		// NOTE(damnever): the packets of the other streams are not blocked by the
+		// one being opened.
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-pending.done:
+		}
+		if pending.err != nil {
+			return nil, pending.err
+		}
+	}
+}
+
+// openStream opens the stream without holding m.mu and wakes up the callers
+// waiting for the pending one.
+func (m *udpMux) openStream(ctx context.Context, key, uri string, withDst bool, pending *pendingUDPMuxStream) (stream *udpMuxStream, err error) {
+	defer func() {
+		m.mu.Lock()
+		delete(m.pendings, key)
+		if err == nil && m.closed {
+			stream.Close()
+			stream, err = nil, errUDPMuxClosed
+		}
+		if err == nil {
+			m.streams[key] = stream
+			m.streamsCounter.Inc()
+			go m.serveDownstreams(stream)
+		}
+		m.mu.Unlock()
+		pending.err = err
+		close(pending.done)
+	}()
+
+	start := time.Now()
+	upstream, err := m.connector.openStream(ctx, uri)
+	m.relay.connectSeconds.Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.relay.connectErrors.Inc(err)
+		m.relay.logger.Error("connect to upstream failed",
+			zap.String("upstream", m.relay.conf.ServerHost()),
+			zap.String("mux", protocol.MuxPacket),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	return &udpMuxStream{
+		key:         key,
+		withDst:     withDst,
+		upstream:    tryWrapWithCompression(upstream, m.relay.conf.codec),
+		traffic:     m.relay.traffic,
+		downstreams: map[string]*udpMuxDownstream{},
+	}, nil
+}
+
+func (m *udpMux) removeStream(stream *udpMuxStream) {
+	m.mu.Lock()
+	if s, ok := m.streams[stream.key]; ok && s == stream {
+		delete(m.streams, stream.key)
+	}
+	m.mu.Unlock()
+	stream.Close()
+	m.sessionsDone(stream.forget(func(*udpMuxDownstream) bool { return true }))
+}
+
+func (m *udpMux) sessionsDone(downstreams []*udpMuxDownstream) {
+	for _, d := range downstreams {
+		m.relay.sessionDone(d.downstream, d.session)
+	}
+}
+
+func (m *udpMux) serveDownstreams(stream *udpMuxStream) {
+	var (
+		src, dst *protocol.Addr
+		n        int
+		err      error
+		buf      = m.relay.pool.Get(math.MaxUint16)
+	)
+	for {
+		if src, dst, n, err = protocol.ReadPacket(stream.upstream, stream.withDst, buf); err != nil {
+			m.relay.readWriteErrors.Inc()
+			break
+		}
+		downstream, session, ok := stream.lookup(udpMuxKey(src, dst))
+		if !ok {
+			continue
+		}
+		if err := downstream.reply(buf[:n]); err != nil {
+			m.relay.logger.Debug("reply failed", append(m.relay.logFields(downstream), zap.Error(err))...)
+			continue
+		}
+		session.AddPacket(traffic.Down, n)
+	}
+	m.relay.pool.Put(buf)
+	m.relay.logger.Debug("mux stream done", zap.String("stream", stream.key), zap.Error(err))
+	m.removeStream(stream)
+	m.streamsCounter.Dec()
+}
+
+// expire forgets the downstreams which are inactive since the timedout.
+func (m *udpMux) expire(timedout time.Time) int {
+	expired := []*udpMuxDownstream{}
+	m.mu.Lock()
+	for _, stream := range m.streams {
+		expired = append(expired, stream.forget(func(d *udpMuxDownstream) bool { return !d.activeAt.After(timedout) })...)
+	}
+	m.mu.Unlock()
+	m.sessionsDone(expired)
+	return len(expired)
+}
+
+// closeKeys forgets the downstreams of the given keys.
+func (m *udpMux) closeKeys(keys ...string) {
+	closing := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		closing[key] = struct{}{}
+	}
+	closed := []*udpMuxDownstream{}
+	m.mu.Lock()
+	for _, stream := range m.streams {
+		closed = append(closed, stream.forget(func(d *udpMuxDownstream) bool {
+			_, ok := closing[d.downstream.key]
+			return ok
+		})...)
+	}
+	m.mu.Unlock()
+	m.sessionsDone(closed)
+}
+
+func udpMuxKey(src, dst *protocol.Addr) string {
+	if dst == nil {
+		return src.String()
+	}
+	return src.String() + "/" + dst.String()
+}
+
+type udpMuxStream struct {
+	key      string
+	withDst  bool
+	wmu      sync.Mutex
+	upstream io.ReadWriteCloser
+	traffic  *traffic.Counters
+
+	mu          sync.Mutex
+	downstreams map[string]*udpMuxDownstream // By src(and dst).
+}
+
+type udpMuxDownstream struct {
+	downstream udpDownstream
+	activeAt   time.Time
+	session    *traffic.Session
+}
+
+// register registers the downstream, the session starts if it is a new one, the
+// onStart is called before it can be forgotten.
+func (s *udpMuxStream) register(key string, downstream udpDownstream, onStart func(udpDownstream, *traffic.Session)) *traffic.Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.downstreams[key]
+	if ok {
+		d.downstream = downstream
+		d.activeAt = time.Now()
+	} else {
+		d = &udpMuxDownstream{downstream: downstream, activeAt: time.Now(), session: traffic.NewSession("udp", s.traffic)}
+		s.downstreams[key] = d
+		onStart(downstream, d.session)
+	}
+	return d.session
+}
+
+func (s *udpMuxStream) lookup(key string) (udpDownstream, *traffic.Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.downstreams[key]
+	if !ok {
+		return udpDownstream{}, nil, false
+	}
+	d.activeAt = time.Now()
+	return d.downstream, d.session, true
+}
+
+// forget forgets the downstreams which match, they are returned.
+func (s *udpMuxStream) forget(match func(*udpMuxDownstream) bool) []*udpMuxDownstream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	forgotten := []*udpMuxDownstream{}
+	for key, d := range s.downstreams {
+		if match(d) {
+			delete(s.downstreams, key)
+			forgotten = append(forgotten, d)
+		}
+	}
+	return forgotten
+}
+
+// write writes a packet, the packets must not be interleaved.
+func (s *udpMuxStream) write(packet []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	_, err := s.upstream.Write(packet)
+	return err
+}
+
+func (s *udpMuxStream) Close() error {
+	return s.upstream.Close()
+}
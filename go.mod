@@ -3,14 +3,21 @@ module github.com/damnever/goodog
 go 1.14
 
 require (
+	github.com/bkaradzic/go-lz4 v1.0.0
 	github.com/caddyserver/caddy/v2 v2.0.0-beta.15
 	github.com/damnever/goctl v1.2.0
 	github.com/damnever/libext-go v0.1.1
 	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db
+	github.com/hashicorp/yamux v0.0.0-20200609203250-aecfd211c9ce
+	github.com/klauspost/compress v1.8.6
 	github.com/lucas-clemente/quic-go v0.14.4
 	github.com/mattn/go-isatty v0.0.4
+	github.com/naoina/toml v0.1.1
 	github.com/stretchr/testify v1.4.0
 	go.uber.org/atomic v1.5.1
 	go.uber.org/goleak v1.0.0
 	go.uber.org/zap v1.10.0
+	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553
+	golang.org/x/sys v0.0.0-20191210023423-ac6580df4449
+	gopkg.in/yaml.v2 v2.2.2
 )
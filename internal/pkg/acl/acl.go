@@ -0,0 +1,226 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Rules are the raw ACL rules:
+//   - CIDRs: "10.0.0.0/8", "fd00::/8" or a single IP.
+//   - Ports: "443" or "8000-8999".
+//   - Domains: suffixes, "example.com" matches itself and all of its subdomains.
+//
+// The deny rules always win. If any of the allow rules of the host(CIDRs or
+// domains) is given, the host must match one of them. The loopback, link-local
+// and private addresses are denied unless AllowPrivate is true or they are allowed
+// explicitly.
+type Rules struct {
+	AllowCIDRs   []string
+	DenyCIDRs    []string
+	AllowPorts   []string
+	DenyPorts    []string
+	AllowDomains []string
+	DenyDomains  []string
+	AllowPrivate bool
+}
+
+// DeniedError is returned if a destination is denied by the ACL.
+type DeniedError struct {
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	return "goodog/pkg/acl: denied: " + e.Reason
+}
+
+func denied(format string, args ...interface{}) error {
+	return &DeniedError{Reason: fmt.Sprintf(format, args...)}
+}
+
+var _privateNets = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+type portRange struct {
+	min, max uint16
+}
+
+// ACL decides which destinations can be dialed.
+type ACL struct {
+	allowNets    []*net.IPNet
+	denyNets     []*net.IPNet
+	allowPorts   []portRange
+	denyPorts    []portRange
+	allowDomains []string
+	denyDomains  []string
+	allowPrivate bool
+}
+
+// New creates an ACL from the rules.
+func New(rules Rules) (*ACL, error) {
+	a := &ACL{allowPrivate: rules.AllowPrivate}
+	var err error
+	if a.allowNets, err = parseCIDRs(rules.AllowCIDRs); err != nil {
+		return nil, err
+	}
+	if a.denyNets, err = parseCIDRs(rules.DenyCIDRs); err != nil {
+		return nil, err
+	}
+	if a.allowPorts, err = parsePortRanges(rules.AllowPorts); err != nil {
+		return nil, err
+	}
+	if a.denyPorts, err = parsePortRanges(rules.DenyPorts); err != nil {
+		return nil, err
+	}
+	a.allowDomains = normalizeDomains(rules.AllowDomains)
+	a.denyDomains = normalizeDomains(rules.DenyDomains)
+	return a, nil
+}
+
+// CheckPort checks the port of the destination.
+func (a *ACL) CheckPort(port uint16) error {
+	if matchPort(a.denyPorts, port) {
+		return denied("port %d is denied", port)
+	}
+	if len(a.allowPorts) > 0 && !matchPort(a.allowPorts, port) {
+		return denied("port %d is not allowed", port)
+	}
+	return nil
+}
+
+// CheckDomain checks the domain of the destination before resolving it,
+// the trusted is true if the domain is allowed explicitly, its addresses
+// are only checked against the deny rules then.
+func (a *ACL) CheckDomain(domain string) (trusted bool, err error) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if matchDomain(a.denyDomains, domain) {
+		return false, denied("domain %s is denied", domain)
+	}
+	if matchDomain(a.allowDomains, domain) {
+		return true, nil
+	}
+	// The addresses may be allowed by the CIDRs.
+	if len(a.allowDomains) > 0 && len(a.allowNets) == 0 {
+		return false, denied("domain %s is not allowed", domain)
+	}
+	return false, nil
+}
+
+// CheckIP checks the IP of the destination, it must be checked after the
+// domain is resolved, otherwise a domain can point to anywhere.
+func (a *ACL) CheckIP(ip net.IP, trusted bool) error {
+	if ip == nil {
+		return denied("bad IP")
+	}
+	if matchNet(a.denyNets, ip) {
+		return denied("IP %s is denied", ip)
+	}
+	if matchNet(a.allowNets, ip) || trusted {
+		return nil
+	}
+	if !a.allowPrivate && (matchNet(_privateNets, ip) || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()) {
+		return denied("IP %s is private", ip)
+	}
+	if len(a.allowNets) > 0 || len(a.allowDomains) > 0 {
+		return denied("IP %s is not allowed", ip)
+	}
+	return nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("goodog/pkg/acl: bad CIDR: %s", cidr)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("goodog/pkg/acl: bad CIDR: %s", cidr)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+func parsePortRanges(ports []string) ([]portRange, error) {
+	ranges := make([]portRange, 0, len(ports))
+	for _, s := range ports {
+		minStr, maxStr := s, s
+		if i := strings.IndexByte(s, '-'); i >= 0 {
+			minStr, maxStr = s[:i], s[i+1:]
+		}
+		min, err0 := strconv.ParseUint(strings.TrimSpace(minStr), 10, 16)
+		max, err1 := strconv.ParseUint(strings.TrimSpace(maxStr), 10, 16)
+		if err0 != nil || err1 != nil || min > max {
+			return nil, fmt.Errorf("goodog/pkg/acl: bad port range: %s", s)
+		}
+		ranges = append(ranges, portRange{min: uint16(min), max: uint16(max)})
+	}
+	return ranges, nil
+}
+
+func normalizeDomains(domains []string) []string {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		domain = strings.Trim(strings.ToLower(domain), ".")
+		if domain != "" {
+			normalized = append(normalized, domain)
+		}
+	}
+	return normalized
+}
+
+func matchNet(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPort(ranges []portRange, port uint16) bool {
+	for _, r := range ranges {
+		if port >= r.min && port <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+func matchDomain(suffixes []string, domain string) bool {
+	for _, suffix := range suffixes {
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package acl
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func isDenied(err error) bool {
+	var derr *DeniedError
+	return errors.As(err, &derr)
+}
+
+func TestDefaults(t *testing.T) {
+	a, err := New(Rules{})
+	require.Nil(t, err)
+
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1",
+		"169.254.169.254", "0.0.0.0", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1"} {
+		require.True(t, isDenied(a.CheckIP(net.ParseIP(ip), false)), ip)
+	}
+	for _, ip := range []string{"8.8.8.8", "2001:4860:4860::8888"} {
+		require.Nil(t, a.CheckIP(net.ParseIP(ip), false), ip)
+	}
+	require.Nil(t, a.CheckPort(22))
+	trusted, err := a.CheckDomain("example.com")
+	require.Nil(t, err)
+	require.False(t, trusted)
+}
+
+func TestRules(t *testing.T) {
+	a, err := New(Rules{
+		AllowCIDRs:   []string{"10.1.0.0/16", "192.168.1.1"},
+		DenyCIDRs:    []string{"10.1.2.0/24"},
+		AllowPorts:   []string{"80", "443", "8000-8999"},
+		DenyPorts:    []string{"8080"},
+		AllowDomains: []string{"example.com"},
+		DenyDomains:  []string{".bad.example.com"},
+	})
+	require.Nil(t, err)
+
+	require.Nil(t, a.CheckIP(net.ParseIP("10.1.1.1"), false))
+	require.Nil(t, a.CheckIP(net.ParseIP("192.168.1.1"), false))
+	require.True(t, isDenied(a.CheckIP(net.ParseIP("192.168.1.2"), false)))
+	require.True(t, isDenied(a.CheckIP(net.ParseIP("10.1.2.1"), false)))
+	require.True(t, isDenied(a.CheckIP(net.ParseIP("10.1.2.1"), true)))
+	require.True(t, isDenied(a.CheckIP(net.ParseIP("8.8.8.8"), false)))
+	require.Nil(t, a.CheckIP(net.ParseIP("127.0.0.1"), true))
+
+	require.Nil(t, a.CheckPort(443))
+	require.Nil(t, a.CheckPort(8888))
+	require.True(t, isDenied(a.CheckPort(8080)))
+	require.True(t, isDenied(a.CheckPort(22)))
+
+	for domain, expected := range map[string]bool{"example.com": true, "A.Example.COM.": true} {
+		trusted, err := a.CheckDomain(domain)
+		require.Nil(t, err, domain)
+		require.Equal(t, expected, trusted, domain)
+	}
+	_, err = a.CheckDomain("x.bad.example.com")
+	require.True(t, isDenied(err))
+	trusted, err := a.CheckDomain("notexample.com") // May resolve into the CIDRs.
+	require.Nil(t, err)
+	require.False(t, trusted)
+
+	a, err = New(Rules{AllowDomains: []string{"example.com"}})
+	require.Nil(t, err)
+	_, err = a.CheckDomain("example.org")
+	require.True(t, isDenied(err))
+	require.True(t, isDenied(a.CheckIP(net.ParseIP("8.8.8.8"), false)))
+}
+
+func TestBadRules(t *testing.T) {
+	for _, rules := range []Rules{
+		{AllowCIDRs: []string{"10.0.0.0/33"}},
+		{DenyCIDRs: []string{"x"}},
+		{AllowPorts: []string{"65536"}},
+		{DenyPorts: []string{"9-1"}},
+	} {
+		_, err := New(rules)
+		require.NotNil(t, err)
+	}
+}
@@ -0,0 +1,229 @@
+package compression
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// FIXME(damnever): magic numbers
+const (
+	maxBlockSize           = 64 << 10
+	maxCompressedBlockSize = maxBlockSize * 2
+
+	storedFlag       = 1 << 31 // In the length of the adaptive blocks.
+	minSavingRatio   = 8       // The compressed block must be 1/8 smaller, or it is stored.
+	minStoredBackoff = 8       // The blocks which are stored before the next try.
+	maxStoredBackoff = 256
+)
+
+var ErrBlockTooLarge = errors.New("goodog/pkg/compression: block too large")
+
+// blockCodec frames the blocks compressed by the block compressors, e.g. lz4 and
+// the zstd frames, every Write makes at most a few blocks so nothing is buffered:
+//
+//	| length(uint32, big endian) | compressed block |
+//
+// The adaptive one stores the blocks uncompressed if the compression does not save
+// enough, the highest bit of the length is set for them. The data is likely to stay
+// incompressible(e.g. TLS), so the later blocks are stored without trying, the number
+// of them doubles every time the compression fails to save.
+type blockCodec struct {
+	compress   func(dst, src []byte) ([]byte, error) // Appends to the dst.
+	decompress func(dst, src []byte) ([]byte, error) // Appends to the dst.
+	adaptive   bool
+	readers    sync.Pool
+	writers    sync.Pool
+}
+
+func newBlockCodec(compress, decompress func(dst, src []byte) ([]byte, error), adaptive bool) *blockCodec {
+	c := &blockCodec{compress: compress, decompress: decompress, adaptive: adaptive}
+	c.readers.New = func() interface{} { return &blockReader{codec: c} }
+	c.writers.New = func() interface{} { return &blockWriter{codec: c} }
+	return c
+}
+
+// newAdaptiveCodec creates the adaptive codec on the block compressor of the inner
+// method, snappy by default.
+func newAdaptiveCodec(inner string) (Codec, error) {
+	if inner == "" || inner == "snappy" {
+		return newBlockCodec(snappyCompress, snappyDecompress, true), nil
+	}
+	codec, err := Lookup(inner)
+	if err != nil {
+		return nil, err
+	}
+	if bc, ok := codec.(*blockCodec); ok && !bc.adaptive {
+		return newBlockCodec(bc.compress, bc.decompress, true), nil
+	}
+	return nil, fmt.Errorf("%w: adaptive:%s", ErrBadLevel, inner)
+}
+
+func (c *blockCodec) NewReader(r io.Reader) Reader {
+	br := c.readers.Get().(*blockReader)
+	br.r = r
+	return br
+}
+
+func (c *blockCodec) NewWriter(w io.Writer) Writer {
+	bw := c.writers.Get().(*blockWriter)
+	bw.w = w
+	return bw
+}
+
+type blockReader struct {
+	codec *blockCodec
+	r     io.Reader
+	hdr   [4]byte
+	block []byte
+	buf   []byte
+	rest  []byte // The decompressed data which has not been read.
+	stats Stats
+}
+
+func (br *blockReader) Read(p []byte) (int, error) {
+	for len(br.rest) == 0 {
+		if err := br.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, br.rest)
+	br.rest = br.rest[n:]
+	return n, nil
+}
+
+func (br *blockReader) next() error {
+	if _, err := io.ReadFull(br.r, br.hdr[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(br.hdr[:])
+	stored := br.codec.adaptive && size&storedFlag != 0
+	if stored {
+		size &^= storedFlag
+	}
+	if size > maxCompressedBlockSize || (stored && size > maxBlockSize) {
+		return ErrBlockTooLarge
+	}
+	if cap(br.block) < int(size) {
+		br.block = make([]byte, size)
+	}
+	br.block = br.block[:size]
+	if _, err := io.ReadFull(br.r, br.block); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	br.stats.WireBytes += uint64(len(br.hdr) + len(br.block))
+
+	if stored {
+		br.rest = br.block
+		br.stats.RawBytes += uint64(len(br.block))
+		br.stats.StoredBlocks++
+		return nil
+	}
+	buf, err := br.codec.decompress(br.buf[:0], br.block)
+	if err != nil {
+		return err
+	}
+	if len(buf) > maxBlockSize {
+		return ErrBlockTooLarge
+	}
+	br.buf, br.rest = buf, buf
+	br.stats.RawBytes += uint64(len(buf))
+	br.stats.CompressedBlocks++
+	return nil
+}
+
+func (br *blockReader) Stats() Stats {
+	return br.stats
+}
+
+func (br *blockReader) Release() {
+	br.r, br.rest, br.stats = nil, nil, Stats{}
+	br.codec.readers.Put(br)
+}
+
+type blockWriter struct {
+	codec   *blockCodec
+	w       io.Writer
+	buf     []byte
+	skips   int // The blocks to store without trying to compress.
+	backoff int
+	stats   Stats
+}
+
+func (bw *blockWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxBlockSize {
+			chunk = chunk[:maxBlockSize]
+		}
+		buf, err := bw.encode(chunk)
+		if err != nil {
+			return written, err
+		}
+		if _, err := bw.w.Write(buf); err != nil {
+			return written, err
+		}
+		bw.stats.RawBytes += uint64(len(chunk))
+		bw.stats.WireBytes += uint64(len(buf))
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// encode encodes the chunk as a block with the length.
+func (bw *blockWriter) encode(chunk []byte) ([]byte, error) {
+	if bw.skips > 0 {
+		bw.skips--
+		return bw.store(chunk), nil
+	}
+	buf, err := bw.codec.compress(append(bw.buf[:0], 0, 0, 0, 0), chunk)
+	if err != nil {
+		return nil, err
+	}
+	bw.buf = buf
+	size := len(buf) - 4
+	if bw.codec.adaptive {
+		if size > len(chunk)-len(chunk)/minSavingRatio {
+			if bw.backoff *= 2; bw.backoff < minStoredBackoff {
+				bw.backoff = minStoredBackoff
+			} else if bw.backoff > maxStoredBackoff {
+				bw.backoff = maxStoredBackoff
+			}
+			bw.skips = bw.backoff
+			return bw.store(chunk), nil
+		}
+		bw.backoff = 0
+	}
+	binary.BigEndian.PutUint32(buf, uint32(size))
+	bw.stats.CompressedBlocks++
+	return buf, nil
+}
+
+func (bw *blockWriter) store(chunk []byte) []byte {
+	bw.buf = append(bw.buf[:0], 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(bw.buf, uint32(len(chunk))|storedFlag)
+	bw.buf = append(bw.buf, chunk...)
+	bw.stats.StoredBlocks++
+	return bw.buf
+}
+
+// Flush does nothing since nothing is buffered.
+func (bw *blockWriter) Flush() error {
+	return nil
+}
+
+func (bw *blockWriter) Stats() Stats {
+	return bw.stats
+}
+
+func (bw *blockWriter) Release() {
+	bw.w, bw.skips, bw.backoff, bw.stats = nil, 0, 0, Stats{}
+	bw.codec.writers.Put(bw)
+}
@@ -0,0 +1,230 @@
+package compression
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	lz4 "github.com/bkaradzic/go-lz4"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/damnever/goodog/internal/pkg/snappypool"
+)
+
+func init() {
+	Register("snappy", newSnappyCodec)
+	Register("zstd", newZstdCodec)
+	Register("lz4", newLZ4Codec)
+	Register("gzip", newGzipCodec)
+	Register("adaptive", newAdaptiveCodec)
+}
+
+type snappyCodec struct{}
+
+func newSnappyCodec(level string) (Codec, error) {
+	if level != "" {
+		return nil, fmt.Errorf("%w: snappy:%s", ErrBadLevel, level)
+	}
+	return snappyCodec{}, nil
+}
+
+func (snappyCodec) NewReader(r io.Reader) Reader {
+	return snappyReader{snappypool.GetReader(r)}
+}
+
+func (snappyCodec) NewWriter(w io.Writer) Writer {
+	return snappyWriter{snappypool.GetWriter(w)}
+}
+
+type snappyReader struct {
+	*snappy.Reader
+}
+
+func (r snappyReader) Release() {
+	snappypool.PutReader(r.Reader)
+}
+
+type snappyWriter struct {
+	*snappy.Writer
+}
+
+func (w snappyWriter) Release() {
+	snappypool.PutWriter(w.Writer)
+}
+
+// snappyCompress compresses a snappy block, the streaming snappy is used otherwise.
+func snappyCompress(dst, src []byte) ([]byte, error) {
+	return appendTo(dst, src, snappy.MaxEncodedLen(len(src)), func(dst, src []byte) ([]byte, error) {
+		return snappy.Encode(dst, src), nil
+	})
+}
+
+func snappyDecompress(dst, src []byte) ([]byte, error) {
+	size, err := snappy.DecodedLen(src)
+	if err != nil {
+		return dst, err
+	}
+	if size > maxBlockSize {
+		return dst, ErrBlockTooLarge
+	}
+	return appendTo(dst, src, size, snappy.Decode)
+}
+
+// newZstdCodec creates the zstd codec, the level is either the level of zstd(e.g. 3)
+// or the name of the encoder level(fastest or default).
+//
+// NOTE(damnever): the streaming decoder of the zstd we are using keeps a goroutine
+// reading in the background, it can not be released before the stream is done. Every
+// Write is compressed as a zstd frame instead, the frames are independent.
+func newZstdCodec(level string) (Codec, error) {
+	encoderLevel := zstd.SpeedDefault
+	if level != "" {
+		if n, err := strconv.Atoi(level); err == nil {
+			encoderLevel = zstd.EncoderLevelFromZstd(n)
+		} else if ok, l := zstd.EncoderLevelFromString(level); ok {
+			encoderLevel = l
+		} else {
+			return nil, fmt.Errorf("%w: zstd:%s", ErrBadLevel, level)
+		}
+	}
+	// Both of them can be used concurrently.
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(encoderLevel),
+		zstd.WithWindowSize(maxBlockSize), zstd.WithEncoderCRC(false))
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxBlockSize))
+	if err != nil {
+		return nil, err
+	}
+	return newBlockCodec(
+		func(dst, src []byte) ([]byte, error) {
+			return encoder.EncodeAll(src, dst), nil
+		},
+		func(dst, src []byte) ([]byte, error) {
+			return decoder.DecodeAll(src, dst)
+		},
+		false,
+	), nil
+}
+
+// newLZ4Codec creates the lz4 codec, every Write is compressed as a lz4 block.
+//
+// FIXME(damnever): the go-lz4 allocates a hash table for every block.
+func newLZ4Codec(level string) (Codec, error) {
+	if level != "" {
+		return nil, fmt.Errorf("%w: lz4:%s", ErrBadLevel, level)
+	}
+	return newBlockCodec(
+		func(dst, src []byte) ([]byte, error) {
+			return appendTo(dst, src, lz4.CompressBound(len(src)), lz4.Encode)
+		},
+		func(dst, src []byte) ([]byte, error) {
+			// The block starts with the decompressed size(uint32, little endian).
+			if len(src) < 4 {
+				return dst, lz4.ErrCorrupt
+			}
+			size := binary.LittleEndian.Uint32(src)
+			if size > maxBlockSize {
+				return dst, ErrBlockTooLarge
+			}
+			return appendTo(dst, src, int(size), lz4.Decode)
+		},
+		false,
+	), nil
+}
+
+// appendTo appends the output of the fn to the dst, the size is the max size of the output.
+func appendTo(dst, src []byte, size int, fn func(dst, src []byte) ([]byte, error)) ([]byte, error) {
+	n := len(dst)
+	if cap(dst)-n < size {
+		grown := make([]byte, n, n+size)
+		copy(grown, dst)
+		dst = grown
+	}
+	out, err := fn(dst[n:n+size], src)
+	if err != nil {
+		return dst, err
+	}
+	return dst[:n+len(out)], nil
+}
+
+// gzipCodec is the gzip codec, the level is 1(best speed) to 9(best compression).
+type gzipCodec struct {
+	level   int
+	readers sync.Pool
+	writers sync.Pool
+}
+
+func newGzipCodec(level string) (Codec, error) {
+	c := &gzipCodec{level: gzip.DefaultCompression}
+	if level != "" {
+		n, err := strconv.Atoi(level)
+		if err != nil || n < gzip.BestSpeed || n > gzip.BestCompression {
+			return nil, fmt.Errorf("%w: gzip:%s", ErrBadLevel, level)
+		}
+		c.level = n
+	}
+	return c, nil
+}
+
+func (c *gzipCodec) NewReader(r io.Reader) Reader {
+	gr, _ := c.readers.Get().(*gzipReader)
+	if gr == nil {
+		gr = &gzipReader{codec: c}
+	}
+	gr.r = r
+	return gr
+}
+
+func (c *gzipCodec) NewWriter(w io.Writer) Writer {
+	gw, _ := c.writers.Get().(*gzipWriter)
+	if gw == nil {
+		zw, _ := gzip.NewWriterLevel(w, c.level) // The level is checked.
+		return &gzipWriter{Writer: zw, codec: c}
+	}
+	gw.Reset(w)
+	return gw
+}
+
+// gzipReader reads the header on the first Read.
+type gzipReader struct {
+	codec *gzipCodec
+	r     io.Reader
+	zr    *gzip.Reader
+	err   error
+}
+
+func (gr *gzipReader) Read(p []byte) (int, error) {
+	if gr.r != nil {
+		if gr.zr == nil {
+			gr.zr, gr.err = gzip.NewReader(gr.r)
+		} else {
+			gr.err = gr.zr.Reset(gr.r)
+		}
+		gr.r = nil
+	}
+	if gr.err != nil {
+		return 0, gr.err
+	}
+	return gr.zr.Read(p)
+}
+
+func (gr *gzipReader) Release() {
+	gr.r, gr.err = nil, nil
+	gr.codec.readers.Put(gr)
+}
+
+type gzipWriter struct {
+	*gzip.Writer
+	codec *gzipCodec
+}
+
+func (gw *gzipWriter) Release() {
+	gw.Reset(nil)
+	gw.codec.writers.Put(gw)
+}
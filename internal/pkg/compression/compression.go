@@ -0,0 +1,125 @@
+// Package compression is the registry of the stream compression methods which are
+// shared by the frontend and the backend. A method is named as "name[:level]" by the
+// "compression" in the URI, e.g. snappy, zstd:fastest, lz4 or gzip:6.
+package compression
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnknownMethod = errors.New("goodog/pkg/compression: unknown method")
+	ErrBadLevel      = errors.New("goodog/pkg/compression: bad level")
+)
+
+// Codec creates the readers and writers of a compression method, they are pooled.
+type Codec interface {
+	// NewReader returns a reader which decompresses the r, nothing is read from the
+	// r until the first Read, the peer may not write anything before it reads.
+	NewReader(r io.Reader) Reader
+	// NewWriter returns a writer which compresses into the w.
+	NewWriter(w io.Writer) Writer
+}
+
+// Reader is the decompressing reader, Release puts it back to the pool, it must not
+// be used after that.
+type Reader interface {
+	io.Reader
+	Release()
+}
+
+// Writer is the compressing writer, the data may be buffered until Flush, Release
+// puts it back to the pool, it must not be used after that.
+type Writer interface {
+	io.Writer
+	Flush() error
+	Release()
+}
+
+// Stats is the statistics of a Reader or a Writer, the block based ones implement
+// StatsReporter, the raw bytes are the uncompressed ones.
+type Stats struct {
+	RawBytes         uint64
+	WireBytes        uint64
+	StoredBlocks     uint64 // Sent uncompressed by the adaptive compression.
+	CompressedBlocks uint64
+}
+
+// StatsReporter reports the Stats since it is created.
+type StatsReporter interface {
+	Stats() Stats
+}
+
+// Factory creates the Codec with the level, the level is empty if it is not given.
+type Factory func(level string) (Codec, error)
+
+var (
+	_registryMu sync.Mutex
+	_factories  = map[string]Factory{}
+	_codecs     = map[string]Codec{} // By the methods.
+)
+
+// Register registers the Factory by the name, it panics if the name is taken.
+func Register(name string, factory Factory) {
+	_registryMu.Lock()
+	defer _registryMu.Unlock()
+	if _, ok := _factories[name]; ok {
+		panic("goodog/pkg/compression: duplicated method: " + name)
+	}
+	_factories[name] = factory
+}
+
+// Lookup returns the Codec of the method, nil is returned if the method is empty,
+// which means no compression. The Codecs are created once for each method, so the
+// readers and the writers are pooled by the methods.
+func Lookup(method string) (Codec, error) {
+	method = strings.ToLower(method)
+	if method == "" {
+		return nil, nil
+	}
+	name, level := method, ""
+	if i := strings.IndexByte(method, ':'); i >= 0 {
+		name, level = method[:i], method[i+1:]
+	}
+
+	_registryMu.Lock()
+	codec, ok := _codecs[method]
+	factory, registered := _factories[name]
+	_registryMu.Unlock()
+	if ok {
+		return codec, nil
+	}
+	if !registered {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMethod, method)
+	}
+	// The factory may look up the other methods.
+	codec, err := factory(level)
+	if err != nil {
+		return nil, err
+	}
+
+	_registryMu.Lock()
+	defer _registryMu.Unlock()
+	if existing, ok := _codecs[method]; ok { // Created concurrently.
+		return existing, nil
+	}
+	_codecs[method] = codec
+	return codec, nil
+}
+
+// Methods returns the sorted names of the registered methods.
+func Methods() []string {
+	_registryMu.Lock()
+	defer _registryMu.Unlock()
+	names := make([]string, 0, len(_factories))
+	for name := range _factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
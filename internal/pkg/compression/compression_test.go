@@ -0,0 +1,147 @@
+package compression
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecs(t *testing.T) {
+	data := make([]byte, 3*maxBlockSize+100)
+	rand.Read(data[:len(data)/2]) // Half of it is incompressible.
+
+	for _, method := range []string{"snappy", "zstd", "zstd:1", "zstd:fastest", "lz4", "gzip", "gzip:9",
+		"adaptive", "adaptive:lz4", "adaptive:zstd:fastest"} {
+		t.Run(method, func(t *testing.T) {
+			codec, err := Lookup(method)
+			require.Nil(t, err)
+			same, err := Lookup(method)
+			require.Nil(t, err)
+			require.True(t, codec == same)
+
+			for i := 0; i < 2; i++ { // Reuse the pooled ones.
+				buf := &bytes.Buffer{}
+				w := codec.NewWriter(buf)
+				for _, chunk := range [][]byte{data[:10], data[10:5000], data[5000:]} {
+					n, err := w.Write(chunk)
+					require.Nil(t, err)
+					require.Equal(t, len(chunk), n)
+					require.Nil(t, w.Flush())
+				}
+				w.Release()
+
+				r := codec.NewReader(buf)
+				got := make([]byte, len(data))
+				_, err = io.ReadFull(r, got)
+				require.Nil(t, err)
+				require.Equal(t, data, got)
+				r.Release()
+			}
+		})
+	}
+}
+
+// The data must be readable once it is flushed, the stream is not done yet.
+func TestFlush(t *testing.T) {
+	for _, method := range Methods() {
+		t.Run(method, func(t *testing.T) {
+			codec, err := Lookup(method)
+			require.Nil(t, err)
+			pr, pw := io.Pipe()
+			w := codec.NewWriter(pw)
+			r := codec.NewReader(pr)
+			done := make(chan struct{})
+			defer func() { // The writer may be still flushing.
+				pr.Close()
+				<-done
+				w.Release()
+				r.Release()
+			}()
+
+			go func() {
+				defer close(done)
+				_, _ = w.Write([]byte("hello"))
+				_ = w.Flush()
+			}()
+			got := make([]byte, 5)
+			_, err = io.ReadFull(r, got)
+			require.Nil(t, err)
+			require.Equal(t, "hello", string(got))
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	codec, err := Lookup("")
+	require.Nil(t, err)
+	require.Nil(t, codec)
+	codec, err = Lookup("SNAPPY")
+	require.Nil(t, err)
+	require.NotNil(t, codec)
+
+	_, err = Lookup("brotli")
+	require.True(t, errors.Is(err, ErrUnknownMethod))
+	for _, method := range []string{"snappy:1", "lz4:x", "zstd:x", "gzip:0", "gzip:10", "adaptive:gzip", "adaptive:adaptive"} {
+		_, err = Lookup(method)
+		require.True(t, errors.Is(err, ErrBadLevel), method)
+	}
+	require.Equal(t, []string{"adaptive", "gzip", "lz4", "snappy", "zstd"}, Methods())
+}
+
+func TestAdaptive(t *testing.T) {
+	codec, err := Lookup("adaptive")
+	require.Nil(t, err)
+	random := make([]byte, 1000)
+	zeros := make([]byte, 1000)
+
+	buf := &bytes.Buffer{}
+	w := codec.NewWriter(buf)
+	defer w.Release()
+	write := func(data []byte, times int) {
+		for i := 0; i < times; i++ {
+			rand.Read(random)
+			_, err := w.Write(data)
+			require.Nil(t, err)
+		}
+	}
+	stats := func() Stats { return w.(StatsReporter).Stats() }
+
+	write(zeros, 2)
+	require.Equal(t, Stats{RawBytes: 2000, WireBytes: stats().WireBytes, CompressedBlocks: 2}, stats())
+	require.True(t, stats().WireBytes < 200)
+	write(random, 1) // Tried.
+	write(zeros, minStoredBackoff)
+	require.Equal(t, uint64(1+minStoredBackoff), stats().StoredBlocks)
+	write(zeros, 1) // Tried again.
+	require.Equal(t, uint64(3), stats().CompressedBlocks)
+	write(random, 1)
+	write(random, minStoredBackoff)
+	write(random, 1) // The backoff doubles.
+	write(random, 2*minStoredBackoff)
+	require.Equal(t, uint64(3), stats().CompressedBlocks)
+	require.Equal(t, uint64(3+4*minStoredBackoff), stats().StoredBlocks)
+	wstats := stats()
+
+	r := codec.NewReader(buf)
+	defer r.Release()
+	_, err = io.Copy(ioutil.Discard, r)
+	require.Nil(t, err)
+	require.Equal(t, wstats, r.(StatsReporter).Stats())
+}
+
+func TestBadBlock(t *testing.T) {
+	codec, err := Lookup("lz4")
+	require.Nil(t, err)
+	r := codec.NewReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))
+	_, err = r.Read(make([]byte, 10))
+	require.Equal(t, ErrBlockTooLarge, err)
+
+	r = codec.NewReader(bytes.NewReader([]byte{0x00, 0x00, 0x00, 0x05, 0xff, 0xff, 0xff, 0x7f, 0x00}))
+	_, err = r.Read(make([]byte, 10))
+	require.Equal(t, ErrBlockTooLarge, err)
+}
@@ -0,0 +1,334 @@
+// Package metrics is a tiny metrics subsystem which is shared by the frontend and
+// the backend, it has the counters, the gauges and the histograms. They are exposed
+// in the Prometheus text format(https://prometheus.io/docs/instrumenting/exposition_formats/),
+// and every one of them is also an expvar.Var.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/atomic"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// Counter only goes up.
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Inc()
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Load() uint64 {
+	return c.v.Load()
+}
+
+func (c *Counter) String() string {
+	return strconv.FormatUint(c.v.Load(), 10)
+}
+
+// Gauge goes up and down.
+type Gauge struct {
+	v atomic.Int64
+}
+
+func (g *Gauge) Inc() {
+	g.v.Inc()
+}
+
+func (g *Gauge) Dec() {
+	g.v.Dec()
+}
+
+func (g *Gauge) Add(n int64) {
+	g.v.Add(n)
+}
+
+func (g *Gauge) Set(n int64) {
+	g.v.Store(n)
+}
+
+func (g *Gauge) Load() int64 {
+	return g.v.Load()
+}
+
+func (g *Gauge) String() string {
+	return strconv.FormatInt(g.v.Load(), 10)
+}
+
+// Histogram counts the observed values in the buckets, the upper bounds of the
+// buckets are inclusive, the +Inf one is implicit.
+type Histogram struct {
+	bounds []float64
+	counts []atomic.Uint64 // Not cumulative, the last one is the +Inf.
+	count  atomic.Uint64
+	sum    atomic.Uint64 // The bits of the float64.
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	bounds = append([]float64(nil), bounds...)
+	sort.Float64s(bounds)
+	return &Histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.counts[sort.SearchFloat64s(h.bounds, v)].Inc()
+	for {
+		old := h.sum.Load()
+		if h.sum.CAS(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			break
+		}
+	}
+	h.count.Inc()
+}
+
+// Count returns the number of the observed values.
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+// Sum returns the sum of the observed values.
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(h.sum.Load())
+}
+
+func (h *Histogram) String() string {
+	return fmt.Sprintf(`{"count": %d, "sum": %s}`, h.Count(), formatFloat(h.Sum()))
+}
+
+// LinearBuckets returns the count bounds which start from the start and are
+// separated by the width.
+func LinearBuckets(start, width float64, count int) []float64 {
+	bounds := make([]float64, count)
+	for i := range bounds {
+		bounds[i] = start + float64(i)*width
+	}
+	return bounds
+}
+
+// ExponentialBuckets returns the count bounds which start from the start, every
+// one of them is the factor times the previous one.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	bounds := make([]float64, count)
+	for i := range bounds {
+		bounds[i] = start
+		start *= factor
+	}
+	return bounds
+}
+
+// Registry registers the metrics by the names and the labels, the names are
+// prefixed by the namespace.
+type Registry struct {
+	namespace string
+
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     string
+	metrics map[string]interface{} // By the formatted labels.
+}
+
+func NewRegistry(namespace string) *Registry {
+	return &Registry{namespace: namespace, families: map[string]*family{}}
+}
+
+// Counter returns the counter of the name and the labels, the labels are the
+// pairs of the label names and the values. The existing one is returned if it
+// is registered already, the counters of a name must have the same label names.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return r.register(name+"_total", help, typeCounter, labels, func() interface{} {
+		return &Counter{}
+	}).(*Counter)
+}
+
+// Gauge is like the Counter.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return r.register(name, help, typeGauge, labels, func() interface{} {
+		return &Gauge{}
+	}).(*Gauge)
+}
+
+// Histogram is like the Counter, the buckets are the upper bounds, they are
+// ignored if it is registered already.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return r.register(name, help, typeHistogram, labels, func() interface{} {
+		return newHistogram(buckets)
+	}).(*Histogram)
+}
+
+func (r *Registry) register(name, help, typ string, labels []string, newMetric func() interface{}) interface{} {
+	if len(labels)%2 != 0 {
+		panic("goodog/pkg/metrics: odd number of labels: " + name)
+	}
+	if r.namespace != "" {
+		name = r.namespace + "_" + name
+	}
+	key := formatLabels(labels)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ, metrics: map[string]interface{}{}}
+		r.families[name] = f
+	} else if f.typ != typ {
+		panic(fmt.Sprintf("goodog/pkg/metrics: %s is a %s", name, f.typ))
+	}
+	m, ok := f.metrics[key]
+	if !ok {
+		m = newMetric()
+		f.metrics[key] = m
+	}
+	return m
+}
+
+// String returns the metrics as a JSON object, the keys are the names with the
+// labels, so that the Registry can be published by expvar.
+func (r *Registry) String() string {
+	r.mu.Lock()
+	keys := []string{}
+	values := map[string]string{}
+	for _, f := range r.families {
+		for labels, m := range f.metrics {
+			key := f.name + wrapLabels(labels)
+			keys = append(keys, key)
+			values[key] = m.(fmt.Stringer).String()
+		}
+	}
+	r.mu.Unlock()
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%q: %s", key, values[key])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = r.Write(w)
+}
+
+// Write writes the metrics in the Prometheus text format, they are sorted by the
+// names and the labels.
+func (r *Registry) Write(out io.Writer) error {
+	w := bufio.NewWriter(out)
+	r.mu.Lock()
+	families := make([]family, 0, len(r.families))
+	for _, f := range r.families {
+		metrics := make(map[string]interface{}, len(f.metrics))
+		for key, m := range f.metrics {
+			metrics[key] = m
+		}
+		families = append(families, family{name: f.name, help: f.help, typ: f.typ, metrics: metrics})
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	for _, f := range families {
+		if f.help != "" {
+			fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+		keys := make([]string, 0, len(f.metrics))
+		for key := range f.metrics {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			switch m := f.metrics[key].(type) {
+			case *Counter, *Gauge:
+				fmt.Fprintf(w, "%s%s %v\n", f.name, wrapLabels(key), m)
+			case *Histogram:
+				writeHistogram(w, f.name, key, m)
+			}
+		}
+	}
+	return w.Flush()
+}
+
+func writeHistogram(w *bufio.Writer, name, labels string, h *Histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	// The sum may be a little behind the buckets, it does not matter.
+	cumulative := uint64(0)
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{%s%sle=%q} %d\n", name, labels, sep, formatFloat(bound), cumulative)
+	}
+	cumulative += h.counts[len(h.bounds)].Load()
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, cumulative)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, wrapLabels(labels), formatFloat(h.Sum()))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, wrapLabels(labels), cumulative)
+}
+
+func formatLabels(labels []string) string {
+	var b strings.Builder
+	for i := 0; i < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(labels[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func escapeHelp(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	_ expvar.Var = &Counter{}
+	_ expvar.Var = &Gauge{}
+	_ expvar.Var = &Histogram{}
+	_ expvar.Var = &Registry{}
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry("test")
+	c := r.Counter("errors", "The \"errors\".\n", "kind", "tls")
+	c.Add(3)
+	require.True(t, c == r.Counter("errors", "", "kind", "tls"))
+	r.Counter("errors", "", "kind", `a"b\c`).Inc()
+	g := r.Gauge("conns", "", "server", "a.com")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	r.Gauge("conns", "", "server", "b.com").Set(-2)
+	h := r.Histogram("latency", "The latency.", []float64{1, 0.1})
+	for _, v := range []float64{0.05, 0.1, 0.5, 2} {
+		h.Observe(v)
+	}
+	require.Equal(t, uint64(4), h.Count())
+	require.Equal(t, 2.65, h.Sum())
+	require.Equal(t, `{"count": 4, "sum": 2.65}`, h.String())
+	require.Panics(t, func() { r.Gauge("latency", "") })
+	require.Panics(t, func() { r.Gauge("conns", "", "server") })
+
+	buf := &bytes.Buffer{}
+	require.Nil(t, r.Write(buf))
+	require.Equal(t, `# TYPE test_conns gauge
+test_conns{server="a.com"} 1
+test_conns{server="b.com"} -2
+# HELP test_errors_total The "errors".\n
+# TYPE test_errors_total counter
+test_errors_total{kind="a\"b\\c"} 1
+test_errors_total{kind="tls"} 3
+# HELP test_latency The latency.
+# TYPE test_latency histogram
+test_latency_bucket{le="0.1"} 2
+test_latency_bucket{le="1"} 3
+test_latency_bucket{le="+Inf"} 4
+test_latency_sum 2.65
+test_latency_count 4
+`, buf.String())
+
+	var vars map[string]interface{}
+	require.Nil(t, json.Unmarshal([]byte(r.String()), &vars))
+	require.Equal(t, map[string]interface{}{
+		`test_conns{server="a.com"}`:        1.0,
+		`test_conns{server="b.com"}`:        -2.0,
+		`test_errors_total{kind="a\"b\\c"}`: 1.0,
+		`test_errors_total{kind="tls"}`:     3.0,
+		`test_latency`:                      map[string]interface{}{"count": 4.0, "sum": 2.65},
+	}, vars)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	require.Equal(t, buf.String(), rec.Body.String())
+}
+
+func TestBuckets(t *testing.T) {
+	require.Equal(t, []float64{1, 3, 5}, LinearBuckets(1, 2, 3))
+	require.Equal(t, []float64{1, 2, 4, 8}, ExponentialBuckets(1, 2, 4))
+}
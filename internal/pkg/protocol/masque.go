@@ -0,0 +1,282 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// MASQUE CONNECT-UDP(RFC 9298), the UDP packets are carried by the DATAGRAM
+// capsules(RFC 9297) in the stream, since the HTTP datagrams are unavailable.
+const (
+	// MASQUEUpgradeToken is the upgrade token of HTTP/1.1 and the :protocol of the extended CONNECT.
+	MASQUEUpgradeToken = "connect-udp"
+	// MASQUEDefaultTemplate is the default URI template of the targets.
+	MASQUEDefaultTemplate = "/.well-known/masque/udp/{target_host}/{target_port}/"
+	// CapsuleDatagram is the type of the DATAGRAM capsule.
+	CapsuleDatagram = 0x00
+
+	maxVarint = 1<<62 - 1
+)
+
+var (
+	ErrVarintTooLarge      = errors.New("goodog/pkg/protocol: varint too large")
+	ErrBadMASQUETarget     = errors.New("goodog/pkg/protocol: bad MASQUE target")
+	ErrUnsupportedTemplate = errors.New("goodog/pkg/protocol: unsupported URI template")
+)
+
+// AppendVarint appends the variable-length integer of QUIC(RFC 9000).
+func AppendVarint(b []byte, v uint64) ([]byte, error) {
+	switch {
+	case v <= 63:
+		return append(b, byte(v)), nil
+	case v <= 16383:
+		return append(b, byte(v>>8)|0x40, byte(v)), nil
+	case v <= 1073741823:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v)), nil
+	case v <= maxVarint:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v)), nil
+	default:
+		return b, ErrVarintTooLarge
+	}
+}
+
+// ReadVarint reads the variable-length integer of QUIC(RFC 9000).
+func ReadVarint(r io.Reader) (uint64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return 0, err
+	}
+	n := 1 << (b[0] >> 6)
+	b[0] &= 0x3f
+	if n > 1 {
+		if _, err := io.ReadFull(r, b[1:n]); err != nil {
+			return 0, noEOF(err)
+		}
+	}
+	v := uint64(0)
+	for _, c := range b[:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// AppendUDPCapsule appends a DATAGRAM capsule which carries the UDP payload
+// in the context 0:
+//
+//	| type(varint) | length(varint) | context id(varint, 0) | payload |
+func AppendUDPCapsule(b []byte, payload []byte) []byte {
+	b, _ = AppendVarint(b, CapsuleDatagram)
+	b, _ = AppendVarint(b, uint64(len(payload)+1))
+	b = append(b, 0x00)
+	return append(b, payload...)
+}
+
+// ReadUDPCapsule reads the UDP payload of the next DATAGRAM capsule into the buf, the
+// other capsules, the other contexts and the payloads larger than the buf are skipped.
+func ReadUDPCapsule(r io.Reader, buf []byte) (int, error) {
+	for {
+		typ, err := ReadVarint(r)
+		if err != nil {
+			return 0, err
+		}
+		length, err := ReadVarint(r)
+		if err != nil {
+			return 0, noEOF(err)
+		}
+		if length > maxVarint {
+			return 0, ErrVarintTooLarge
+		}
+		lr := &io.LimitedReader{R: r, N: int64(length)}
+		if typ == CapsuleDatagram && length > 0 {
+			contextID, err := ReadVarint(lr)
+			if err != nil {
+				return 0, noEOF(err)
+			}
+			if n := int(lr.N); contextID == 0 && lr.N <= int64(len(buf)) {
+				if _, err := io.ReadFull(lr, buf[:n]); err != nil {
+					return 0, noEOF(err)
+				}
+				return n, nil
+			}
+		}
+		if _, err := io.Copy(ioutil.Discard, lr); err != nil {
+			return 0, err
+		}
+		if lr.N > 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ExpandMASQUETemplate expands the URI template(RFC 6570) with the target, the
+// simple string expansion({target_host}) and the form-style query expansion
+// ({?target_host,target_port}) are supported.
+func ExpandMASQUETemplate(template string, host string, port uint16) (string, error) {
+	values := map[string]string{
+		"target_host": host,
+		"target_port": strconv.Itoa(int(port)),
+	}
+	var sb strings.Builder
+	for {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			sb.WriteString(template)
+			return sb.String(), nil
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return "", ErrUnsupportedTemplate
+		}
+		end += start
+		sb.WriteString(template[:start])
+		expr := template[start+1 : end]
+		template = template[end+1:]
+
+		op := byte(0)
+		if expr != "" && (expr[0] == '?' || expr[0] == '&') {
+			op, expr = expr[0], expr[1:]
+		}
+		for i, name := range strings.Split(expr, ",") {
+			value, ok := values[name]
+			if !ok {
+				return "", fmt.Errorf("%w: %s", ErrUnsupportedTemplate, name)
+			}
+			switch {
+			case op == 0 && i > 0:
+				sb.WriteByte(',')
+			case op == '?' && i == 0:
+				sb.WriteByte('?')
+			case op != 0:
+				sb.WriteByte('&')
+			}
+			if op != 0 {
+				sb.WriteString(name)
+				sb.WriteByte('=')
+			}
+			sb.WriteString(escapeUnreserved(value))
+		}
+	}
+}
+
+// MatchMASQUETemplate extracts the target from the URI by the template, the scheme and
+// the authority of the template are ignored. The variables must be whole path segments,
+// query values(e.g. ?h={target_host}) or the form-style query expansions.
+func MatchMASQUETemplate(template string, u *url.URL) (*Addr, error) {
+	if i := strings.Index(template, "://"); i >= 0 {
+		template = template[i+3:]
+		if j := strings.IndexAny(template, "/?{"); j >= 0 {
+			template = template[j:]
+		} else {
+			template = "/"
+		}
+	}
+
+	values := map[string]string{}
+	query := u.Query()
+	// The form-style query expansions.
+	for {
+		start := strings.Index(template, "{?")
+		if start < 0 {
+			start = strings.Index(template, "{&")
+		}
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return nil, ErrUnsupportedTemplate
+		}
+		end += start
+		for _, name := range strings.Split(template[start+2:end], ",") {
+			values[name] = query.Get(name)
+		}
+		template = template[:start] + template[end+1:]
+	}
+
+	pathTemplate, queryTemplate := template, ""
+	if i := strings.IndexByte(template, '?'); i >= 0 {
+		pathTemplate, queryTemplate = template[:i], template[i+1:]
+	}
+	segments, templateSegments := strings.Split(u.EscapedPath(), "/"), strings.Split(pathTemplate, "/")
+	if len(segments) != len(templateSegments) {
+		return nil, ErrBadMASQUETarget
+	}
+	for i, seg := range templateSegments {
+		if name, ok := templateVar(seg); ok {
+			value, err := url.PathUnescape(segments[i])
+			if err != nil {
+				return nil, ErrBadMASQUETarget
+			}
+			values[name] = value
+		} else if strings.ContainsAny(seg, "{}") {
+			return nil, ErrUnsupportedTemplate
+		} else if seg != segments[i] {
+			return nil, ErrBadMASQUETarget
+		}
+	}
+	for _, pair := range strings.Split(queryTemplate, "&") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if name, ok := templateVar(kv[1]); ok {
+			values[name] = query.Get(kv[0])
+		} else if query.Get(kv[0]) != kv[1] {
+			return nil, ErrBadMASQUETarget
+		}
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(values["target_host"], "["), "]")
+	port, err := strconv.ParseUint(values["target_port"], 10, 16)
+	if host == "" || err != nil || port == 0 {
+		return nil, ErrBadMASQUETarget
+	}
+	if ip := net.ParseIP(host); ip == nil && len(host) > 255 {
+		return nil, ErrBadMASQUETarget
+	}
+	return &Addr{Network: "udp", Host: host, Port: uint16(port)}, nil
+}
+
+func templateVar(s string) (string, bool) {
+	if len(s) < 3 || s[0] != '{' || s[len(s)-1] != '}' {
+		return "", false
+	}
+	name := s[1 : len(s)-1]
+	if name != "target_host" && name != "target_port" {
+		return "", false
+	}
+	return name, true
+}
+
+// escapeUnreserved percent-encodes everything except the unreserved characters,
+// e.g. the colons of the IPv6 addresses.
+func escapeUnreserved(s string) string {
+	const hex = "0123456789ABCDEF"
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteByte('%')
+		sb.WriteByte(hex[c>>4])
+		sb.WriteByte(hex[c&0x0f])
+	}
+	return sb.String()
+}
@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVarint(t *testing.T) {
+	for _, v := range []uint64{0, 63, 64, 16383, 16384, 1073741823, 1073741824, maxVarint} {
+		b, err := AppendVarint(nil, v)
+		require.Nil(t, err)
+		got, err := ReadVarint(bytes.NewReader(b))
+		require.Nil(t, err)
+		require.Equal(t, v, got)
+	}
+	_, err := AppendVarint(nil, maxVarint+1)
+	require.Equal(t, ErrVarintTooLarge, err)
+	// Ref: RFC 9000, A.1
+	v, err := ReadVarint(bytes.NewReader([]byte{0x7b, 0xbd}))
+	require.Nil(t, err)
+	require.Equal(t, uint64(15293), v)
+}
+
+func TestUDPCapsule(t *testing.T) {
+	b := AppendUDPCapsule(nil, []byte("first"))
+	b = append(b, 0x17, 0x02, 0xff, 0xff)     // Unknown capsule.
+	b = append(b, 0x00, 0x03, 0x01, 'x', 'x') // Other context.
+	b = AppendUDPCapsule(b, []byte("large"))  // Larger than the buf.
+	b = AppendUDPCapsule(b, []byte("last"))
+
+	r := bytes.NewReader(b)
+	buf := make([]byte, 5)
+	n, err := ReadUDPCapsule(r, buf)
+	require.Nil(t, err)
+	require.Equal(t, "first", string(buf[:n]))
+	n, err = ReadUDPCapsule(r, buf[:4])
+	require.Nil(t, err)
+	require.Equal(t, "last", string(buf[:n]))
+	_, err = ReadUDPCapsule(r, buf)
+	require.Equal(t, io.EOF, err)
+
+	_, err = ReadUDPCapsule(bytes.NewReader(AppendUDPCapsule(nil, []byte("data"))[:4]), buf)
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestMASQUETemplate(t *testing.T) {
+	for _, c := range []struct {
+		template string
+		host     string
+		expanded string
+	}{
+		{MASQUEDefaultTemplate, "192.0.2.6", "/.well-known/masque/udp/192.0.2.6/443/"},
+		{MASQUEDefaultTemplate, "2001:db8::42", "/.well-known/masque/udp/2001%3Adb8%3A%3A42/443/"},
+		{"https://proxy.x.io/masque?h={target_host}&p={target_port}", "goodog.x.io",
+			"https://proxy.x.io/masque?h=goodog.x.io&p=443"},
+		{"https://proxy.x.io:4443/masque{?target_host,target_port}", "goodog.x.io",
+			"https://proxy.x.io:4443/masque?target_host=goodog.x.io&target_port=443"},
+	} {
+		expanded, err := ExpandMASQUETemplate(c.template, c.host, 443)
+		require.Nil(t, err)
+		require.Equal(t, c.expanded, expanded)
+
+		u, err := url.Parse(expanded)
+		require.Nil(t, err)
+		addr, err := MatchMASQUETemplate(c.template, u)
+		require.Nil(t, err)
+		require.Equal(t, &Addr{Network: "udp", Host: c.host, Port: 443}, addr)
+	}
+
+	_, err := ExpandMASQUETemplate("/{unknown}", "x", 1)
+	require.NotNil(t, err)
+	for _, uri := range []string{
+		"/.well-known/masque/udp/192.0.2.6/",
+		"/.well-known/masque/udp/192.0.2.6/0/",
+		"/.well-known/masque/tcp/192.0.2.6/443/",
+	} {
+		u, err := url.Parse(uri)
+		require.Nil(t, err)
+		_, err = MatchMASQUETemplate(MASQUEDefaultTemplate, u)
+		require.Equal(t, ErrBadMASQUETarget, err)
+	}
+}
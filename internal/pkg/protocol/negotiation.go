@@ -0,0 +1,42 @@
+package protocol
+
+import (
+	"sort"
+	"strings"
+)
+
+// The headers of the negotiation, the backend responds with them before streaming, so
+// that the frontend can tell if the two sides agree with each other. The older
+// backends respond without them.
+const (
+	HeaderVersion     = "Goodog-Version"     // The accepted protocol version.
+	HeaderCompression = "Goodog-Compression" // The accepted compression, CompressionNone if there is none.
+	HeaderFeatures    = "Goodog-Features"    // The features of the backend, see Features.
+
+	CompressionNone = "none"
+)
+
+// Features formats the features of the backend, they are separated by comma, e.g.
+// "compression=snappy,masque,mux=packet,mux=yamux,ping".
+func Features(masque bool, compressions []string) string {
+	features := []string{"mux=" + MuxYamux, "mux=" + MuxPacket, "ping"}
+	if masque {
+		features = append(features, "masque")
+	}
+	for _, name := range compressions {
+		features = append(features, "compression="+name)
+	}
+	sort.Strings(features)
+	return strings.Join(features, ",")
+}
+
+// ParseFeatures parses the features formatted by Features.
+func ParseFeatures(s string) map[string]bool {
+	features := map[string]bool{}
+	for _, feature := range strings.Split(s, ",") {
+		if feature = strings.TrimSpace(feature); feature != "" {
+			features[feature] = true
+		}
+	}
+	return features
+}
@@ -0,0 +1,299 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"strconv"
+
+	"github.com/hashicorp/yamux"
+
+	"github.com/damnever/goodog/internal/pkg/encoding"
+)
+
+// Protocol versions:
+//   - v1: the backend forwards everything to the upstream configured in it.
+//   - v2: the request body starts with a preamble which carries the destination,
+//     the backend dials the destination.
+const (
+	V1 = "v1"
+	V2 = "v2"
+)
+
+// Mux modes, it is the value of the query "mux":
+//   - yamux: the TCP streams are multiplexed by yamux over a single stream,
+//     every sub-stream starts with the preamble in v2, then the backend writes
+//     a status(the same as the HTTP status code) into it.
+//   - packet: the UDP packets of many peers are multiplexed over a single stream,
+//     see AppendPacket, the src of a packet identifies a session, the backend
+//     keeps an upstream socket for every session until it is idle.
+const (
+	MuxYamux  = "yamux"
+	MuxPacket = "packet"
+)
+
+// Address types, they are the same as SOCKS5.
+const (
+	AddrTypeIPv4   byte = 0x01
+	AddrTypeDomain byte = 0x03
+	AddrTypeIPv6   byte = 0x04
+)
+
+// Networks in the preamble.
+const (
+	NetworkTCP byte = 0x01
+	NetworkUDP byte = 0x02
+)
+
+// MaxPreambleSize is the maximum size of a preamble, the size field excluded.
+const MaxPreambleSize = 1024
+
+var (
+	ErrBadAddrType    = errors.New("goodog/pkg/protocol: bad address type")
+	ErrBadNetwork     = errors.New("goodog/pkg/protocol: bad network")
+	ErrBadPreamble    = errors.New("goodog/pkg/protocol: bad preamble")
+	ErrDomainTooLong  = errors.New("goodog/pkg/protocol: domain too long")
+	ErrPacketTooLarge = errors.New("goodog/pkg/protocol: packet too large")
+)
+
+// Addr is a destination address, the Host is either an IP or a domain.
+type Addr struct {
+	Network string // tcp or udp
+	Host    string
+	Port    uint16
+}
+
+// ParseAddr parses the "host:port" into Addr.
+func ParseAddr(network, hostport string) (*Addr, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("goodog/pkg/protocol: bad port: %s", portStr)
+	}
+	return &Addr{Network: network, Host: host, Port: uint16(port)}, nil
+}
+
+// AddrFromNetAddr converts *net.TCPAddr and *net.UDPAddr into Addr.
+func AddrFromNetAddr(addr net.Addr) (*Addr, error) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return &Addr{Network: "tcp", Host: a.IP.String(), Port: uint16(a.Port)}, nil
+	case *net.UDPAddr:
+		return &Addr{Network: "udp", Host: a.IP.String(), Port: uint16(a.Port)}, nil
+	default:
+		return ParseAddr(addr.Network(), addr.String())
+	}
+}
+
+func (a *Addr) String() string {
+	return net.JoinHostPort(a.Host, strconv.Itoa(int(a.Port)))
+}
+
+// Type returns the address type of the host.
+func (a *Addr) Type() byte {
+	if ip := net.ParseIP(a.Host); ip != nil {
+		if ip.To4() != nil {
+			return AddrTypeIPv4
+		}
+		return AddrTypeIPv6
+	}
+	return AddrTypeDomain
+}
+
+// AppendAddr appends the address in SOCKS5 format: | atyp | addr | port |,
+// the domain is prefixed with an one byte length.
+func AppendAddr(b []byte, a *Addr) ([]byte, error) {
+	atyp := a.Type()
+	b = append(b, atyp)
+	switch atyp {
+	case AddrTypeIPv4:
+		b = append(b, net.ParseIP(a.Host).To4()...)
+	case AddrTypeIPv6:
+		b = append(b, net.ParseIP(a.Host).To16()...)
+	default:
+		if len(a.Host) > 255 {
+			return nil, ErrDomainTooLong
+		}
+		b = append(b, byte(len(a.Host)))
+		b = append(b, a.Host...)
+	}
+	return append(b, byte(a.Port>>8), byte(a.Port)), nil
+}
+
+// ReadAddr reads the address which is in SOCKS5 format.
+func ReadAddr(r io.Reader, network string) (*Addr, error) {
+	var buf [255]byte
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return nil, err
+	}
+	atyp := buf[0]
+	var size int
+	switch atyp {
+	case AddrTypeIPv4:
+		size = net.IPv4len
+	case AddrTypeIPv6:
+		size = net.IPv6len
+	case AddrTypeDomain:
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return nil, err
+		}
+		size = int(buf[0])
+		if size == 0 {
+			return nil, ErrBadAddrType
+		}
+	default:
+		return nil, ErrBadAddrType
+	}
+	if _, err := io.ReadFull(r, buf[:size]); err != nil {
+		return nil, err
+	}
+	a := &Addr{Network: network}
+	if atyp == AddrTypeDomain {
+		a.Host = string(buf[:size])
+	} else {
+		a.Host = net.IP(append([]byte(nil), buf[:size]...)).String()
+	}
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return nil, err
+	}
+	a.Port = binary.BigEndian.Uint16(buf[:2])
+	return a, nil
+}
+
+// The preamble(big endian):
+//   | size(2) | network(1) | atyp(1) | addr(variable) | port(2) |
+// The size excludes itself, so that the unknown trailing fields can be skipped.
+
+// AppendPreamble appends the preamble of protocol v2.
+func AppendPreamble(b []byte, a *Addr) ([]byte, error) {
+	var network byte
+	switch a.Network {
+	case "tcp":
+		network = NetworkTCP
+	case "udp":
+		network = NetworkUDP
+	default:
+		return nil, ErrBadNetwork
+	}
+	start := len(b)
+	b = append(b, 0, 0, network)
+	b, err := AppendAddr(b, a)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(b[start:], uint16(len(b)-start-2))
+	return b, nil
+}
+
+// ReadPreamble reads the preamble of protocol v2.
+func ReadPreamble(r io.Reader) (*Addr, error) {
+	var sizeb [2]byte
+	if _, err := io.ReadFull(r, sizeb[:]); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint16(sizeb[:]))
+	if size < 1+1+1+2 || size > MaxPreambleSize {
+		return nil, ErrBadPreamble
+	}
+	lr := &io.LimitedReader{R: r, N: int64(size)}
+
+	var networkb [1]byte
+	if _, err := io.ReadFull(lr, networkb[:]); err != nil {
+		return nil, err
+	}
+	var network string
+	switch networkb[0] {
+	case NetworkTCP:
+		network = "tcp"
+	case NetworkUDP:
+		network = "udp"
+	default:
+		return nil, ErrBadNetwork
+	}
+	a, err := ReadAddr(lr, network)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrBadPreamble
+		}
+		return nil, err
+	}
+	if lr.N > 0 { // Skip the unknown fields.
+		if _, err := io.Copy(ioutil.Discard, lr); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// WriteStatus writes the status of a sub-stream: | status(2) |
+func WriteStatus(w io.Writer, status uint16) error {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], status)
+	_, err := w.Write(b[:])
+	return err
+}
+
+// ReadStatus reads the status of a sub-stream.
+func ReadStatus(r io.Reader) (uint16, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b[:]), nil
+}
+
+// NewYamuxConfig returns the yamux config shared by the frontend and the backend.
+func NewYamuxConfig() *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.LogOutput = ioutil.Discard
+	// The streams of HTTP/3 are flow controlled as well, but the window of
+	// a sub-stream should be large enough to saturate the link.
+	config.MaxStreamWindowSize = 1 << 20
+	return config
+}
+
+// The packet of MuxPacket(big endian):
+//   v1: | src | size(2) | data |
+//   v2: | src | dst | size(2) | data |
+// The src and dst are in SOCKS5 format, the dst of the packets from the backend
+// is the one they reply to.
+
+// AppendPacket appends the packet of MuxPacket, the dst is omitted if it is nil.
+func AppendPacket(b []byte, src, dst *Addr, data []byte) ([]byte, error) {
+	if len(data) > math.MaxUint16 {
+		return nil, ErrPacketTooLarge
+	}
+	b, err := AppendAddr(b, src)
+	if err != nil {
+		return nil, err
+	}
+	if dst != nil {
+		if b, err = AppendAddr(b, dst); err != nil {
+			return nil, err
+		}
+	}
+	b = append(b, byte(len(data)>>8), byte(len(data)))
+	return append(b, data...), nil
+}
+
+// ReadPacket reads the packet of MuxPacket, the data is read into the buf
+// which must be large enough(math.MaxUint16), the dst is read if withDst is true.
+func ReadPacket(r io.Reader, withDst bool, buf []byte) (src, dst *Addr, n int, err error) {
+	if src, err = ReadAddr(r, "udp"); err != nil {
+		return
+	}
+	if withDst {
+		if dst, err = ReadAddr(r, "udp"); err != nil {
+			return
+		}
+	}
+	n, err = encoding.ReadU16SizedBytes(r, buf)
+	return
+}
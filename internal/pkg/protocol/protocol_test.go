@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddr(t *testing.T) {
+	for _, addr := range []*Addr{
+		{Network: "tcp", Host: "127.0.0.1", Port: 80},
+		{Network: "udp", Host: "::1", Port: 53},
+		{Network: "tcp", Host: "goodog.x.io", Port: 443},
+	} {
+		b, err := AppendAddr(nil, addr)
+		require.Nil(t, err)
+		b = append(b, "data"...)
+
+		r := bytes.NewReader(b)
+		got, err := ReadAddr(r, addr.Network)
+		require.Nil(t, err)
+		require.Equal(t, addr, got)
+		require.Equal(t, 4, r.Len())
+	}
+
+	_, err := ReadAddr(bytes.NewReader([]byte{0x09, 1, 2, 3, 4}), "tcp")
+	require.Equal(t, ErrBadAddrType, err)
+	_, err = ReadAddr(bytes.NewReader([]byte{AddrTypeDomain, 0x00, 0x00, 0x50}), "tcp")
+	require.Equal(t, ErrBadAddrType, err)
+}
+
+func TestPreamble(t *testing.T) {
+	for _, addr := range []*Addr{
+		{Network: "tcp", Host: "127.0.0.1", Port: 80},
+		{Network: "udp", Host: "::1", Port: 53},
+		{Network: "tcp", Host: "goodog.x.io", Port: 443},
+	} {
+		b, err := AppendPreamble(nil, addr)
+		require.Nil(t, err)
+		b = append(b, "data"...)
+
+		r := bytes.NewReader(b)
+		got, err := ReadPreamble(r)
+		require.Nil(t, err)
+		require.Equal(t, addr, got)
+		require.Equal(t, 4, r.Len())
+	}
+}
+
+func TestPreambleUnknownFields(t *testing.T) {
+	b, err := AppendPreamble(nil, &Addr{Network: "tcp", Host: "1.2.3.4", Port: 8080})
+	require.Nil(t, err)
+	b = append(b, 0xff, 0xff)
+	b[1] += 2
+	b = append(b, "data"...)
+
+	r := bytes.NewReader(b)
+	got, err := ReadPreamble(r)
+	require.Nil(t, err)
+	require.Equal(t, "1.2.3.4:8080", got.String())
+	require.Equal(t, 4, r.Len())
+}
+
+func TestBadPreamble(t *testing.T) {
+	_, err := AppendPreamble(nil, &Addr{Network: "ip", Host: "1.2.3.4", Port: 80})
+	require.Equal(t, ErrBadNetwork, err)
+	_, err = AppendPreamble(nil, &Addr{Network: "tcp", Host: strings.Repeat("x", 256), Port: 80})
+	require.Equal(t, ErrDomainTooLong, err)
+
+	_, err = ReadPreamble(bytes.NewReader([]byte{0x00, 0x01, NetworkTCP}))
+	require.Equal(t, ErrBadPreamble, err)
+	_, err = ReadPreamble(bytes.NewReader([]byte{0x00, 0x05, 0x09, AddrTypeIPv4, 1, 2, 3}))
+	require.Equal(t, ErrBadNetwork, err)
+	_, err = ReadPreamble(bytes.NewReader([]byte{0x00, 0x05, NetworkTCP, 0x09, 1, 2, 3}))
+	require.Equal(t, ErrBadAddrType, err)
+	_, err = ReadPreamble(bytes.NewReader([]byte{0x00, 0x06, NetworkTCP, AddrTypeIPv4, 1, 2, 3, 4}))
+	require.Equal(t, ErrBadPreamble, err)
+}
+
+func TestStatus(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.Nil(t, WriteStatus(buf, 403))
+	require.Equal(t, []byte{0x01, 0x93}, buf.Bytes())
+	status, err := ReadStatus(buf)
+	require.Nil(t, err)
+	require.Equal(t, uint16(403), status)
+	_, err = ReadStatus(buf)
+	require.NotNil(t, err)
+}
+
+func TestPacket(t *testing.T) {
+	src := &Addr{Network: "udp", Host: "1.2.3.4", Port: 5353}
+	dst := &Addr{Network: "udp", Host: "example.com", Port: 53}
+	b, err := AppendPacket(nil, src, dst, []byte("v2"))
+	require.Nil(t, err)
+	b, err = AppendPacket(b, src, nil, []byte("v1"))
+	require.Nil(t, err)
+
+	r := bytes.NewReader(b)
+	buf := make([]byte, 1<<16)
+	gotSrc, gotDst, n, err := ReadPacket(r, true, buf)
+	require.Nil(t, err)
+	require.Equal(t, src, gotSrc)
+	require.Equal(t, dst, gotDst)
+	require.Equal(t, "v2", string(buf[:n]))
+	gotSrc, gotDst, n, err = ReadPacket(r, false, buf)
+	require.Nil(t, err)
+	require.Equal(t, src, gotSrc)
+	require.Nil(t, gotDst)
+	require.Equal(t, "v1", string(buf[:n]))
+	require.Equal(t, 0, r.Len())
+
+	_, err = AppendPacket(nil, src, nil, make([]byte, 1<<16))
+	require.Equal(t, ErrPacketTooLarge, err)
+}
+
+func TestFeatures(t *testing.T) {
+	s := Features(true, []string{"zstd", "snappy"})
+	require.Equal(t, "compression=snappy,compression=zstd,masque,mux=packet,mux=yamux,ping", s)
+	features := ParseFeatures(s + ", x ,")
+	require.Len(t, features, 7)
+	require.True(t, features["x"])
+	require.True(t, features["compression=zstd"])
+	require.False(t, ParseFeatures(Features(false, nil))["masque"])
+	require.Len(t, ParseFeatures(""), 0)
+}
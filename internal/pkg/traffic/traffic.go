@@ -0,0 +1,171 @@
+// Package traffic accounts the bytes and the packets of the sessions in both
+// directions, they are aggregated by the protocols as well. It is shared by the
+// frontend and the backend.
+package traffic
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+
+	"github.com/damnever/goodog/internal/pkg/metrics"
+)
+
+// Direction is the direction of the traffic, Up is from the client to the
+// upstream, Down is the opposite.
+type Direction int
+
+const (
+	Up Direction = iota
+	Down
+)
+
+func (d Direction) String() string {
+	if d == Up {
+		return "up"
+	}
+	return "down"
+}
+
+// Counters aggregates the sessions of a protocol.
+type Counters struct {
+	Sessions    *metrics.Counter
+	Active      *metrics.Gauge
+	BytesUp     *metrics.Counter
+	BytesDown   *metrics.Counter
+	PacketsUp   *metrics.Counter
+	PacketsDown *metrics.Counter
+}
+
+// Stats is the statistics of a session.
+type Stats struct {
+	Protocol    string
+	Duration    time.Duration
+	BytesUp     uint64
+	BytesDown   uint64
+	PacketsUp   uint64 // Zero for the stream protocols.
+	PacketsDown uint64
+	CloseReason string // Empty if it is not closed.
+}
+
+// Fields returns the log fields of the stats.
+func (s Stats) Fields() []zap.Field {
+	fields := []zap.Field{
+		zap.String("protocol", s.Protocol),
+		zap.Duration("duration", s.Duration),
+		zap.Uint64("bytes_up", s.BytesUp),
+		zap.Uint64("bytes_down", s.BytesDown),
+	}
+	if s.PacketsUp > 0 || s.PacketsDown > 0 {
+		fields = append(fields, zap.Uint64("packets_up", s.PacketsUp), zap.Uint64("packets_down", s.PacketsDown))
+	}
+	if s.CloseReason != "" {
+		fields = append(fields, zap.String("close_reason", s.CloseReason))
+	}
+	return fields
+}
+
+// Session accounts the traffic of a session, it can be used concurrently.
+type Session struct {
+	protocol string
+	start    time.Time
+	counters *Counters
+
+	bytes       [2]atomic.Uint64 // By the Direction.
+	packets     [2]atomic.Uint64
+	closed      atomic.Bool
+	mu          sync.Mutex
+	closeReason string
+}
+
+// NewSession starts a session of the protocol, the traffic is added to the counters,
+// it is active until it is closed.
+func NewSession(protocol string, counters *Counters) *Session {
+	counters.Sessions.Inc()
+	counters.Active.Inc()
+	return &Session{protocol: protocol, start: time.Now(), counters: counters}
+}
+
+// Start returns when the session starts.
+func (s *Session) Start() time.Time {
+	return s.start
+}
+
+// Add adds the bytes of the streams.
+func (s *Session) Add(d Direction, bytes int) {
+	s.bytes[d].Add(uint64(bytes))
+	if d == Up {
+		s.counters.BytesUp.Add(uint64(bytes))
+	} else {
+		s.counters.BytesDown.Add(uint64(bytes))
+	}
+}
+
+// AddPacket adds a packet and the bytes of it.
+func (s *Session) AddPacket(d Direction, bytes int) {
+	s.Add(d, bytes)
+	s.packets[d].Inc()
+	if d == Up {
+		s.counters.PacketsUp.Inc()
+	} else {
+		s.counters.PacketsDown.Inc()
+	}
+}
+
+// Writer returns a writer which adds the bytes written to the w.
+func (s *Session) Writer(d Direction, w io.Writer) io.Writer {
+	return &countingWriter{w: w, session: s, direction: d}
+}
+
+// SetCloseReason sets why the session is closed if it is not set yet, it is
+// useful if the reason is known before the session is done.
+func (s *Session) SetCloseReason(reason string) {
+	s.mu.Lock()
+	if s.closeReason == "" {
+		s.closeReason = reason
+	}
+	s.mu.Unlock()
+}
+
+// Close closes the session with the reason(see SetCloseReason), it returns the
+// final statistics. It is fine to close it more than once.
+func (s *Session) Close(reason string) Stats {
+	s.SetCloseReason(reason)
+	if s.closed.CAS(false, true) {
+		s.counters.Active.Dec()
+	}
+	return s.Stats()
+}
+
+// Stats returns the statistics since the session starts.
+func (s *Session) Stats() Stats {
+	s.mu.Lock()
+	reason := s.closeReason
+	s.mu.Unlock()
+	return Stats{
+		Protocol:    s.protocol,
+		Duration:    time.Since(s.start),
+		BytesUp:     s.bytes[Up].Load(),
+		BytesDown:   s.bytes[Down].Load(),
+		PacketsUp:   s.packets[Up].Load(),
+		PacketsDown: s.packets[Down].Load(),
+		CloseReason: reason,
+	}
+}
+
+type countingWriter struct {
+	w         io.Writer
+	session   *Session
+	direction Direction
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	if n > 0 {
+		cw.session.Add(cw.direction, n)
+	}
+	return n, err
+}
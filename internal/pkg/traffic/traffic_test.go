@@ -0,0 +1,58 @@
+package traffic
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/damnever/goodog/internal/pkg/metrics"
+)
+
+func TestSession(t *testing.T) {
+	r := metrics.NewRegistry("")
+	counters := &Counters{
+		Sessions:    r.Counter("sessions", ""),
+		Active:      r.Gauge("active", ""),
+		BytesUp:     r.Counter("bytes", "", "direction", "up"),
+		BytesDown:   r.Counter("bytes", "", "direction", "down"),
+		PacketsUp:   r.Counter("packets", "", "direction", "up"),
+		PacketsDown: r.Counter("packets", "", "direction", "down"),
+	}
+
+	s := NewSession("tcp", counters)
+	buf := &bytes.Buffer{}
+	w := s.Writer(Down, buf)
+	n, err := w.Write([]byte("hello"))
+	require.Nil(t, err)
+	require.Equal(t, 5, n)
+	s.Add(Up, 3)
+	stats := s.Stats()
+	require.Equal(t, "tcp", stats.Protocol)
+	require.Equal(t, uint64(3), stats.BytesUp)
+	require.Equal(t, uint64(5), stats.BytesDown)
+	require.Len(t, stats.Fields(), 4)
+	require.Equal(t, int64(1), counters.Active.Load())
+	s.SetCloseReason("timeout")
+	stats = s.Close("eof")
+	require.Equal(t, "timeout", stats.CloseReason)
+	require.Len(t, stats.Fields(), 5)
+	s.Close("")
+	require.Equal(t, int64(0), counters.Active.Load())
+
+	s = NewSession("udp", counters)
+	s.AddPacket(Up, 10)
+	s.AddPacket(Up, 20)
+	s.AddPacket(Down, 100)
+	stats = s.Stats()
+	require.Equal(t, uint64(30), stats.BytesUp)
+	require.Equal(t, uint64(2), stats.PacketsUp)
+	require.Equal(t, uint64(1), stats.PacketsDown)
+	require.Len(t, stats.Fields(), 6)
+
+	require.Equal(t, uint64(2), counters.Sessions.Load())
+	require.Equal(t, uint64(33), counters.BytesUp.Load())
+	require.Equal(t, uint64(105), counters.BytesDown.Load())
+	require.Equal(t, uint64(2), counters.PacketsUp.Load())
+	require.Equal(t, uint64(1), counters.PacketsDown.Load())
+}
@@ -0,0 +1,183 @@
+//go:build linux
+// +build linux
+
+// Package transparent recovers the original destinations of the TCP connections
+// and the UDP packets redirected by iptables/nftables(REDIRECT and TPROXY).
+package transparent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Ref: linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h
+const (
+	soOriginalDst     = 80
+	ip6tSOOriginalDst = 80
+)
+
+// OriginalDst recovers the original destination of a connection redirected
+// by the REDIRECT target.
+func OriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("not a syscall.Conn: %T", conn)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	level, opt := unix.SOL_IP, soOriginalDst
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		level, opt = unix.SOL_IPV6, ip6tSOOriginalDst
+	}
+
+	var (
+		sa      unix.RawSockaddrAny
+		sockErr error
+	)
+	err = rc.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(sa))
+		_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, fd, uintptr(level), uintptr(opt),
+			uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			sockErr = errno
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("getsockopt SO_ORIGINAL_DST: %w", sockErr)
+	}
+	ip, port, err := parseRawSockaddr(&sa)
+	if err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// ListenTCP listens with IP_TRANSPARENT for the TPROXY target,
+// the local addresses of the accepted connections are the original destinations.
+func ListenTCP(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: transparentControl(false)}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// ListenUDP listens with IP_TRANSPARENT and IP_RECVORIGDSTADDR for
+// the TPROXY target, use ReadFromUDPWithDst to get the original destinations.
+func ListenUDP(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: transparentControl(true)}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// ListenUDPAt listens on the non-local address, the packets sent
+// from it look like they are coming from the original destination.
+func ListenUDPAt(laddr *net.UDPAddr) (*net.UDPConn, error) {
+	control := transparentControl(false)
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp", laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+func transparentControl(recvOrigDst bool) func(string, string, syscall.RawConn) error {
+	return func(network, _ string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			ipv6 := strings.HasSuffix(network, "6")
+			opts := [][2]int{{unix.SOL_IP, unix.IP_TRANSPARENT}}
+			if recvOrigDst {
+				opts = append(opts, [2]int{unix.SOL_IP, unix.IP_RECVORIGDSTADDR})
+			}
+			if ipv6 {
+				opts = append(opts, [2]int{unix.SOL_IPV6, unix.IPV6_TRANSPARENT})
+				if recvOrigDst {
+					opts = append(opts, [2]int{unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR})
+				}
+			}
+			for _, opt := range opts {
+				err := unix.SetsockoptInt(int(fd), opt[0], opt[1], 1)
+				// The IPv4 options are optional for the IPv6(dual-stack) sockets.
+				if err != nil && (!ipv6 || opt[0] == unix.SOL_IPV6) {
+					sockErr = fmt.Errorf("setsockopt(%d, %d): %w", opt[0], opt[1], err)
+					return
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// ReadFromUDPWithDst reads a packet and its original destination, the dst is
+// nil if it is absent.
+func ReadFromUDPWithDst(conn *net.UDPConn, b, oob []byte) (n int, src, dst *net.UDPAddr, err error) {
+	n, oobn, _, src, err := conn.ReadMsgUDP(b, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, src, nil, nil
+	}
+	for _, msg := range msgs {
+		if (msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_ORIGDSTADDR) ||
+			(msg.Header.Level == unix.SOL_IPV6 && msg.Header.Type == unix.IPV6_ORIGDSTADDR) {
+			var sa unix.RawSockaddrAny
+			copy((*[unix.SizeofSockaddrAny]byte)(unsafe.Pointer(&sa))[:], msg.Data)
+			ip, port, err := parseRawSockaddr(&sa)
+			if err != nil {
+				continue
+			}
+			return n, src, &net.UDPAddr{IP: ip, Port: port}, nil
+		}
+	}
+	return n, src, nil, nil
+}
+
+// OOBSize is enough for the IP_ORIGDSTADDR and IPV6_ORIGDSTADDR.
+var OOBSize = unix.CmsgSpace(unix.SizeofSockaddrInet6)
+
+func parseRawSockaddr(sa *unix.RawSockaddrAny) (net.IP, int, error) {
+	switch sa.Addr.Family {
+	case unix.AF_INET:
+		sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(sa))
+		p := (*[2]byte)(unsafe.Pointer(&sa4.Port))
+		return net.IP(append([]byte(nil), sa4.Addr[:]...)), int(p[0])<<8 | int(p[1]), nil
+	case unix.AF_INET6:
+		sa6 := (*unix.RawSockaddrInet6)(unsafe.Pointer(sa))
+		p := (*[2]byte)(unsafe.Pointer(&sa6.Port))
+		return net.IP(append([]byte(nil), sa6.Addr[:]...)), int(p[0])<<8 | int(p[1]), nil
+	default:
+		return nil, 0, fmt.Errorf("unknown address family: %d", sa.Addr.Family)
+	}
+}
@@ -0,0 +1,86 @@
+//go:build linux
+// +build linux
+
+package transparent
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseRawSockaddr(t *testing.T) {
+	var sa unix.RawSockaddrAny
+	sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(&sa))
+	sa4.Family = unix.AF_INET
+	sa4.Addr = [4]byte{10, 0, 0, 1}
+	p := (*[2]byte)(unsafe.Pointer(&sa4.Port))
+	p[0], p[1] = 0x01, 0xbb // Network byte order.
+	ip, port, err := parseRawSockaddr(&sa)
+	require.Nil(t, err)
+	require.Equal(t, "10.0.0.1", ip.String())
+	require.Equal(t, 443, port)
+
+	sa = unix.RawSockaddrAny{}
+	sa6 := (*unix.RawSockaddrInet6)(unsafe.Pointer(&sa))
+	sa6.Family = unix.AF_INET6
+	copy(sa6.Addr[:], net.ParseIP("fd00::1"))
+	p = (*[2]byte)(unsafe.Pointer(&sa6.Port))
+	p[0], p[1] = 0x00, 0x35
+	ip, port, err = parseRawSockaddr(&sa)
+	require.Nil(t, err)
+	require.Equal(t, "fd00::1", ip.String())
+	require.Equal(t, 53, port)
+
+	sa = unix.RawSockaddrAny{}
+	sa.Addr.Family = unix.AF_UNIX
+	_, _, err = parseRawSockaddr(&sa)
+	require.NotNil(t, err)
+}
+
+// TestOriginalDst redirects the connections in a new network namespace, it needs
+// the root and iptables.
+func TestOriginalDst(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("root is required")
+	}
+	if _, err := exec.LookPath("iptables"); err != nil {
+		t.Skip("iptables is required")
+	}
+	// The namespace is per thread, the thread is dropped once it is done since
+	// it is not unlocked.
+	runtime.LockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	for _, args := range [][]string{
+		{"ip", "link", "set", "lo", "up"},
+		{"iptables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-d", "127.0.0.2", "--dport", "80",
+			"-j", "REDIRECT", "--to-ports", strconv.Itoa(port)},
+	} {
+		out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+		require.Nil(t, err, string(out))
+	}
+
+	client, err := net.Dial("tcp", "127.0.0.2:80")
+	require.Nil(t, err)
+	defer client.Close()
+	conn, err := l.Accept()
+	require.Nil(t, err)
+	defer conn.Close()
+	dst, err := OriginalDst(conn)
+	require.Nil(t, err)
+	require.Equal(t, "127.0.0.2:80", dst.String())
+}
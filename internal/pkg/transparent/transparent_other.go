@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+package transparent
+
+import (
+	"errors"
+	"net"
+)
+
+var ErrUnsupported = errors.New("goodog/pkg/transparent: only supported on Linux")
+
+func OriginalDst(net.Conn) (*net.TCPAddr, error) {
+	return nil, ErrUnsupported
+}
+
+func ListenTCP(string) (net.Listener, error) {
+	return nil, ErrUnsupported
+}
+
+func ListenUDP(string) (*net.UDPConn, error) {
+	return nil, ErrUnsupported
+}
+
+func ListenUDPAt(*net.UDPAddr) (*net.UDPConn, error) {
+	return nil, ErrUnsupported
+}
+
+func ReadFromUDPWithDst(*net.UDPConn, []byte, []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	return 0, nil, nil, ErrUnsupported
+}
+
+var OOBSize = 0
@@ -1,18 +1,23 @@
 package test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	_ "net/http/pprof" // Import pprof
 	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -21,11 +26,15 @@ import (
 	caddycmd "github.com/caddyserver/caddy/v2/cmd"
 	_ "github.com/caddyserver/caddy/v2/modules/standard" // Plug in Caddy module
 	randext "github.com/damnever/libext-go/rand"
+	"github.com/lucas-clemente/quic-go/http3"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
 
 	_ "github.com/damnever/goodog/backend/caddy" // Plug in Caddy module
 	"github.com/damnever/goodog/frontend"
+	"github.com/damnever/goodog/internal/pkg/protocol"
 )
 
 func TestGoodog(t *testing.T) {
@@ -59,23 +68,110 @@ func TestGoodog(t *testing.T) {
 	resp.Body.Close()
 
 	t.Run("no-compression", func(subt *testing.T) {
-		testWithArgs(ctx, subt, backendaddr, url.Values{
+		testWithArgs(ctx, subt, backendaddr, "caddy-http3", url.Values{
 			"version": []string{"v1"},
 		})
 	})
 
 	t.Run("snappy-compression", func(subt *testing.T) {
-		testWithArgs(ctx, subt, backendaddr, url.Values{
+		testWithArgs(ctx, subt, backendaddr, "caddy-http3", url.Values{
 			"version":     []string{"v1"},
 			"compression": []string{"snappy"},
 		})
 	})
 
+	for _, method := range []string{"zstd:fastest", "lz4", "gzip:1", "adaptive"} {
+		method := method
+		t.Run(method+"-compression", func(subt *testing.T) {
+			testWithArgs(ctx, subt, backendaddr, "caddy-http2", url.Values{
+				"version":     []string{"v1"},
+				"compression": []string{method},
+			})
+		})
+	}
+
+	t.Run("caddy-http2", func(subt *testing.T) {
+		testWithArgs(ctx, subt, backendaddr, "caddy-http2", url.Values{
+			"version":     []string{"v1"},
+			"compression": []string{"snappy"},
+		})
+	})
+
+	t.Run("yamux", func(subt *testing.T) {
+		testWithArgs(ctx, subt, backendaddr, "caddy-http3", url.Values{
+			"version":     []string{"v1"},
+			"compression": []string{"snappy"},
+			"mux":         []string{"yamux"},
+		})
+	})
+
+	t.Run("udp-mux", func(subt *testing.T) {
+		testWithArgs(ctx, subt, backendaddr, "caddy-http3", url.Values{
+			"version":     []string{"v1"},
+			"compression": []string{"snappy"},
+			"udp-mux":     []string{"packet"},
+		})
+	})
+
+	t.Run("failover", func(subt *testing.T) {
+		testWithArgs(ctx, subt, backendaddr, "caddy-http2", url.Values{
+			"version": []string{"v1"},
+		}, "https://knock:knock@"+findaddr(t)+"/?version=v1") // Nothing listens on it.
+	})
+
+	t.Run("connect-timeout", func(subt *testing.T) {
+		testConnectTimeout(ctx, subt)
+	})
+
+	t.Run("warm-pool", func(subt *testing.T) {
+		testWarmPool(subt)
+	})
+
+	t.Run("socks5", func(subt *testing.T) {
+		testSOCKS5(ctx, subt, backendaddr, remoteaddr)
+	})
+
+	t.Run("http-connect", func(subt *testing.T) {
+		testHTTPConnect(ctx, subt, backendaddr, remoteaddr)
+	})
+
+	t.Run("probe", func(subt *testing.T) {
+		testProbe(ctx, subt, backendaddr)
+	})
+
+	t.Run("admin", func(subt *testing.T) {
+		testAdmin(ctx, subt, backendaddr)
+	})
+
+	t.Run("reload", func(subt *testing.T) {
+		testReload(ctx, subt, backendaddr)
+	})
+
+	t.Run("negotiation", func(subt *testing.T) {
+		testNegotiation(subt, backendaddr)
+	})
+
+	t.Run("masque", func(subt *testing.T) {
+		testMASQUE(subt, backendaddr, remoteaddr)
+	})
+
+	t.Run("masque-extended-connect", func(subt *testing.T) {
+		testMASQUEExtendedConnect(subt, backendaddr, remoteaddr)
+	})
+
+	t.Run("backend-metrics", func(subt *testing.T) {
+		testBackendMetrics(subt)
+	})
+
+	t.Run("backend-admin", func(subt *testing.T) {
+		testBackendAdmin(ctx, subt, backendaddr, remoteaddr)
+	})
+
 	os.Args = []string{"caddy", "stop"}
 	caddycmd.Main()
 }
 
-func testWithArgs(ctx context.Context, t *testing.T, backendaddr string, args url.Values) {
+func testWithArgs(ctx context.Context, t *testing.T, backendaddr string, connector string, args url.Values, servers ...string) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
@@ -84,7 +180,8 @@ func testWithArgs(ctx context.Context, t *testing.T, backendaddr string, args ur
 	proxy, err := frontend.NewProxy(frontend.Config{
 		ListenAddr:         frontendaddr,
 		ServerURI:          "https://knock:knock@" + backendaddr + "/?" + args.Encode(),
-		Connector:          "caddy-http3",
+		ServerURIs:         servers,
+		Connector:          connector,
 		LogLevel:           "debug",
 		InsecureSkipVerify: true,
 		Timeout:            30 * time.Second,
@@ -153,6 +250,646 @@ func testWithArgs(ctx context.Context, t *testing.T, backendaddr string, args ur
 	wg.Wait()
 }
 
+func testConnectTimeout(ctx context.Context, t *testing.T) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The response header is delayed until the frontend gives up.
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(3 * time.Second):
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	listenaddr := findaddr(t)
+	proxy, err := frontend.NewProxy(frontend.Config{
+		ListenAddr:         listenaddr,
+		ServerURI:          strings.Replace(backend.URL, "https://", "https://knock:knock@", 1) + "/?version=v1",
+		Connector:          "caddy-http2",
+		LogLevel:           "debug",
+		InsecureSkipVerify: true,
+		ConnectTimeout:     333 * time.Millisecond,
+	})
+	require.Nil(t, err)
+	defer proxy.Close()
+	go proxy.Serve(ctx)
+	time.Sleep(333 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", listenaddr)
+	require.Nil(t, err)
+	defer conn.Close()
+	start := time.Now()
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(make([]byte, 7))
+	require.Equal(t, io.EOF, err) // Closed once the connect times out.
+	require.True(t, time.Since(start) < 2*time.Second, time.Since(start))
+}
+
+func testWarmPool(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		peers = map[string]bool{} // Every QUIC connection has its own UDP socket.
+		pings int
+	)
+	certServer := httptest.NewUnstartedServer(nil)
+	certServer.StartTLS()
+	certServer.Close()
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer pconn.Close()
+	backend := &http3.Server{
+		Server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodHead {
+					mu.Lock()
+					pings++
+					mu.Unlock()
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}),
+			TLSConfig: certServer.TLS,
+		},
+	}
+	go func() {
+		_ = backend.Serve(&peersPacketConn{PacketConn: pconn, seen: func(addr net.Addr) {
+			mu.Lock()
+			peers[addr.String()] = true
+			mu.Unlock()
+		}})
+	}()
+	defer backend.Close()
+
+	warmConns := 2
+	proxy, err := frontend.NewProxy(frontend.Config{
+		ListenAddr:         findaddr(t),
+		ServerURI:          "https://knock:knock@" + pconn.LocalAddr().String() + "/?version=v1",
+		Connector:          "caddy-http3",
+		LogLevel:           "info",
+		InsecureSkipVerify: true,
+		WarmConns:          warmConns,
+		ConnIdleTimeout:    time.Second, // Pinged every 500ms.
+	})
+	require.Nil(t, err)
+	defer proxy.Close()
+
+	// Nothing is connected through the proxy, the tcp and the udp pools are warmed anyway.
+	ok := false
+	for i := 0; i < 30 && !ok; i++ {
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		ok = len(peers) == 2*warmConns
+		mu.Unlock()
+	}
+	require.True(t, ok, "warm connections: %d", len(peers))
+
+	w := httptest.NewRecorder()
+	proxy.AdminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/http3-pools", nil))
+	var pools []struct {
+		Conns []struct {
+			Streams int `json:"streams"`
+		} `json:"conns"`
+	}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &pools))
+	require.Len(t, pools, 2)
+	for _, pool := range pools {
+		require.Len(t, pool.Conns, warmConns)
+	}
+
+	// The warm connections are pinged periodically, no more connections are made.
+	time.Sleep(1500 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	require.True(t, pings >= 2*len(peers), "pings: %d", pings)
+	require.Len(t, peers, 2*warmConns)
+}
+
+// peersPacketConn reports the peers it reads from.
+type peersPacketConn struct {
+	net.PacketConn
+	seen func(net.Addr)
+}
+
+func (c *peersPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil {
+		c.seen(addr)
+	}
+	return n, addr, err
+}
+
+func testSOCKS5(ctx context.Context, t *testing.T, backendaddr string, remoteaddr string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	socks5addr := findaddr(t)
+	proxy, err := frontend.NewProxy(frontend.Config{
+		SOCKS5ListenAddr:   socks5addr,
+		ServerURI:          "https://knock:knock@" + backendaddr + "/?version=v1",
+		Connector:          "caddy-http3",
+		LogLevel:           "debug",
+		InsecureSkipVerify: true,
+		Timeout:            30 * time.Second,
+	})
+	require.Nil(t, err)
+	defer proxy.Close()
+	go proxy.Serve(ctx)
+	time.Sleep(333 * time.Millisecond)
+
+	host, portstr, err := net.SplitHostPort(remoteaddr)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(portstr)
+	require.Nil(t, err)
+
+	conn, err := net.Dial("tcp", socks5addr)
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte{0x05, 0x01, 0x00})
+	require.Nil(t, err)
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	require.Nil(t, err)
+	require.Equal(t, []byte{0x05, 0x00}, buf)
+
+	req := []byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}
+	req = append(req, host...)
+	req = append(req, byte(port>>8), byte(port))
+	_, err = conn.Write(req)
+	require.Nil(t, err)
+	buf = make([]byte, 10) // | ver | rep | rsv | atyp(ipv4) | bnd.addr | bnd.port |
+	_, err = io.ReadFull(conn, buf)
+	require.Nil(t, err)
+	require.Equal(t, byte(0x00), buf[1])
+
+	for j := 22; j < 99; j++ {
+		value := randext.String(j)
+		_, err := conn.Write([]byte(value))
+		require.Nil(t, err)
+		buf := make([]byte, len(value))
+		_, err = io.ReadFull(conn, buf)
+		require.Nil(t, err)
+		require.Equal(t, value, string(buf))
+	}
+}
+
+func testHTTPConnect(ctx context.Context, t *testing.T, backendaddr string, remoteaddr string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	httpaddr := findaddr(t)
+	proxy, err := frontend.NewProxy(frontend.Config{
+		HTTPListenAddr:     httpaddr,
+		ServerURI:          "https://knock:knock@" + backendaddr + "/?version=v1",
+		Connector:          "caddy-http3",
+		LogLevel:           "debug",
+		InsecureSkipVerify: true,
+		Timeout:            30 * time.Second,
+	})
+	require.Nil(t, err)
+	defer proxy.Close()
+	go proxy.Serve(ctx)
+	time.Sleep(333 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", httpaddr)
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", remoteaddr, remoteaddr)
+	require.Nil(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for j := 22; j < 99; j++ {
+		value := randext.String(j)
+		_, err := conn.Write([]byte(value))
+		require.Nil(t, err)
+		buf := make([]byte, len(value))
+		_, err = io.ReadFull(conn, buf)
+		require.Nil(t, err)
+		require.Equal(t, value, string(buf))
+	}
+}
+
+func testProbe(ctx context.Context, t *testing.T, backendaddr string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	proxy, err := frontend.NewProxy(frontend.Config{
+		ListenAddr:         findaddr(t),
+		ServerURI:          "https://knock:knock@" + backendaddr + "/?version=v1",
+		Connector:          "caddy-http3",
+		LogLevel:           "debug",
+		InsecureSkipVerify: true,
+		ProbeInterval:      time.Minute,
+	})
+	require.Nil(t, err)
+	defer proxy.Close()
+	go proxy.Serve(ctx)
+	time.Sleep(666 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	proxy.StatusHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var results []struct {
+		Server   string `json:"server"`
+		Healthy  bool   `json:"healthy"`
+		Features string `json:"features"`
+	}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &results))
+	require.Len(t, results, 1)
+	require.Equal(t, backendaddr, results[0].Server)
+	require.True(t, results[0].Healthy)
+	require.Contains(t, results[0].Features, "compression=zstd")
+
+	w = httptest.NewRecorder()
+	frontend.MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Contains(t, w.Body.String(), `goodog_frontend_probes_successes_total{server="`+backendaddr+`"}`)
+	require.Contains(t, w.Body.String(), "# TYPE goodog_frontend_tcp_connect_seconds histogram")
+}
+
+func testAdmin(ctx context.Context, t *testing.T, backendaddr string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	listenaddr := findaddr(t)
+	proxy, err := frontend.NewProxy(frontend.Config{
+		ListenAddr:         listenaddr,
+		ServerURI:          "https://knock:knock@" + backendaddr + "/?version=v1",
+		Connector:          "caddy-http3",
+		LogLevel:           "info",
+		InsecureSkipVerify: true,
+	})
+	require.Nil(t, err)
+	defer proxy.Close()
+	go proxy.Serve(ctx)
+	time.Sleep(666 * time.Millisecond)
+	admin := proxy.AdminHandler()
+
+	conn, err := net.Dial("tcp", listenaddr)
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("admin"))
+	require.Nil(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.Nil(t, err)
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sessions", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var sessions []struct {
+		ID        uint64 `json:"id"`
+		Network   string `json:"network"`
+		Upstream  string `json:"upstream"`
+		BytesUp   uint64 `json:"bytes_up"`
+		BytesDown uint64 `json:"bytes_down"`
+	}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &sessions))
+	require.Len(t, sessions, 1)
+	require.Equal(t, "tcp", sessions[0].Network)
+	require.Equal(t, backendaddr, sessions[0].Upstream)
+	require.Equal(t, uint64(5), sessions[0].BytesUp)
+	require.Equal(t, uint64(5), sessions[0].BytesDown)
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/http3-pools", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"server":"`+backendaddr+`"`)
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/sessions/%d", sessions[0].ID), nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+	_, err = conn.Read(buf)
+	require.Equal(t, io.EOF, err)
+	for i := 0; i < 30; i++ { // It is removed once the other stream is done.
+		w = httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/sessions/%d", sessions[0].ID), nil))
+		if w.Code == http.StatusNotFound {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/log-level", strings.NewReader(`{"level":"debug"}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/log-level", nil))
+	require.JSONEq(t, `{"level":"debug"}`, w.Body.String())
+}
+
+func testReload(ctx context.Context, t *testing.T, backendaddr string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	listenaddr, socks5addr := findaddr(t), findaddr(t)
+	conf := frontend.Config{
+		ListenAddr:         listenaddr,
+		ServerURI:          "https://knock:knock@" + backendaddr + "/?version=v1",
+		Connector:          "caddy-http3",
+		LogLevel:           "debug",
+		InsecureSkipVerify: true,
+		Timeout:            30 * time.Second,
+	}
+	proxy, err := frontend.NewProxy(conf)
+	require.Nil(t, err)
+	defer proxy.Close()
+	go proxy.Serve(ctx)
+	time.Sleep(333 * time.Millisecond)
+
+	echo := func(conn net.Conn) {
+		value := randext.String(33)
+		_, err := conn.Write([]byte(value))
+		require.Nil(t, err)
+		buf := make([]byte, len(value))
+		_, err = io.ReadFull(conn, buf)
+		require.Nil(t, err)
+		require.Equal(t, value, string(buf))
+	}
+	conn, err := net.Dial("tcp", listenaddr)
+	require.Nil(t, err)
+	defer conn.Close()
+	echo(conn)
+
+	conf.ListenAddr = ""
+	conf.Listeners = []frontend.Listener{{Kind: frontend.ListenerSOCKS5, Addr: socks5addr}}
+	conf.Compression = "snappy"
+	require.Nil(t, proxy.Reload(conf))
+	conf.Listeners = append(conf.Listeners, frontend.Listener{Kind: "unknown", Addr: findaddr(t)})
+	require.NotNil(t, proxy.Reload(conf)) // Nothing is changed.
+	time.Sleep(333 * time.Millisecond)
+
+	echo(conn) // The existing sessions are not affected.
+	_, err = net.Dial("tcp", listenaddr)
+	require.NotNil(t, err)
+	socks5conn, err := net.Dial("tcp", socks5addr)
+	require.Nil(t, err)
+	defer socks5conn.Close()
+	_, err = socks5conn.Write([]byte{0x05, 0x01, 0x00})
+	require.Nil(t, err)
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(socks5conn, buf)
+	require.Nil(t, err)
+	require.Equal(t, []byte{0x05, 0x00}, buf)
+}
+
+func testNegotiation(t *testing.T, backendaddr string) {
+	client := &http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	for _, c := range []struct {
+		compression string
+		status      int
+	}{
+		{"zstd:fastest", http.StatusOK},
+		{"brotli", http.StatusBadRequest},
+	} {
+		uri := "https://knock:knock@" + backendaddr + "/?version=v1&protocol=tcp&compression=" + c.compression
+		resp, err := client.Post(uri, "application/octet-stream", http.NoBody)
+		require.Nil(t, err)
+		resp.Body.Close()
+		require.Equal(t, c.status, resp.StatusCode)
+		require.Contains(t, resp.Header.Get(protocol.HeaderFeatures), "compression=lz4")
+		if c.status == http.StatusOK {
+			require.Equal(t, "v1", resp.Header.Get(protocol.HeaderVersion))
+			require.Equal(t, c.compression, resp.Header.Get(protocol.HeaderCompression))
+		}
+	}
+}
+
+func testMASQUE(t *testing.T, backendaddr string, remoteaddr string) {
+	host, port, err := net.SplitHostPort(remoteaddr)
+	require.Nil(t, err)
+	conn, err := tls.Dial("tcp", backendaddr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	require.Nil(t, err)
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(conn, "GET /?h=%s&p=%s HTTP/1.1\r\nHost: %s\r\n"+
+		"Authorization: Basic a25vY2s6a25vY2s=\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\n"+
+		"Capsule-Protocol: ?1\r\n\r\n", host, port, backendaddr)
+	require.Nil(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	buf := make([]byte, 128)
+	for j := 22; j < 99; j++ {
+		value := randext.String(j)
+		_, err := conn.Write(protocol.AppendUDPCapsule(nil, []byte(value)))
+		require.Nil(t, err)
+		n, err := protocol.ReadUDPCapsule(br, buf)
+		require.Nil(t, err)
+		require.Equal(t, value, string(buf[:n]))
+	}
+}
+
+// testMASQUEExtendedConnect speaks the HTTP/2 frames directly, since the HTTP clients
+// refuse to send the :protocol.
+func testMASQUEExtendedConnect(t *testing.T, backendaddr string, remoteaddr string) {
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		t.Skip("the HTTP/2 server of Go accepts the extended CONNECT with GODEBUG=http2xconnect=1 only")
+	}
+	host, port, err := net.SplitHostPort(remoteaddr)
+	require.Nil(t, err)
+	conn, err := tls.Dial("tcp", backendaddr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(http2.ClientPreface))
+	require.Nil(t, err)
+	framer := http2.NewFramer(conn, conn)
+	require.Nil(t, framer.WriteSettings())
+
+	for { // SETTINGS_ENABLE_CONNECT_PROTOCOL(0x8) must be advertised.
+		frame, err := framer.ReadFrame()
+		require.Nil(t, err)
+		if settings, ok := frame.(*http2.SettingsFrame); ok && !settings.IsAck() {
+			v, ok := settings.Value(http2.SettingID(0x8))
+			require.True(t, ok && v == 1)
+			require.Nil(t, framer.WriteSettingsAck())
+			break
+		}
+	}
+
+	var block bytes.Buffer
+	encoder := hpack.NewEncoder(&block)
+	for _, field := range []hpack.HeaderField{
+		{Name: ":method", Value: http.MethodConnect},
+		{Name: ":protocol", Value: protocol.MASQUEUpgradeToken},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: backendaddr},
+		{Name: ":path", Value: fmt.Sprintf("/?h=%s&p=%s", host, port)},
+		{Name: "authorization", Value: "Basic a25vY2s6a25vY2s="},
+		{Name: "capsule-protocol", Value: "?1"},
+	} {
+		require.Nil(t, encoder.WriteField(field))
+	}
+	require.Nil(t, framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block.Bytes(), EndHeaders: true}))
+
+	// The DATA frames of the stream are piped so that the capsules can be read across them.
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	status := make(chan string, 1)
+	go func() {
+		decoder := hpack.NewDecoder(4096, nil)
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			switch frame := frame.(type) {
+			case *http2.HeadersFrame:
+				fields, err := decoder.DecodeFull(frame.HeaderBlockFragment())
+				if err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+				for _, field := range fields {
+					if field.Name == ":status" {
+						status <- field.Value
+					}
+				}
+			case *http2.DataFrame:
+				if _, err := pw.Write(frame.Data()); err != nil {
+					return
+				}
+			case *http2.RSTStreamFrame:
+				pw.CloseWithError(http2.StreamError{StreamID: frame.StreamID, Code: frame.ErrCode})
+				return
+			}
+		}
+	}()
+	select {
+	case s := <-status:
+		require.Equal(t, "200", s)
+	case <-time.After(3 * time.Second):
+		t.Fatal("no response")
+	}
+
+	buf := make([]byte, 128)
+	for j := 22; j < 99; j++ {
+		value := randext.String(j)
+		require.Nil(t, framer.WriteData(1, false, protocol.AppendUDPCapsule(nil, []byte(value))))
+		n, err := protocol.ReadUDPCapsule(pr, buf)
+		require.Nil(t, err)
+		require.Equal(t, value, string(buf[:n]))
+	}
+}
+
+func testBackendMetrics(t *testing.T) {
+	resp, err := http.Get("http://localhost:2019/goodog/metrics")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	for _, name := range []string{
+		`goodog_backend_traffic_sessions_total{protocol="tcp"}`,
+		`goodog_backend_traffic_bytes_total{protocol="udp",direction="up"}`,
+		`goodog_backend_traffic_active{protocol="masque"}`,
+		`goodog_backend_rejected_requests_total{reason="bad-compression"}`, // By the negotiation.
+		`goodog_backend_session_seconds_count{protocol="tcp"}`,
+		`goodog_backend_compression_raw_bytes_total`,
+		`goodog_backend_compression_ratio_count`,
+	} {
+		require.Contains(t, string(body), name)
+	}
+}
+
+func testBackendAdmin(ctx context.Context, t *testing.T, backendaddr string, remoteaddr string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	listenaddr := findaddr(t)
+	proxy, err := frontend.NewProxy(frontend.Config{
+		ListenAddr:         listenaddr,
+		ServerURI:          "https://knock:knock@" + backendaddr + "/?version=v1",
+		Connector:          "caddy-http3",
+		LogLevel:           "info",
+		InsecureSkipVerify: true,
+	})
+	require.Nil(t, err)
+	defer proxy.Close()
+	go proxy.Serve(ctx)
+	time.Sleep(666 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", listenaddr)
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("admin"))
+	require.Nil(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.Nil(t, err)
+
+	adminDo := func(method, uri string, v interface{}) int {
+		req, err := http.NewRequest(method, "http://localhost:2019"+uri, nil)
+		require.Nil(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		if v != nil && resp.StatusCode == http.StatusOK {
+			require.Nil(t, json.NewDecoder(resp.Body).Decode(v))
+		}
+		return resp.StatusCode
+	}
+
+	var sessions map[string][]struct {
+		ID       uint64 `json:"id"`
+		User     string `json:"user"`
+		Upstream string `json:"upstream"`
+		Protocol string `json:"protocol"`
+		BytesUp  uint64 `json:"bytes_up"`
+	}
+	require.Equal(t, http.StatusOK, adminDo(http.MethodGet, "/goodog/sessions?user=knock", &sessions))
+	id := uint64(0)
+	for _, session := range sessions["test"] { // The UDP sessions of the others may be still alive.
+		if session.Protocol == "tcp" {
+			require.Equal(t, uint64(0), id)
+			require.Equal(t, remoteaddr, session.Upstream)
+			require.Equal(t, uint64(5), session.BytesUp)
+			id = session.ID
+		}
+	}
+	require.NotEqual(t, uint64(0), id)
+
+	var stats struct {
+		Protocols map[string]struct {
+			Sessions uint64 `json:"sessions"`
+			Active   int64  `json:"active"`
+		} `json:"protocols"`
+		Handlers map[string]struct {
+			Users map[string]int `json:"users"`
+		} `json:"handlers"`
+	}
+	require.Equal(t, http.StatusOK, adminDo(http.MethodGet, "/goodog/stats", &stats))
+	require.True(t, stats.Protocols["tcp"].Sessions > 0)
+	require.True(t, stats.Handlers["test"].Users["knock"] > 0)
+
+	var result struct {
+		Terminated int `json:"terminated"`
+	}
+	require.Equal(t, http.StatusBadRequest, adminDo(http.MethodDelete, "/goodog/sessions", nil))
+	require.Equal(t, http.StatusOK, adminDo(http.MethodDelete, "/goodog/sessions?user=knock", &result))
+	require.True(t, result.Terminated > 0)
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+	_, err = conn.Read(buf)
+	require.Equal(t, io.EOF, err)
+	status := 0
+	for i := 0; i < 30; i++ { // It is removed once the other stream is done.
+		if status = adminDo(http.MethodDelete, fmt.Sprintf("/goodog/sessions/%d", id), nil); status == http.StatusNotFound {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Equal(t, http.StatusNotFound, status)
+}
+
 func findaddr(t *testing.T) string {
 	l, err := net.Listen("tcp", "localhost:0")
 	if err != nil {